@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// multipartMemory is the part of a multipart request that is kept in memory, the rest goes to temporary files
+	multipartMemory = 1 << 20
+	// sniffLength is the number of bytes that http.DetectContentType looks at
+	sniffLength = 512
+)
+
+// Attachment is a file that has been uploaded with the send request
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"`
+}
+
+// AttachmentLimits restricts the attachments that are allowed for a recipient
+type AttachmentLimits struct {
+	MaxCount int      `json:"maxCount"`
+	MaxSize  int64    `json:"maxSize"`
+	Types    []string `json:"types"`
+}
+
+// allows returns true if the sniffed content type is in the list of allowed types.
+// Types may end with a wildcard like image/*, an empty list allows all types.
+func (limits *AttachmentLimits) allows(contentType string) bool {
+	if len(limits.Types) == 0 {
+		return true
+	}
+	for _, allowed := range limits.Types {
+		if allowed == contentType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// readMultipartRequest parses a multipart/form-data send request. The well known form values are mapped
+// to the fields of SendMailRequest, all other values become custom fields and all files become attachments.
+func readMultipartRequest(r *http.Request) (SendMailRequest, []*Attachment, error) {
+	var request SendMailRequest
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		return request, nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	for name, values := range r.MultipartForm.Value {
+		if len(values) != 1 {
+			return request, nil, fmt.Errorf("form value %v must be given exactly once", name)
+		}
+		value := values[0]
+		switch name {
+		case "Token":
+			request.Token = value
+		case "From":
+			request.From = value
+		case "To":
+			request.To = value
+		case "Subject":
+			request.Subject = value
+		case "Body":
+			request.Body = value
+		case "Challenge":
+			request.Challenge = value
+		case "Nonce":
+			request.Nonce = value
+		case "Captcha", "h-captcha-response", "g-recaptcha-response", "cf-turnstile-response":
+			// the form fields of the captcha widgets are accepted as well
+			request.Captcha = value
+		default:
+			if request.Fields == nil {
+				request.Fields = make(map[string]string)
+			}
+			request.Fields[name] = value
+		}
+	}
+
+	var attachments []*Attachment
+	for _, files := range r.MultipartForm.File {
+		for _, header := range files {
+			attachment, err := readAttachment(header)
+			if err != nil {
+				return request, nil, err
+			}
+			attachments = append(attachments, attachment)
+		}
+	}
+	return request, attachments, nil
+}
+
+// readAttachment reads an uploaded file. The content type is sniffed from the content,
+// the one that the client sent is ignored.
+func readAttachment(header *multipart.FileHeader) (*Attachment, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("attachment %v is empty", header.Filename)
+	}
+	sniff := data
+	if len(sniff) > sniffLength {
+		sniff = sniff[:sniffLength]
+	}
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(sniff))
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{
+		Filename:    sanitizeFilename(header.Filename),
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
+
+// sanitizeFilename strips directories and control characters from a client supplied file name
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+// validateAttachments checks the uploaded files against the attachment limits of the recipient.
+// Recipients without limits do not accept attachments at all.
+func (o *RecipientOptions) validateAttachments(attachments []*Attachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	if o == nil || o.Attachments == nil {
+		return errors.New("attachments are not allowed for this recipient")
+	}
+	limits := o.Attachments
+	if limits.MaxCount > 0 && len(attachments) > limits.MaxCount {
+		return fmt.Errorf("%d attachments, only %d are allowed", len(attachments), limits.MaxCount)
+	}
+	var size int64
+	for _, attachment := range attachments {
+		if !limits.allows(attachment.ContentType) {
+			return fmt.Errorf("attachment %v has type %v which is not allowed", attachment.Filename, attachment.ContentType)
+		}
+		size += int64(len(attachment.Data))
+	}
+	if limits.MaxSize > 0 && size > limits.MaxSize {
+		return fmt.Errorf("attachments have %d bytes, only %d are allowed", size, limits.MaxSize)
+	}
+	return nil
+}
+
+// isMultipart returns true if the request has a multipart/form-data body
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+var (
+	pdfContent = []byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	pngContent = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+)
+
+func TestController_SendMail_Multipart(t *testing.T) {
+	ms := &MockMailServer{}
+	c := newController(ms, &MockActiveTokens{}, &MockTarpit{})
+	c.recipients = map[string]*RecipientOptions{
+		"jobs": {Attachments: &AttachmentLimits{MaxCount: 2, MaxSize: 1024, Types: []string{"application/pdf", "image/*"}}},
+	}
+
+	// the client claims a wrong content type, it must be sniffed from the content
+	req := newMultipartRequest(t, map[string]string{"To": "jobs", "phone": "0123"}, map[string][]byte{"../../cv.pdf": pdfContent})
+	rr := doRequestController(req, c)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("Wrong status: %d, should be %d", status, http.StatusCreated)
+	}
+	if ms.sent == nil || len(ms.sent.attachments) != 1 {
+		t.Fatalf("Expected a message with one attachment, got %+v", ms.sent)
+	}
+	attachment := ms.sent.attachments[0]
+	if attachment.Filename != "cv.pdf" || attachment.ContentType != "application/pdf" {
+		t.Errorf("Wrong attachment: %v (%v)", attachment.Filename, attachment.ContentType)
+	}
+	if ms.sent.recipientID != "jobs" || ms.sent.subject != "SUBJECT" || ms.sent.fields["phone"] != "0123" {
+		t.Errorf("Form values not mapped to message: %+v", ms.sent)
+	}
+}
+
+func TestController_SendMail_MultipartRejected(t *testing.T) {
+	ms := &MockMailServer{}
+	c := newController(ms, &MockActiveTokens{}, &MockTarpit{})
+	c.recipients = map[string]*RecipientOptions{
+		"jobs": {Attachments: &AttachmentLimits{MaxCount: 2, MaxSize: 100, Types: []string{"application/pdf", "image/*"}}},
+	}
+	c.uploadLimit = 4096
+
+	requests := map[string]*http.Request{
+		"wrong type":    newMultipartRequest(t, map[string]string{"To": "jobs"}, map[string][]byte{"cv.pdf": []byte("#!/bin/sh\nrm -rf /\n")}),
+		"too many":      newMultipartRequest(t, map[string]string{"To": "jobs"}, map[string][]byte{"a.pdf": pdfContent, "b.png": pngContent, "c.pdf": pdfContent}),
+		"too big":       newMultipartRequest(t, map[string]string{"To": "jobs"}, map[string][]byte{"a.pdf": bytes.Repeat(pdfContent, 2), "b.pdf": bytes.Repeat(pdfContent, 2)}),
+		"not allowed":   newMultipartRequest(t, map[string]string{"To": "other"}, map[string][]byte{"a.pdf": pdfContent}),
+		"upload limit":  newMultipartRequest(t, map[string]string{"To": "jobs"}, map[string][]byte{"a.pdf": bytes.Repeat(pdfContent, 200)}),
+		"missing token": newMultipartRequest(t, map[string]string{"To": "jobs", "Token": ""}, nil),
+	}
+	for name, req := range requests {
+		rr := doRequestController(req, c)
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: Wrong status: %d, should be %d", name, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAttachment_ValidateSize(t *testing.T) {
+	t.Parallel()
+	options := &RecipientOptions{Attachments: &AttachmentLimits{MaxSize: 100}}
+	small := &Attachment{Filename: "a.pdf", ContentType: "application/pdf", Data: pdfContent}
+	if err := options.validateAttachments([]*Attachment{small}); err != nil {
+		t.Errorf("Error: attachment within limits did not validate: %v", err)
+	}
+	if err := options.validateAttachments([]*Attachment{small, small, small}); err == nil {
+		t.Errorf("Error: attachments exceeding the total size validated")
+	}
+}
+
+func TestAttachment_SanitizeFilename(t *testing.T) {
+	t.Parallel()
+	names := map[string]string{
+		"cv.pdf":                "cv.pdf",
+		"../../etc/passwd":      "passwd",
+		"C:\\Users\\me\\cv.pdf": "cv.pdf",
+		"evil\r\nBcc: x\".pdf":  "evilBcc: x.pdf",
+		"":                      "attachment",
+		"/":                     "attachment",
+	}
+	for name, expected := range names {
+		if got := sanitizeFilename(name); got != expected {
+			t.Errorf("sanitizeFilename(%q) is %q but should be %q", name, got, expected)
+		}
+	}
+}
+
+func TestMessage_ComposeAttachments(t *testing.T) {
+	t.Parallel()
+	msg := &EmailMessage{
+		from: "from@example.com", recipientID: "jobs", subject: "SUBJECT", body: "BODY",
+		attachments: []*Attachment{{Filename: "lebenslauf ä.pdf", ContentType: "application/pdf", Data: bytes.Repeat(pdfContent, 10)}},
+	}
+	raw, err := composeMessage(msg, "", &Recipients{To: []string{"to@example.com"}}, nil)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing composed message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Wrong content type: %v (%v)", mediaType, err)
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	body, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("Error reading body part: %v", err)
+	}
+	if content, _ := ioutil.ReadAll(body); string(content) != "BODY" {
+		t.Errorf("Wrong body part: %v", string(content))
+	}
+	file, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("Error reading attachment part: %v", err)
+	}
+	if file.FileName() != "lebenslauf ä.pdf" {
+		t.Errorf("Wrong attachment file name: %v", file.FileName())
+	}
+	if encoding := file.Header.Get("Content-Transfer-Encoding"); encoding != "base64" {
+		t.Errorf("Wrong attachment encoding: %v", encoding)
+	}
+	encoded, _ := ioutil.ReadAll(file)
+	for _, line := range strings.Split(string(encoded), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("base64 line too long: %d", len(line))
+		}
+	}
+}
+
+// HELPER METHODS
+func newMultipartRequest(t *testing.T, values map[string]string, files map[string][]byte) *http.Request {
+	defaults := map[string]string{"Token": "TOKEN", "From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY"}
+	for name, value := range values {
+		defaults[name] = value
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range defaults {
+		if err := w.WriteField(name, value); err != nil {
+			t.Fatalf("Error writing form field: %v", err)
+		}
+	}
+	for name, content := range files {
+		part, err := w.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("Error writing form file: %v", err)
+		}
+		part.Write(content)
+	}
+	w.Close()
+	req, _ := http.NewRequest("POST", "/send", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	netmail "net/mail"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	// defaultAutoReplyPerAddress is the number of auto replies that an address gets within the interval
+	defaultAutoReplyPerAddress = 1
+	// defaultAutoReplyTotal is the number of auto replies to all addresses within the interval
+	defaultAutoReplyTotal = 100
+	// defaultAutoReplyInterval is the interval of the auto reply limits in seconds
+	defaultAutoReplyInterval = 3600
+	// defaultAutoReplySubject is the subject template of auto replies without a configured subject
+	defaultAutoReplySubject = "Re: {{.Subject}} [{{.Ticket}}]"
+	// defaultAutoReplyText is the text template of auto replies without configured templates
+	defaultAutoReplyText = `Thank you for your message, we will get back to you as soon as possible.
+Your reference is {{.Ticket}}.
+
+--- Your message ---
+Subject: {{.Subject}}
+
+{{.Body}}
+{{range .Fields}}
+{{.Label}}: {{.Value}}{{end}}
+`
+)
+
+var defaultAutoReplyTextTemplate = texttemplate.Must(texttemplate.New("autoreply").Parse(defaultAutoReplyText))
+
+// ReplyOptions configures a mail to the submitter of a message, like the auto reply or the confirmation mail
+type ReplyOptions struct {
+	Sender          string `json:"sender"`
+	Subject         string `json:"subject"`
+	TextTemplate    string `json:"textTemplate"`
+	HTMLTemplate    string `json:"htmlTemplate"`
+	subjectTemplate *texttemplate.Template
+	textTemplate    *texttemplate.Template
+	htmlTemplate    *htmltemplate.Template
+}
+
+// load checks the sender and parses the subject and the template files, the defaults are used for the missing ones
+func (a *ReplyOptions) load(defaultSubject string, defaultText *texttemplate.Template) error {
+	if a.Sender != "" {
+		if _, err := netmail.ParseAddress(a.Sender); err != nil {
+			return fmt.Errorf("invalid sender %q: %v", a.Sender, err)
+		}
+	}
+	subject := a.Subject
+	if subject == "" {
+		subject = defaultSubject
+	}
+	t, err := texttemplate.New("subject").Parse(subject)
+	if err != nil {
+		return fmt.Errorf("could not parse subject: %v", err)
+	}
+	a.subjectTemplate = t
+	a.textTemplate = defaultText
+	if a.TextTemplate != "" {
+		t, err := texttemplate.New(filepath.Base(a.TextTemplate)).ParseFiles(a.TextTemplate)
+		if err != nil {
+			return fmt.Errorf("could not parse text template: %v", err)
+		}
+		a.textTemplate = t
+	}
+	if a.HTMLTemplate != "" {
+		t, err := htmltemplate.New(filepath.Base(a.HTMLTemplate)).ParseFiles(a.HTMLTemplate)
+		if err != nil {
+			return fmt.Errorf("could not parse html template: %v", err)
+		}
+		a.htmlTemplate = t
+	}
+	return nil
+}
+
+// ReplyLimiter limits the mails to submitters per address and in total, so that the form cannot be used
+// to send mails to third parties. The auto replies and the confirmation mails each have their own ReplyLimiter with these limits.
+type ReplyLimiter struct {
+	perAddress int
+	total      int
+	interval   time.Duration
+	sent       map[string][]time.Time
+	sentTotal  []time.Time
+	sync.Mutex
+}
+
+// InitReplyLimiter is the factory method to initialize a ReplyLimiter with the limits of the config
+func InitReplyLimiter(config *ApplicationConfig) *ReplyLimiter {
+	perAddress := config.AutoReplyPerAddress
+	if perAddress <= 0 {
+		perAddress = defaultAutoReplyPerAddress
+	}
+	total := config.AutoReplyTotal
+	if total <= 0 {
+		total = defaultAutoReplyTotal
+	}
+	interval := config.AutoReplyInterval
+	if interval <= 0 {
+		interval = defaultAutoReplyInterval
+	}
+	l := newReplyLimiter(perAddress, total, time.Duration(interval)*time.Second)
+	l.SetupTicker()
+	return l
+}
+
+// newReplyLimiter creates a ReplyLimiter with the given limits
+func newReplyLimiter(perAddress int, total int, interval time.Duration) *ReplyLimiter {
+	return &ReplyLimiter{perAddress: perAddress, total: total, interval: interval, sent: make(map[string][]time.Time)}
+}
+
+// AutoResponder implements MailServerInterface, it sends an acknowledgement with a ticket reference
+// to the submitter once the message has been accepted. The acknowledgements are rate limited by the ReplyLimiter.
+type AutoResponder struct {
+	mailServer  MailServerInterface
+	replyServer MailServerInterface
+	recipients  map[string]*RecipientOptions
+	limiter     *ReplyLimiter
+}
+
+// InitAutoResponder is the factory method to initialize an AutoResponder. Messages are sent through the mail server,
+// the auto replies through the reply server, which is the same or the mail queue or transport behind it.
+func InitAutoResponder(config *ApplicationConfig, mailServer MailServerInterface, replyServer MailServerInterface, limiter *ReplyLimiter) *AutoResponder {
+	return &AutoResponder{
+		mailServer:  mailServer,
+		replyServer: replyServer,
+		recipients:  config.RecipientOptions,
+		limiter:     limiter,
+	}
+}
+
+// hasAutoReplies returns true if any recipient has auto replies
+func (c *ApplicationConfig) hasAutoReplies() bool {
+	for _, options := range c.RecipientOptions {
+		if options != nil && options.AutoReply != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Send sends the message with a new ticket reference. If that succeeded and the limits allow it,
+// the auto reply is sent. A failing auto reply is only logged, the message has been sent already.
+func (a *AutoResponder) Send(mail *EmailMessage) error {
+	options := a.recipients[mail.recipientID]
+	if options == nil || options.AutoReply == nil {
+		return a.mailServer.Send(mail)
+	}
+	if mail.ticket == "" {
+		ticket, err := newTicket()
+		if err != nil {
+			return err
+		}
+		mail.ticket = ticket
+	}
+	if err := a.mailServer.Send(mail); err != nil {
+		return err
+	}
+
+	submitter, err := netmail.ParseAddress(mail.from)
+	if err != nil {
+		return nil
+	}
+	// the sender of spam is usually forged, a reply would go to an uninvolved third party
+	if mail.spamTag != "" {
+		log.Printf("Auto reply to %v for ticket %v suppressed for a message tagged as spam", submitter.Address, mail.ticket)
+		return nil
+	}
+	if !a.limiter.allow(submitter.Address, time.Now()) {
+		log.Printf("Auto reply to %v for ticket %v suppressed by the rate limit", submitter.Address, mail.ticket)
+		return nil
+	}
+	reply := *mail
+	reply.autoReply = true
+	if err := a.replyServer.Send(&reply); err != nil {
+		log.Printf("ERROR: auto reply to %v for ticket %v failed: %v", submitter.Address, mail.ticket, err)
+	}
+	return nil
+}
+
+// Queued implements MailServerInterface, it queues like the mail server
+func (a *AutoResponder) Queued() bool {
+	return a.mailServer.Queued()
+}
+
+// allow records a mail to the address and returns true if it is within the limits
+func (l *ReplyLimiter) allow(address string, now time.Time) bool {
+	address = strings.ToLower(address)
+	l.Lock()
+	defer l.Unlock()
+	since := now.Add(-l.interval)
+	l.sentTotal = recentTimes(l.sentTotal, since)
+	sent := recentTimes(l.sent[address], since)
+	if len(sent) >= l.perAddress || len(l.sentTotal) >= l.total {
+		l.sent[address] = sent
+		return false
+	}
+	l.sent[address] = append(sent, now)
+	l.sentTotal = append(l.sentTotal, now)
+	return true
+}
+
+// Clean forgets the mails that are older than the interval, it returns the number of addresses that were removed
+func (l *ReplyLimiter) Clean() int {
+	l.Lock()
+	defer l.Unlock()
+	since := time.Now().Add(-l.interval)
+	l.sentTotal = recentTimes(l.sentTotal, since)
+	i := 0
+	for address, sent := range l.sent {
+		if sent = recentTimes(sent, since); len(sent) == 0 {
+			delete(l.sent, address)
+			i++
+		} else {
+			l.sent[address] = sent
+		}
+	}
+	return i
+}
+
+// SetupTicker schedules the cleanup of the limits
+func (l *ReplyLimiter) SetupTicker() {
+	ticker := time.NewTicker(l.interval)
+	go func() {
+		for t := range ticker.C {
+			startTime := time.Now()
+			cleaned := l.Clean()
+			runtime := time.Since(startTime)
+			if cleaned > 0 {
+				log.Printf("[%s] Cleaned reply limits of %d addresses in %v seconds", t, cleaned, runtime.Seconds())
+			}
+		}
+	}()
+}
+
+// recentTimes returns the times after since, the times are in ascending order
+func recentTimes(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(since) {
+		i++
+	}
+	return times[i:]
+}
+
+// newTicket returns a random ticket reference of 8 characters
+func newTicket() (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(buf), nil
+}
+
+// composeAutoReply returns the acknowledgement of the mail to its submitter
+func (c *Composer) composeAutoReply(mail *EmailMessage) (*Envelope, error) {
+	options := c.recipients[mail.recipientID]
+	if options == nil || options.AutoReply == nil {
+		return nil, fmt.Errorf("No auto reply for id %v", mail.recipientID)
+	}
+	// RFC 3834, mail systems must not answer to the auto reply
+	return c.composeReply(mail, options, options.AutoReply, "auto-replied")
+}
+
+// composeReply returns a mail to the submitter of the mail. It is sent from the sender of the reply options,
+// the sender of the recipient or the global sender, never from the submitter.
+func (c *Composer) composeReply(mail *EmailMessage, options *RecipientOptions, reply *ReplyOptions, autoSubmitted string) (*Envelope, error) {
+	sender := reply.Sender
+	if sender == "" {
+		sender = options.Sender
+	}
+	if sender == "" {
+		sender = c.sender
+	}
+	if sender == "" {
+		return nil, errors.New("reply without sender")
+	}
+	from, err := netmail.ParseAddress(sender)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %v", sender, err)
+	}
+	submitter, err := netmail.ParseAddress(mail.from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid submitter %q: %v", mail.from, err)
+	}
+	messageID, err := newMessageID(from.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var subject bytes.Buffer
+	if err := reply.subjectTemplate.Execute(&subject, newTemplateData(mail, options, now)); err != nil {
+		return nil, fmt.Errorf("could not render subject: %v", err)
+	}
+	// the body is rendered like the message, with the templates of the reply
+	entity, err := renderBody(mail, &RecipientOptions{Fields: options.Fields, textTemplate: reply.textTemplate, htmlTemplate: reply.htmlTemplate}, now)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &messageHeader{}
+	header.setAddress("From", from)
+	header.setAddress("To", submitter)
+	header.set("Date", now.Format(time.RFC1123Z))
+	header.setText("Subject", subject.String())
+	header.set("Message-ID", messageID)
+	header.set("Auto-Submitted", autoSubmitted)
+	header.set("MIME-Version", "1.0")
+	if header.err != nil {
+		return nil, header.err
+	}
+
+	var buf bytes.Buffer
+	header.writeTo(&buf)
+	entity.writeTo(&buf)
+	return &Envelope{From: from.Address, To: []string{submitter.Address}, Data: buf.Bytes()}, nil
+}
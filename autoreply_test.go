@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoResponder_SendsReply(t *testing.T) {
+	t.Parallel()
+	recipients := getAutoReplyRecipients(t)
+	ms := &FailingMailServer{}
+	replies := &FailingMailServer{}
+	a := newTestAutoResponder(recipients, ms, replies, newReplyLimiter(1, 10, time.Hour))
+
+	msg := newTestMessage()
+	if err := a.Send(msg); err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+	if ms.sentCount() != 1 || ms.sent[0].ticket == "" || ms.sent[0].autoReply {
+		t.Fatalf("Expected the message with a ticket, got %+v", ms.sent)
+	}
+	if replies.sentCount() != 1 || !replies.sent[0].autoReply || replies.sent[0].ticket != ms.sent[0].ticket {
+		t.Fatalf("Expected an auto reply with the same ticket, got %+v", replies.sent)
+	}
+
+	composer := &Composer{sender: "noreply@example.com", recipientMap: map[string]string{"id1": "to@example.com"}, recipients: recipients}
+	forwarded, err := composer.Compose(ms.sent[0])
+	if err != nil {
+		t.Fatalf("Error composing the message: %v", err)
+	}
+	if !strings.Contains(string(forwarded.Data), "X-Mailbridge-Ticket: "+msg.ticket) {
+		t.Errorf("The forwarded message has no ticket header")
+	}
+
+	envelope, err := composer.Compose(replies.sent[0])
+	if err != nil {
+		t.Fatalf("Error composing the auto reply: %v", err)
+	}
+	if envelope.From != "support@example.com" || len(envelope.To) != 1 || envelope.To[0] != "from@example.com" {
+		t.Errorf("The auto reply must go from the sender to the submitter, got %v to %v", envelope.From, envelope.To)
+	}
+	reply, err := mail.ReadMessage(strings.NewReader(string(envelope.Data)))
+	if err != nil {
+		t.Fatalf("Error parsing the auto reply: %v", err)
+	}
+	if reply.Header.Get("Subject") != "Re: SUBJECT ["+msg.ticket+"]" || reply.Header.Get("Auto-Submitted") != "auto-replied" {
+		t.Errorf("Wrong auto reply header: %v", reply.Header)
+	}
+	body, _ := ioutil.ReadAll(reply.Body)
+	if !strings.Contains(string(body), "Your reference is "+msg.ticket) || !strings.Contains(string(body), "BODY") {
+		t.Errorf("The auto reply must contain the ticket and a copy of the message, got %q", body)
+	}
+}
+
+func TestAutoResponder_NoReplyForSpam(t *testing.T) {
+	t.Parallel()
+	ms := &FailingMailServer{}
+	replies := &FailingMailServer{}
+	a := newTestAutoResponder(getAutoReplyRecipients(t), ms, replies, newReplyLimiter(10, 10, time.Hour))
+
+	msg := newTestMessage()
+	msg.spamTag = defaultSpamTagPrefix
+	if err := a.Send(msg); err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+	if ms.sentCount() != 1 || replies.sentCount() != 0 {
+		t.Errorf("Expected the tagged message without an auto reply, got %d messages and %d replies", ms.sentCount(), replies.sentCount())
+	}
+}
+
+func TestAutoResponder_NoReplyOnFailure(t *testing.T) {
+	t.Parallel()
+	replies := &FailingMailServer{}
+	a := newTestAutoResponder(getAutoReplyRecipients(t), &FailingMailServer{failures: -1}, replies, newReplyLimiter(1, 10, time.Hour))
+	if err := a.Send(newTestMessage()); err == nil {
+		t.Errorf("Error: send succeeded with a failing mail server")
+	}
+	if replies.sentCount() != 0 {
+		t.Errorf("A message that was not sent must not be acknowledged")
+	}
+}
+
+func TestAutoResponder_WithoutAutoReply(t *testing.T) {
+	t.Parallel()
+	ms := &FailingMailServer{}
+	replies := &FailingMailServer{}
+	a := newTestAutoResponder(map[string]*RecipientOptions{}, ms, replies, newReplyLimiter(1, 10, time.Hour))
+	if err := a.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+	if ms.sentCount() != 1 || ms.sent[0].ticket != "" || replies.sentCount() != 0 {
+		t.Errorf("A recipient without auto reply must get the message only")
+	}
+}
+
+func TestAutoResponder_RateLimit(t *testing.T) {
+	t.Parallel()
+	replies := &FailingMailServer{}
+	limiter := newReplyLimiter(2, 3, time.Hour)
+	a := newTestAutoResponder(getAutoReplyRecipients(t), &FailingMailServer{}, replies, limiter)
+	for _, from := range []string{"a@example.com", "A@example.com", "a@example.com", "b@example.com", "c@example.com"} {
+		msg := newTestMessage()
+		msg.from = from
+		if err := a.Send(msg); err != nil {
+			t.Fatalf("Error sending mail: %v", err)
+		}
+	}
+	// the third mail of a@example.com is over the limit of the address, the one of c@example.com over the total limit
+	if n := replies.sentCount(); n != 3 {
+		t.Errorf("Expected 3 auto replies, got %d", n)
+	}
+
+	// after the interval, the address gets replies again
+	later := time.Now().Add(2 * time.Hour)
+	if !limiter.allow("a@example.com", later) {
+		t.Errorf("Error: the limit did not expire")
+	}
+}
+
+func TestReplyLimiter_Clean(t *testing.T) {
+	t.Parallel()
+	l := newReplyLimiter(1, 10, time.Hour)
+	l.allow("old@example.com", time.Now().Add(-2*time.Hour))
+	l.allow("new@example.com", time.Now())
+	if n := l.Clean(); n != 1 {
+		t.Errorf("Expected 1 cleaned address, got %d", n)
+	}
+	if _, found := l.sent["new@example.com"]; !found || len(l.sentTotal) != 1 {
+		t.Errorf("Recent auto replies must be kept")
+	}
+}
+
+func TestAutoResponder_LoadOptions(t *testing.T) {
+	t.Parallel()
+	invalid := []*ReplyOptions{
+		{Sender: "not an address"},
+		{Subject: "{{.Subject"},
+		{TextTemplate: "/does/not/exist.txt"},
+	}
+	for _, options := range invalid {
+		if err := options.load(defaultAutoReplySubject, defaultAutoReplyTextTemplate); err == nil {
+			t.Errorf("Error: invalid auto reply %+v should not load", options)
+		}
+	}
+}
+
+// HELPER METHODS
+func getAutoReplyRecipients(t *testing.T) map[string]*RecipientOptions {
+	options := &RecipientOptions{AutoReply: &ReplyOptions{Sender: "Support <support@example.com>"}}
+	if err := options.load(); err != nil {
+		t.Fatalf("Error loading auto reply: %v", err)
+	}
+	return map[string]*RecipientOptions{"id1": options}
+}
+
+func newTestAutoResponder(recipients map[string]*RecipientOptions, mailServer MailServerInterface, replyServer MailServerInterface, limiter *ReplyLimiter) *AutoResponder {
+	return InitAutoResponder(&ApplicationConfig{RecipientOptions: recipients}, mailServer, replyServer, limiter)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// CaptchaHCaptcha verifies hCaptcha responses
+	CaptchaHCaptcha = "hcaptcha"
+	// CaptchaReCaptcha verifies Google reCAPTCHA responses
+	CaptchaReCaptcha = "recaptcha"
+	// CaptchaTurnstile verifies Cloudflare Turnstile responses
+	CaptchaTurnstile = "turnstile"
+	// captchaTimeout is the maximal time of a request to the siteverify endpoint
+	captchaTimeout = 10 * time.Second
+	// captchaResponseLimit is the maximal size of a siteverify response that is read
+	captchaResponseLimit = 65536
+)
+
+// captchaVerifyURLs are the siteverify endpoints of the providers
+var captchaVerifyURLs = map[string]string{
+	CaptchaHCaptcha:  "https://api.hcaptcha.com/siteverify",
+	CaptchaReCaptcha: "https://www.google.com/recaptcha/api/siteverify",
+	CaptchaTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// Captcha verifies the captcha responses of the clients with the siteverify endpoint of the provider.
+// hCaptcha, reCAPTCHA and Turnstile all use the same protocol.
+type Captcha struct {
+	verifyURL string
+	secret    string
+	hostnames []string
+	action    string
+	client    *http.Client
+}
+
+// captchaResult is the answer of a siteverify endpoint. Only some providers and plans return a score,
+// the action is returned by reCAPTCHA v3 and Turnstile.
+type captchaResult struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`
+	Hostname   string   `json:"hostname"`
+	Action     string   `json:"action"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// InitCaptcha is the factory method to initialize a Captcha for the provider in the config
+func InitCaptcha(config *ApplicationConfig) (*Captcha, error) {
+	verifyURL, found := captchaVerifyURLs[config.CaptchaProvider]
+	if !found {
+		return nil, fmt.Errorf("unknown captcha provider %q", config.CaptchaProvider)
+	}
+	if config.CaptchaSecret == "" {
+		return nil, errors.New("captcha needs a captchaSecret")
+	}
+	if config.CaptchaVerifyURL != "" {
+		verifyURL = config.CaptchaVerifyURL
+	}
+	return &Captcha{
+		verifyURL: verifyURL,
+		secret:    config.CaptchaSecret,
+		hostnames: config.CaptchaHostnames,
+		action:    config.CaptchaAction,
+		client:    &http.Client{Timeout: captchaTimeout},
+	}, nil
+}
+
+// Verify checks the response of the client with the provider. The captcha must have been solved on one of the
+// configured hostnames and for the configured action, so that responses solved on other sites with the same
+// site key are rejected. With a minimal score, the provider has to return a score of at least that value.
+func (c *Captcha) Verify(response string, remoteIP string, minScore float64) error {
+	if response == "" {
+		return errors.New("missing captcha response")
+	}
+	form := url.Values{"secret": {c.secret}, "response": {response}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	resp, err := c.client.PostForm(c.verifyURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha verification answered with status %d", resp.StatusCode)
+	}
+	var result captchaResult
+	if err := json.NewDecoder(io.LimitReader(resp.Body, captchaResponseLimit)).Decode(&result); err != nil {
+		return fmt.Errorf("invalid captcha verification response: %v", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("captcha was not solved: %v", strings.Join(result.ErrorCodes, ", "))
+	}
+	if len(c.hostnames) > 0 && !c.allowedHostname(result.Hostname) {
+		return fmt.Errorf("captcha was solved on the wrong hostname %q", result.Hostname)
+	}
+	if c.action != "" && result.Action != c.action {
+		return fmt.Errorf("captcha was solved for the wrong action %q", result.Action)
+	}
+	if minScore > 0 {
+		if result.Score == nil {
+			return errors.New("captcha verification returned no score")
+		}
+		if *result.Score < minScore {
+			return fmt.Errorf("captcha score %v is below %v", *result.Score, minScore)
+		}
+	}
+	return nil
+}
+
+// allowedHostname returns true if the hostname is one of the configured hostnames
+func (c *Captcha) allowedHostname(hostname string) bool {
+	for _, allowed := range c.hostnames {
+		if strings.EqualFold(hostname, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// captchaScore returns the minimal captcha score of the recipient, a nil receiver has none
+func (o *RecipientOptions) captchaScore() float64 {
+	if o == nil {
+		return 0
+	}
+	return o.CaptchaScore
+}
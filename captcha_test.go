@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCaptcha_Verify(t *testing.T) {
+	t.Parallel()
+	server := newTestCaptchaServer(t)
+	defer server.Close()
+	captcha := newTestCaptcha(t, server.URL)
+
+	if err := captcha.Verify("valid", "192.0.2.1", 0); err != nil {
+		t.Errorf("Error verifying a valid captcha: %v", err)
+	}
+	if err := captcha.Verify("score-0.9", "", 0.5); err != nil {
+		t.Errorf("Error verifying a captcha with a high score: %v", err)
+	}
+	invalid := map[string]float64{
+		"":            0,
+		"invalid":     0,
+		"score-0.3":   0.5,
+		"valid":       0.5,
+		"broken":      0,
+		"otherhost":   0,
+		"otheraction": 0,
+	}
+	for response, minScore := range invalid {
+		if err := captcha.Verify(response, "", minScore); err == nil {
+			t.Errorf("Error: captcha response %q with minimal score %v should not verify", response, minScore)
+		}
+	}
+}
+
+func TestCaptcha_InvalidConfig(t *testing.T) {
+	t.Parallel()
+	invalid := []*ApplicationConfig{
+		{CaptchaProvider: "unknown", CaptchaSecret: "secret"},
+		{CaptchaProvider: CaptchaTurnstile},
+	}
+	for _, config := range invalid {
+		if _, err := InitCaptcha(config); err == nil {
+			t.Errorf("Error: invalid captcha config %+v should return error", config)
+		}
+	}
+	captcha, err := InitCaptcha(&ApplicationConfig{CaptchaProvider: CaptchaHCaptcha, CaptchaSecret: "secret"})
+	if err != nil || captcha.verifyURL != captchaVerifyURLs[CaptchaHCaptcha] {
+		t.Errorf("Expected the default verify URL of hCaptcha, got %v", err)
+	}
+	if err := (&RecipientOptions{CaptchaScore: 1.5}).load(); err == nil {
+		t.Errorf("Error: a captcha score above 1 should not load")
+	}
+}
+
+func TestController_Captcha(t *testing.T) {
+	t.Parallel()
+	server := newTestCaptchaServer(t)
+	defer server.Close()
+	c := newController(&MockMailServer{}, &MockActiveTokens{}, &MockTarpit{})
+	c.captcha = newTestCaptcha(t, server.URL)
+	c.recipients = map[string]*RecipientOptions{"STRICT": {CaptchaScore: 0.5}}
+
+	requests := map[string]int{
+		`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY"}`:                             http.StatusBadRequest,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Captcha": "invalid"}`:       http.StatusBadRequest,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Captcha": "valid"}`:         http.StatusCreated,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "STRICT", "Subject": "SUBJECT", "Body": "BODY", "Captcha": "score-0.3"}`: http.StatusBadRequest,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "STRICT", "Subject": "SUBJECT", "Body": "BODY", "Captcha": "score-0.9"}`: http.StatusCreated,
+	}
+	for msg, expected := range requests {
+		req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+		if status := doRequestController(req, c).Code; status != expected {
+			t.Errorf("Wrong status for %s: %d, should be %d", msg, status, expected)
+		}
+	}
+
+	// the form field of the widget is accepted in multipart requests
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range map[string]string{"Token": "TOKEN", "From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "h-captcha-response": "valid"} {
+		w.WriteField(name, value)
+	}
+	w.Close()
+	req, _ := http.NewRequest("POST", "/send", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if status := doRequestController(req, c).Code; status != http.StatusCreated {
+		t.Errorf("Wrong status for the widget form field: %d, should be %d", status, http.StatusCreated)
+	}
+}
+
+func TestController_CaptchaLast(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"success": true, "hostname": "forms.example.com", "action": "submit"}`))
+	}))
+	defer server.Close()
+	c := newController(&MockMailServer{}, &MockActiveTokens{}, &MockTarpit{})
+	c.captcha = newTestCaptcha(t, server.URL)
+	c.pow = newTestProofOfWork(t, 4)
+
+	// a request without proof of work is rejected without asking the captcha provider
+	msg := `{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Captcha": "valid"}`
+	req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+	if status := doRequestController(req, c).Code; status != http.StatusBadRequest {
+		t.Errorf("Wrong status: %d, should be %d", status, http.StatusBadRequest)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("The captcha must be verified after the proof of work, got %d verifications", n)
+	}
+}
+
+// HELPER METHODS
+func newTestCaptcha(t *testing.T, verifyURL string) *Captcha {
+	config := &ApplicationConfig{
+		CaptchaProvider:  CaptchaReCaptcha,
+		CaptchaSecret:    "secret",
+		CaptchaVerifyURL: verifyURL,
+		CaptchaHostnames: []string{"forms.example.com"},
+		CaptchaAction:    "submit",
+	}
+	captcha, err := InitCaptcha(config)
+	if err != nil {
+		t.Fatalf("Error creating captcha: %v", err)
+	}
+	return captcha
+}
+
+// newTestCaptchaServer is a siteverify stub, the response "valid" succeeds without score, "score-X" succeeds
+// with score X, "otherhost" and "otheraction" are solved on another site and "broken" returns no JSON
+func newTestCaptchaServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("secret") != "secret" {
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-secret"]}`))
+			return
+		}
+		response := r.PostFormValue("response")
+		switch {
+		case response == "valid":
+			w.Write([]byte(`{"success": true, "hostname": "Forms.example.com", "action": "submit"}`))
+		case strings.HasPrefix(response, "score-"):
+			w.Write([]byte(`{"success": true, "hostname": "forms.example.com", "action": "submit", "score": ` + strings.TrimPrefix(response, "score-") + `}`))
+		case response == "otherhost":
+			w.Write([]byte(`{"success": true, "hostname": "evil.example.com", "action": "submit"}`))
+		case response == "otheraction":
+			w.Write([]byte(`{"success": true, "hostname": "forms.example.com", "action": "login"}`))
+		case response == "broken":
+			w.Write([]byte(`<html>`))
+		default:
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		}
+	}))
+}
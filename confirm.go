@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	// defaultConfirmLifetime is the time in seconds that a message waits for its confirmation
+	defaultConfirmLifetime = 86400
+	// defaultConfirmSubject is the subject template of confirmation mails without a configured subject
+	defaultConfirmSubject = "Please confirm your message: {{.Subject}}"
+	// defaultConfirmText is the text template of confirmation mails without configured templates
+	defaultConfirmText = `Please confirm that you sent the following message by opening this link:
+
+{{.ConfirmLink}}
+
+If you did not send this message, please ignore this mail. The message will not be delivered.
+
+--- Your message ---
+Subject: {{.Subject}}
+
+{{.Body}}
+`
+)
+
+var defaultConfirmTextTemplate = texttemplate.Must(texttemplate.New("confirm").Parse(defaultConfirmText))
+
+// errUnknownConfirmation is returned for confirmation IDs that are unknown, expired or used already
+var errUnknownConfirmation = errors.New("unknown or expired confirmation")
+
+// ConfirmationsInterface for being able to mock Confirmations
+type ConfirmationsInterface interface {
+	Hold(mail *EmailMessage) error
+	Release(id string, send func(*EmailMessage) error) error
+	Clean() int
+	SetupTicker()
+}
+
+// heldMessage is a message that waits for the confirmation of its submitter
+type heldMessage struct {
+	mail    *EmailMessage
+	expires time.Time
+}
+
+// Confirmations implements ConfirmationsInterface, it holds the messages in memory until the submitter
+// opens the link in the confirmation mail. Held messages are lost on restart, like the tokens in memory.
+type Confirmations struct {
+	mailServer      MailServerInterface
+	limiter         *ReplyLimiter
+	baseURL         string
+	lifetime        int
+	cleanupInterval int
+	held            map[string]*heldMessage
+	sync.Mutex
+}
+
+// InitConfirmations is the factory method to initialize Confirmations, the confirmation mails are sent through the mail server.
+// They have a ReplyLimiter of their own, so that a confirmation mail does not use up the auto reply for the confirmed message.
+func InitConfirmations(config *ApplicationConfig, mailServer MailServerInterface) *Confirmations {
+	c := newConfirmations(config, mailServer, InitReplyLimiter(config))
+	c.SetupTicker()
+	return c
+}
+
+// newConfirmations returns Confirmations without starting the cleanup ticker
+func newConfirmations(config *ApplicationConfig, mailServer MailServerInterface, limiter *ReplyLimiter) *Confirmations {
+	lifetime := config.ConfirmLifetime
+	if lifetime <= 0 {
+		lifetime = defaultConfirmLifetime
+	}
+	return &Confirmations{
+		mailServer:      mailServer,
+		limiter:         limiter,
+		baseURL:         strings.TrimSuffix(config.ConfirmURL, "/"),
+		lifetime:        lifetime,
+		cleanupInterval: config.CleanupInterval,
+		held:            make(map[string]*heldMessage),
+	}
+}
+
+// hasConfirmations returns true if any recipient needs confirmed messages
+func (c *ApplicationConfig) hasConfirmations() bool {
+	for _, options := range c.RecipientOptions {
+		if options.needsConfirmation() {
+			return true
+		}
+	}
+	return false
+}
+
+// needsConfirmation returns true if the messages for the recipient are held until the submitter confirms them
+func (o *RecipientOptions) needsConfirmation() bool {
+	return o != nil && o.Confirm != nil
+}
+
+// Hold stores the message and sends the confirmation mail with the link to its submitter
+func (c *Confirmations) Hold(mail *EmailMessage) error {
+	submitter, err := netmail.ParseAddress(mail.from)
+	if err != nil {
+		return err
+	}
+	if !c.limiter.allow(submitter.Address, time.Now()) {
+		return fmt.Errorf("too many confirmation mails to %v", submitter.Address)
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(buf)
+
+	c.Lock()
+	c.held[id] = &heldMessage{mail: mail, expires: time.Now().Add(time.Duration(c.lifetime) * time.Second)}
+	c.Unlock()
+
+	confirmation := *mail
+	if mail.spamTag != "" {
+		// the sender of spam is usually forged, the confirmation mail must not carry the content to a third party
+		confirmation.subject, confirmation.body, confirmation.fields, confirmation.attachments = "", "", nil, nil
+	}
+	confirmation.confirmLink = c.baseURL + "/api/confirm/" + id
+	if err := c.mailServer.Send(&confirmation); err != nil {
+		c.Lock()
+		delete(c.held, id)
+		c.Unlock()
+		return err
+	}
+	log.Printf("Message held for confirmation by %v", submitter.Address)
+	return nil
+}
+
+// Release sends the message of the confirmation ID with the send function and forgets it, a message can only
+// be released once. The message is taken out while it is sent, so that a second click cannot send it again,
+// and it is put back if the sending fails, so that the submitter can open the link again later.
+func (c *Confirmations) Release(id string, send func(*EmailMessage) error) error {
+	c.Lock()
+	held, found := c.held[id]
+	delete(c.held, id)
+	c.Unlock()
+	if !found || time.Now().After(held.expires) {
+		return errUnknownConfirmation
+	}
+	if err := send(held.mail); err != nil {
+		c.Lock()
+		c.held[id] = held
+		c.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Clean deletes the expired messages and returns how many were deleted
+func (c *Confirmations) Clean() int {
+	c.Lock()
+	defer c.Unlock()
+	i := 0
+	for id, held := range c.held {
+		if time.Now().After(held.expires) {
+			delete(c.held, id)
+			i++
+		}
+	}
+	return i
+}
+
+// SetupTicker creates a ticker that calls Clean() in regular intervals (config.CleanupInterval)
+func (c *Confirmations) SetupTicker() {
+	ticker := time.NewTicker(time.Second * time.Duration(c.cleanupInterval))
+	go func() {
+		for t := range ticker.C {
+			deleted := c.Clean()
+			if deleted > 0 {
+				log.Printf("[%s] Cleaning up %d unconfirmed messages", t, deleted)
+			}
+		}
+	}()
+}
+
+// composeConfirmation returns the mail with the confirmation link to the submitter
+func (c *Composer) composeConfirmation(mail *EmailMessage) (*Envelope, error) {
+	options := c.recipients[mail.recipientID]
+	if !options.needsConfirmation() {
+		return nil, fmt.Errorf("No confirmation for id %v", mail.recipientID)
+	}
+	return c.composeReply(mail, options, options.Confirm, "auto-generated")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfirmations_HoldAndRelease(t *testing.T) {
+	t.Parallel()
+	replies := &FailingMailServer{}
+	c := newTestConfirmations(replies, newReplyLimiter(1, 10, time.Hour))
+
+	msg := newTestMessage()
+	if err := c.Hold(msg); err != nil {
+		t.Fatalf("Error holding message: %v", err)
+	}
+	if replies.sentCount() != 1 || msg.confirmLink != "" {
+		t.Fatalf("Expected one confirmation mail, got %d", replies.sentCount())
+	}
+	link := replies.sent[0].confirmLink
+	if !strings.HasPrefix(link, "https://forms.example.com/api/confirm/") {
+		t.Fatalf("Wrong confirmation link %q", link)
+	}
+	id := link[strings.LastIndex(link, "/")+1:]
+
+	released := &FailingMailServer{}
+	if err := c.Release("unknown", released.Send); err != errUnknownConfirmation {
+		t.Errorf("Expected %v for an unknown id, got %v", errUnknownConfirmation, err)
+	}
+	if err := c.Release(id, released.Send); err != nil || released.sentCount() != 1 || released.sent[0] != msg {
+		t.Fatalf("Error releasing the message: %v", err)
+	}
+	if err := c.Release(id, released.Send); err != errUnknownConfirmation {
+		t.Errorf("A message must only be released once, got %v", err)
+	}
+}
+
+func TestConfirmations_ExpireAndClean(t *testing.T) {
+	t.Parallel()
+	c := newTestConfirmations(&FailingMailServer{}, newReplyLimiter(10, 10, time.Hour))
+	c.held["expired"] = &heldMessage{mail: newTestMessage(), expires: time.Now().Add(-time.Second)}
+	c.held["active"] = &heldMessage{mail: newTestMessage(), expires: time.Now().Add(time.Hour)}
+
+	if err := c.Release("expired", (&FailingMailServer{}).Send); err != errUnknownConfirmation {
+		t.Errorf("An expired message must not be released, got %v", err)
+	}
+	c.held["expired"] = &heldMessage{mail: newTestMessage(), expires: time.Now().Add(-time.Second)}
+	if n := c.Clean(); n != 1 {
+		t.Errorf("Expected 1 cleaned message, got %d", n)
+	}
+	if _, found := c.held["active"]; !found {
+		t.Errorf("A message that did not expire must be kept")
+	}
+}
+
+func TestConfirmations_Failures(t *testing.T) {
+	t.Parallel()
+	c := newTestConfirmations(&FailingMailServer{failures: -1}, newReplyLimiter(10, 10, time.Hour))
+	if err := c.Hold(newTestMessage()); err == nil {
+		t.Errorf("Error: hold succeeded without confirmation mail")
+	}
+	if len(c.held) != 0 {
+		t.Errorf("A message without confirmation mail must not be held")
+	}
+
+	c = newTestConfirmations(&FailingMailServer{}, newReplyLimiter(1, 10, time.Hour))
+	if err := c.Hold(newTestMessage()); err != nil {
+		t.Fatalf("Error holding message: %v", err)
+	}
+	if err := c.Hold(newTestMessage()); err == nil {
+		t.Errorf("Error: the second confirmation mail to the same address should be over the limit")
+	}
+}
+
+func TestConfirmations_ReleaseFailure(t *testing.T) {
+	t.Parallel()
+	c := newTestConfirmations(&FailingMailServer{}, newReplyLimiter(10, 10, time.Hour))
+	msg := newTestMessage()
+	c.held["id"] = &heldMessage{mail: msg, expires: time.Now().Add(time.Hour)}
+
+	// the message stays held if it cannot be sent
+	failing := &FailingMailServer{failures: 1}
+	if err := c.Release("id", failing.Send); err == nil || err == errUnknownConfirmation {
+		t.Fatalf("Expected the error of the mail server, got %v", err)
+	}
+	if err := c.Release("id", failing.Send); err != nil || failing.sentCount() != 1 || failing.sent[0] != msg {
+		t.Errorf("Error releasing the message again: %v", err)
+	}
+}
+
+func TestConfirmations_Compose(t *testing.T) {
+	t.Parallel()
+	options := &RecipientOptions{Confirm: &ReplyOptions{}}
+	if err := options.load(); err != nil {
+		t.Fatalf("Error loading options: %v", err)
+	}
+	composer := &Composer{sender: "noreply@example.com", recipientMap: map[string]string{"id1": "to@example.com"}, recipients: map[string]*RecipientOptions{"id1": options}}
+	msg := newTestMessage()
+	msg.confirmLink = "https://forms.example.com/api/confirm/ID"
+	envelope, err := composer.Compose(msg)
+	if err != nil {
+		t.Fatalf("Error composing the confirmation: %v", err)
+	}
+	if envelope.From != "noreply@example.com" || envelope.To[0] != "from@example.com" {
+		t.Errorf("The confirmation must go to the submitter, got %v to %v", envelope.From, envelope.To)
+	}
+	if !strings.Contains(string(envelope.Data), "Subject: Please confirm your message: SUBJECT") || !strings.Contains(string(envelope.Data), "api/confirm/ID") {
+		t.Errorf("The confirmation must contain the link, got %s", envelope.Data)
+	}
+}
+
+func TestConfirmations_HoldSpam(t *testing.T) {
+	t.Parallel()
+	options := &RecipientOptions{Confirm: &ReplyOptions{}}
+	if err := options.load(); err != nil {
+		t.Fatalf("Error loading options: %v", err)
+	}
+	composer := &Composer{sender: "noreply@example.com", recipientMap: map[string]string{"id1": "to@example.com"}, recipients: map[string]*RecipientOptions{"id1": options}}
+	replies := &FailingMailServer{}
+	c := newTestConfirmations(replies, newReplyLimiter(1, 10, time.Hour))
+
+	// the confirmation of a tagged message does not contain the submitted content
+	msg := newTestMessage()
+	msg.spamTag = defaultSpamTagPrefix
+	if err := c.Hold(msg); err != nil || replies.sentCount() != 1 {
+		t.Fatalf("Error holding message: %v", err)
+	}
+	envelope, err := composer.Compose(replies.sent[0])
+	if err != nil {
+		t.Fatalf("Error composing the confirmation: %v", err)
+	}
+	if data := string(envelope.Data); !strings.Contains(data, "api/confirm/") || strings.Contains(data, "SUBJECT") || strings.Contains(data, "BODY") {
+		t.Errorf("The confirmation of a tagged message must only contain the link, got %s", data)
+	}
+
+	// the held message is released with its content
+	link := replies.sent[0].confirmLink
+	released := &FailingMailServer{}
+	if err := c.Release(link[strings.LastIndex(link, "/")+1:], released.Send); err != nil || released.sentCount() != 1 || released.sent[0].body != "BODY" {
+		t.Errorf("Error releasing the tagged message: %v", err)
+	}
+}
+
+func TestController_ConfirmMail(t *testing.T) {
+	t.Parallel()
+	ms := &MockMailServer{}
+	replies := &FailingMailServer{}
+	c := newController(ms, &MockActiveTokens{}, &MockTarpit{})
+	c.recipients = map[string]*RecipientOptions{"TO": {Confirm: &ReplyOptions{}}}
+	c.confirmations = newTestConfirmations(replies, newReplyLimiter(1, 10, time.Hour))
+
+	msg := `{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY"}`
+	req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+	if rr := doRequestController(req, c); rr.Code != http.StatusAccepted {
+		t.Fatalf("Wrong status: %d, should be %d", rr.Code, http.StatusAccepted)
+	}
+	if ms.sent != nil || replies.sentCount() != 1 {
+		t.Fatalf("The message must be held until it is confirmed")
+	}
+
+	link := replies.sent[0].confirmLink
+	req, _ = http.NewRequest("GET", "/confirm/"+link[strings.LastIndex(link, "/")+1:], nil)
+	rr := doRequestController(req, c)
+	body, _ := ioutil.ReadAll(rr.Body)
+	if rr.Code != http.StatusOK || !strings.Contains(string(body), "has been sent") {
+		t.Errorf("Wrong status: %d, should be %d", rr.Code, http.StatusOK)
+	}
+	if ms.sent == nil || ms.sent.subject != "SUBJECT" {
+		t.Errorf("The confirmed message was not sent")
+	}
+
+	// the link only works once
+	if rr := doRequestController(req, c); rr.Code != http.StatusBadRequest {
+		t.Errorf("Wrong status: %d, should be %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestController_ConfirmMail_SendFailure(t *testing.T) {
+	t.Parallel()
+	ms := &FailingMailServer{failures: 1}
+	c := newController(ms, &MockActiveTokens{}, &MockTarpit{})
+	confirmations := newTestConfirmations(&FailingMailServer{}, newReplyLimiter(1, 10, time.Hour))
+	confirmations.held["id"] = &heldMessage{mail: newTestMessage(), expires: time.Now().Add(time.Hour)}
+	c.confirmations = confirmations
+
+	req, _ := http.NewRequest("GET", "/confirm/id", nil)
+	if rr := doRequestController(req, c); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status: %d, should be %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	// the message is still held after the failure
+	if rr := doRequestController(req, c); rr.Code != http.StatusOK || ms.sentCount() != 1 {
+		t.Errorf("Wrong status: %d, should be %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestController_ConfirmMail_AutoReply(t *testing.T) {
+	t.Parallel()
+	recipients := getAutoReplyRecipients(t)
+	recipients["id1"].Confirm = &ReplyOptions{}
+	ms := &FailingMailServer{}
+	replies := &FailingMailServer{}
+	c := newController(newTestAutoResponder(recipients, ms, replies, newReplyLimiter(1, 10, time.Hour)), &MockActiveTokens{}, &MockTarpit{})
+	c.recipients = recipients
+	c.confirmations = newTestConfirmations(replies, newReplyLimiter(1, 10, time.Hour))
+
+	msg := `{"Token": "TOKEN","From": "from@example.com", "To": "id1", "Subject": "SUBJECT", "Body": "BODY"}`
+	req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+	if rr := doRequestController(req, c); rr.Code != http.StatusAccepted {
+		t.Fatalf("Wrong status: %d, should be %d", rr.Code, http.StatusAccepted)
+	}
+	link := replies.sent[0].confirmLink
+	req, _ = http.NewRequest("GET", "/confirm/"+link[strings.LastIndex(link, "/")+1:], nil)
+	if rr := doRequestController(req, c); rr.Code != http.StatusOK {
+		t.Fatalf("Wrong status: %d, should be %d", rr.Code, http.StatusOK)
+	}
+	// the confirmation mail does not count against the limit of the auto reply
+	if ms.sentCount() != 1 || replies.sentCount() != 2 || !replies.sent[1].autoReply {
+		t.Errorf("Expected the confirmed message and its auto reply, got %d messages and %d replies", ms.sentCount(), replies.sentCount())
+	}
+}
+
+// HELPER METHODS
+func newTestConfirmations(mailServer MailServerInterface, limiter *ReplyLimiter) *Confirmations {
+	config := &ApplicationConfig{ConfirmURL: "https://forms.example.com/", CleanupInterval: 10}
+	return newConfirmations(config, mailServer, limiter)
+}
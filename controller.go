@@ -8,38 +8,103 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	netmail "net/mail"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// fieldNameRe restricts the names of custom fields
+var fieldNameRe = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,64}$`)
+
 // Controller is a object that holds all our handlers and their dependencies
 type Controller struct {
 	activeTokens ActiveTokensInterface
 	mailServer   MailServerInterface
 	tarpit       TarpitInterface
+	recipients   map[string]*RecipientOptions
 	bodyLimit    int64
+	uploadLimit  int64
+	// confirmations is only set if a recipient needs confirmed messages
+	confirmations   ConfirmationsInterface
+	confirmRedirect string
+	// pow is only set if tokens need a proof of work, it replaces the tarpit
+	pow *ProofOfWork
+	// captcha is only set if requests need a solved captcha
+	captcha *Captcha
+	// honeypot is the name of a hidden form field that only bots fill, empty disables the check
+	honeypot string
+	// minFillTime is the minimal time between token and submission, zero disables the check
+	minFillTime time.Duration
+	// spam is only set if the content of the messages is scored
+	spam *SpamFilter
+	// scanner is only set if the rendered messages are checked by spamd or rspamd
+	scanner *SpamChecker
+	// quarantine is only set if suspicious messages are stored instead of sent
+	quarantine *Quarantine
+}
+
+// InitController is the factory method for the controller, it sets up the checks of the submissions from the config.
+// Confirmation mails are sent through the reply server, the quarantine is shared with the spam scanner.
+func InitController(config *ApplicationConfig, m MailServerInterface, replyServer MailServerInterface, a ActiveTokensInterface, t TarpitInterface, quarantine *Quarantine) (*Controller, error) {
+	c := newController(m, a, t)
+	c.recipients = config.RecipientOptions
+	if config.UploadLimit > 0 {
+		c.uploadLimit = config.UploadLimit
+	}
+	if config.hasConfirmations() {
+		c.confirmations = InitConfirmations(config, replyServer)
+		c.confirmRedirect = config.ConfirmRedirect
+	}
+	c.honeypot = config.HoneypotField
+	c.minFillTime = time.Duration(config.MinFillTime) * time.Second
+	c.quarantine = quarantine
+
+	var err error
+	if config.Spam != nil {
+		if c.spam, err = InitSpamFilter(config); err != nil {
+			return nil, fmt.Errorf("spam filter: %v", err)
+		}
+	}
+	if config.SpamScanner != nil {
+		c.scanner = InitSpamChecker(config, quarantine)
+	}
+	if config.PowDifficulty > 0 {
+		if c.pow, err = InitProofOfWork(config); err != nil {
+			return nil, fmt.Errorf("proof of work: %v", err)
+		}
+	}
+	if config.CaptchaProvider != "" {
+		if c.captcha, err = InitCaptcha(config); err != nil {
+			return nil, fmt.Errorf("captcha: %v", err)
+		}
+	}
+	return c, nil
 }
 
-// InitController is the factory method for the controller
-func InitController(m MailServerInterface, a ActiveTokensInterface, t TarpitInterface) *Controller {
-	c := &Controller{
+// newController returns a controller with the default limits and without any further checks
+func newController(m MailServerInterface, a ActiveTokensInterface, t TarpitInterface) *Controller {
+	return &Controller{
 		activeTokens: a,
 		mailServer:   m,
 		tarpit:       t,
 		bodyLimit:    1048576,
+		uploadLimit:  10485760,
 	}
-	return c
 }
 
 // GetToken is the handler for the /token endpoint
 func (c *Controller) GetToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// tarpit the client if we had an earlier request:
-	err := c.tarpit.Wait(r)
-	if err != nil {
-		log.Printf("ERROR tarpitting user: %v", err)
-		http.Error(w, "ERROR", http.StatusBadRequest)
-		return
+	// tarpit the client if we had an earlier request, a proof of work slows down the client instead
+	if c.pow == nil {
+		err := c.tarpit.Wait(r)
+		if err != nil {
+			log.Printf("ERROR tarpitting user: %v", err)
+			http.Error(w, "ERROR", http.StatusBadRequest)
+			return
+		}
 	}
 
 	token, err := c.activeTokens.New()
@@ -56,6 +121,9 @@ func (c *Controller) GetToken(w http.ResponseWriter, r *http.Request, _ httprout
 		http.Error(w, "ERROR", http.StatusBadRequest)
 		return
 	}
+	if c.pow != nil {
+		o.Challenge, o.Difficulty = c.pow.Challenge(o.Token)
+	}
 	response, err := json.Marshal(&o)
 	if err != nil {
 		log.Printf("ERROR Token Marshal: %v", err)
@@ -76,50 +144,230 @@ func (c *Controller) SendMail(w http.ResponseWriter, r *http.Request, _ httprout
 		http.Error(w, "ERROR", http.StatusBadRequest)
 		return
 	}
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, c.bodyLimit))
-	if err != nil {
-		log.Printf("ERROR ReadBodyStream: %v", err)
-		http.Error(w, "ERROR", http.StatusBadRequest)
-		return
+	var request SendMailRequest
+	var attachments []*Attachment
+	if isMultipart(r) {
+		// file uploads, the limit covers the whole request including all files
+		r.Body = http.MaxBytesReader(w, r.Body, c.uploadLimit)
+		var err error
+		request, attachments, err = readMultipartRequest(r)
+		if err != nil {
+			log.Printf("ERROR InvalidMultipartRequest: %v", err)
+			http.Error(w, "ERROR", http.StatusBadRequest)
+			return
+		}
+	} else {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, c.bodyLimit))
+		if err != nil {
+			log.Printf("ERROR ReadBodyStream: %v", err)
+			http.Error(w, "ERROR", http.StatusBadRequest)
+			return
+		}
+		if err := r.Body.Close(); err != nil {
+			log.Printf("ERROR CloseBodyStream: %v", err)
+			http.Error(w, "ERROR", http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			log.Printf("ERROR InvalidSendMailRequest: %v", err)
+			http.Error(w, "ERROR", http.StatusBadRequest)
+			return
+		}
 	}
-	if err := r.Body.Close(); err != nil {
-		log.Printf("ERROR CloseBodyStream: %v", err)
+	// Input Validation
+	if err := request.Validate(); err != nil {
+		log.Printf("ERROR Failed Validation: %v", err)
 		http.Error(w, "ERROR", http.StatusBadRequest)
 		return
 	}
-	var request SendMailRequest
-	if err := json.Unmarshal(body, &request); err != nil {
-		log.Printf("ERROR InvalidSendMailRequest: %v", err)
+	// the honeypot is not a custom field of the message, it is checked after all other checks
+	trapped := c.honeypot != "" && request.Fields[c.honeypot] != ""
+	delete(request.Fields, c.honeypot)
+	if err := c.recipients[request.To].validateFields(request.Fields); err != nil {
+		log.Printf("ERROR Failed Field Validation: %v", err)
 		http.Error(w, "ERROR", http.StatusBadRequest)
 		return
 	}
-	// Input Validation
-	if err := request.Validate(); err != nil {
-		log.Printf("ERROR Failed Validation: %v", err)
+	if err := c.recipients[request.To].validateAttachments(attachments); err != nil {
+		log.Printf("ERROR Failed Attachment Validation: %v", err)
 		http.Error(w, "ERROR", http.StatusBadRequest)
 		return
 	}
+	// check the proof of work and the captcha before the token is used up
+	if c.pow != nil {
+		if err := c.pow.Verify(request.Token, request.Challenge, request.Nonce); err != nil {
+			log.Printf("ERROR Invalid Proof of Work for Token %v: %v", request.Token, err)
+			http.Error(w, "ERROR", http.StatusBadRequest)
+			return
+		}
+	}
+	// the captcha is verified last, the request to the provider takes the longest
+	if c.captcha != nil {
+		ip, _ := c.tarpit.getIP(r)
+		if err := c.captcha.Verify(request.Captcha, ip, c.recipients[request.To].captchaScore()); err != nil {
+			log.Printf("ERROR Captcha Verification: %v", err)
+			http.Error(w, "ERROR", http.StatusBadRequest)
+			return
+		}
+	}
 	// validate token:
-	if err := c.activeTokens.Validate(request.Token); err != nil {
+	token, err := c.activeTokens.Validate(request.Token)
+	if err != nil {
 		log.Printf("ERROR Invalid Token %v: %v", request.Token, err)
 		http.Error(w, "ERROR", http.StatusBadRequest)
 		return
 	}
-	if err := c.mailServer.Send(MessageObjectFromRequest(request)); err != nil {
+	// bots send the form right after they got the token, the token can not be used again anyway
+	if elapsed := time.Since(token.Issued); elapsed < c.minFillTime {
+		log.Printf("ERROR Form filled too fast: %v after the token, at least %v are required", elapsed, c.minFillTime)
+		http.Error(w, "ERROR", http.StatusBadRequest)
+		return
+	}
+	// bots fill every field, they get the answer of a sent message so they do not learn that it is dropped.
+	// Invalid requests get the same error with and without a filled honeypot.
+	if trapped {
+		log.Printf("Honeypot field filled, dropping message from %v", request.From)
+		w.WriteHeader(c.successStatus(request.To))
+		return
+	}
+	message := MessageObjectFromRequest(request)
+	message.attachments = attachments
+	// the content is scored after the token, so that only real submissions are remembered as duplicates
+	quarantined, err := c.checkSpam(message)
+	if err != nil {
+		log.Printf("ERROR Spam: %v", err)
+		http.Error(w, "ERROR", http.StatusBadRequest)
+		return
+	}
+	if quarantined {
+		// the submitter gets the answer of a sent message
+		w.WriteHeader(c.successStatus(request.To))
+		return
+	}
+	// the scanner runs before the message is held, sent or dispatched, so nothing of a dropped message goes out
+	dropped, err := c.scanSpam(message)
+	if errors.Is(err, errScanFailed) {
+		log.Printf("ERROR Spam Scan: %v", err)
+		http.Error(w, "ERROR", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR Spam Scan: %v", err)
+		http.Error(w, "ERROR", http.StatusBadRequest)
+		return
+	}
+	if dropped {
+		w.WriteHeader(c.successStatus(request.To))
+		return
+	}
+	if c.holds(request.To) {
+		// the message is only sent once the submitter confirms it
+		if err := c.confirmations.Hold(message); err != nil {
+			log.Printf("ERROR Confirmation Mail: %v", err)
+			http.Error(w, "ERROR", http.StatusBadRequest)
+			return
+		}
+	} else if err := c.mailServer.Send(message); err != nil {
 		log.Printf("ERROR Mail Sending: %v", err)
 		http.Error(w, "ERROR", http.StatusBadRequest)
 		return
 	}
+	w.WriteHeader(c.successStatus(request.To))
+}
 
-	w.WriteHeader(http.StatusCreated)
+// scanSpam has the rendered message checked by the spam scanner, it returns true if the message has been quarantined
+// or dropped. The ticket of an auto reply is part of the rendered message, so it is assigned before the check.
+func (c *Controller) scanSpam(message *EmailMessage) (bool, error) {
+	if c.scanner == nil {
+		return false, nil
+	}
+	if options := c.recipients[message.recipientID]; options != nil && options.AutoReply != nil && message.ticket == "" {
+		ticket, err := newTicket()
+		if err != nil {
+			return false, err
+		}
+		message.ticket = ticket
+	}
+	return c.scanner.Check(message)
+}
+
+// checkSpam runs the spam filter on the message. Tagged messages get the prefix in the subject for the recipient, quarantined
+// messages are stored and must not be sent. A rejected message returns an error.
+func (c *Controller) checkSpam(message *EmailMessage) (bool, error) {
+	if c.spam == nil {
+		return false, nil
+	}
+	verdict := c.spam.Check(message)
+	reasons := strings.Join(verdict.Reasons, ", ")
+	switch verdict.Action {
+	case SpamReject:
+		return false, fmt.Errorf("message from %v rejected with score %g: %v", message.from, verdict.Score, reasons)
+	case SpamQuarantine:
+		if c.quarantine == nil {
+			return false, errors.New("no quarantine for a suspicious message")
+		}
+		return true, c.quarantine.Store(message, fmt.Sprintf("spam score %g: %v", verdict.Score, reasons))
+	case SpamTag:
+		log.Printf("Message from %v tagged as spam with score %g: %v", message.from, verdict.Score, reasons)
+		message.spamTag = c.spam.tagPrefix
+	}
+	return false, nil
+}
+
+// holds returns true if the messages for the recipient are held until the submitter confirms them
+func (c *Controller) holds(to string) bool {
+	return c.recipients[to].needsConfirmation() && c.confirmations != nil
+}
+
+// successStatus returns the status of a successful send request for the recipient. Held and queued messages
+// have only been accepted, they are not sent yet.
+func (c *Controller) successStatus(to string) int {
+	if c.holds(to) || c.mailServer.Queued() {
+		return http.StatusAccepted
+	}
+	return http.StatusCreated
+}
+
+// ConfirmMail is the handler for the /confirm/:id endpoint, it sends the held message of the confirmation link
+func (c *Controller) ConfirmMail(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if c.confirmations == nil {
+		http.NotFound(w, r)
+		return
+	}
+	err := c.confirmations.Release(params.ByName("id"), c.mailServer.Send)
+	if err == errUnknownConfirmation {
+		log.Printf("ERROR Confirmation: %v", err)
+		http.Error(w, "ERROR", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		// the message is still held, the link can be opened again
+		log.Printf("ERROR Mail Sending: %v", err)
+		http.Error(w, "ERROR", http.StatusServiceUnavailable)
+		return
+	}
+	if c.confirmRedirect != "" {
+		http.Redirect(w, r, c.confirmRedirect, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "Thank you, your message has been sent.")
+}
+
+// ProofOfWorkScript is the handler for the /pow.js endpoint, it serves the reference solver of the challenges
+func (c *Controller) ProofOfWorkScript(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Write(powScript)
 }
 
 // Request and Response Objects
 
 // TokenResponse represents the response object returned by the token endpoint
 type TokenResponse struct {
-	Token   string
-	Expires int64
+	Token      string
+	Expires    int64
+	Challenge  string `json:",omitempty"`
+	Difficulty int    `json:",omitempty"`
 }
 
 // ResponseObjectFromToken is a mapper method that returns a TokenResponse for the HTTP endpoint from a given Token
@@ -135,11 +383,15 @@ func ResponseObjectFromToken(token *Token) (*TokenResponse, error) {
 
 // SendMailRequest represents the accepted structure that clients send to the send endpoint
 type SendMailRequest struct {
-	Token   string `json:"Token"`
-	From    string `json:"From"`
-	To      string `json:"To"`
-	Subject string `json:"Subject"`
-	Body    string `json:"Body"`
+	Token     string            `json:"Token"`
+	From      string            `json:"From"`
+	To        string            `json:"To"`
+	Subject   string            `json:"Subject"`
+	Body      string            `json:"Body"`
+	Fields    map[string]string `json:"Fields"`
+	Challenge string            `json:"Challenge"`
+	Nonce     string            `json:"Nonce"`
+	Captcha   string            `json:"Captcha"`
 }
 
 // Validate checks whether all required fields are set
@@ -151,16 +403,25 @@ func (in *SendMailRequest) Validate() error {
 	}
 	if in.From == "" {
 		msg = append(msg, "From must be set")
+	} else if _, err := netmail.ParseAddress(in.From); err != nil || strings.ContainsAny(in.From, "\r\n") {
+		msg = append(msg, "From must be a valid email address")
 	}
 	if in.To == "" {
 		msg = append(msg, "To must be set")
 	}
 	if in.Subject == "" {
 		msg = append(msg, "Subject must be set")
+	} else if strings.ContainsAny(in.Subject, "\r\n") {
+		msg = append(msg, "Subject must not contain line breaks")
 	}
 	if in.Body == "" {
 		msg = append(msg, "Message Body must be set")
 	}
+	for name := range in.Fields {
+		if !fieldNameRe.MatchString(name) {
+			msg = append(msg, fmt.Sprintf("Invalid field name %q", name))
+		}
+	}
 	if len(msg) > 0 {
 		return errors.New(strings.Join(msg, "\n"))
 	}
@@ -174,5 +435,6 @@ func MessageObjectFromRequest(request SendMailRequest) *EmailMessage {
 		recipientID: request.To,
 		subject:     request.Subject,
 		body:        request.Body,
+		fields:      request.Fields,
 	}
 }
@@ -8,23 +8,30 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 // create mock object for mailServer
 type MockMailServer struct {
+	sent *EmailMessage
 }
 
 func (ms *MockMailServer) Send(m *EmailMessage) error {
+	ms.sent = m
 	return nil
 }
+func (ms *MockMailServer) Queued() bool {
+	return false
+}
 
 // create mock object for activeTokens
 type MockActiveTokens struct {
-	calledNew int
-	lastToken *Token
-	mockNew   func() (*Token, error)
+	calledNew    int
+	lastToken    *Token
+	mockNew      func() (*Token, error)
+	mockValidate func(key string) (*Token, error)
 }
 
 // New delegates to mockable
@@ -34,8 +41,11 @@ func (at *MockActiveTokens) New() (*Token, error) {
 	}
 	return nil, fmt.Errorf("No mocked function found")
 }
-func (at *MockActiveTokens) Validate(key string) error {
-	return nil
+func (at *MockActiveTokens) Validate(key string) (*Token, error) {
+	if at.mockValidate != nil {
+		return at.mockValidate(key)
+	}
+	return &Token{}, nil
 }
 func (at *MockActiveTokens) Clean() int {
 	return 0
@@ -158,7 +168,7 @@ func TestController_GetTokenNewError(t *testing.T) {
 // TODO * marshalling or response object creation fails
 
 func TestController_SendMail_OK(t *testing.T) {
-	msg := string(`{"Token": "TOKEN","From": "FROM", "To": "TO", "Subject": "SUBJECT", "Body": "BODY"}`)
+	msg := string(`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY"}`)
 	req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
 	rr := doRequestDefault(req)
 	// check status
@@ -192,6 +202,122 @@ func TestController_SendMail_EmptyBody(t *testing.T) {
 	}
 }
 
+func TestController_SendMail_InvalidFields(t *testing.T) {
+	ms := &MockMailServer{}
+	at := &MockActiveTokens{}
+	tp := &MockTarpit{}
+	c := newController(ms, at, tp)
+	c.recipients = map[string]*RecipientOptions{
+		"TO": {Fields: []*FieldSpec{{Name: "phone", Type: FieldTypePhone, Required: true}}},
+	}
+
+	requests := map[string]int{
+		`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"phone": "0123"}}`:           http.StatusCreated,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY"}`:                                        http.StatusBadRequest,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"phone": "no"}}`:             http.StatusBadRequest,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"phone": "0123", "x": "y"}}`: http.StatusBadRequest,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "OTHER", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"bad name": "y"}}`:        http.StatusBadRequest,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "OTHER", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"anything": "y"}}`:        http.StatusCreated,
+	}
+	for msg, expected := range requests {
+		req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+		rr := doRequestController(req, c)
+		if status := rr.Code; status != expected {
+			t.Errorf("Wrong status for %s: %d, should be %d", msg, status, expected)
+		}
+	}
+}
+
+func TestController_SendMail_Honeypot(t *testing.T) {
+	ms := &MockMailServer{}
+	c := newController(ms, &MockActiveTokens{}, &MockTarpit{})
+	c.honeypot = "website"
+	c.recipients = map[string]*RecipientOptions{
+		"TO": {Fields: []*FieldSpec{{Name: "phone"}}},
+	}
+
+	// a filled honeypot looks like a sent message
+	msg := `{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"website": "http://spam.example.com"}}`
+	req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+	if status := doRequestController(req, c).Code; status != http.StatusCreated {
+		t.Errorf("Wrong status for a filled honeypot: %d, should be %d", status, http.StatusCreated)
+	}
+	if ms.sent != nil {
+		t.Errorf("Error: message with a filled honeypot has been sent")
+	}
+
+	// an empty honeypot is not a custom field of the message
+	msg = `{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"website": "", "phone": "0123"}}`
+	req, _ = http.NewRequest("POST", "/send", strings.NewReader(msg))
+	if status := doRequestController(req, c).Code; status != http.StatusCreated {
+		t.Errorf("Wrong status for an empty honeypot: %d, should be %d", status, http.StatusCreated)
+	}
+	if ms.sent == nil {
+		t.Fatalf("Error: message with an empty honeypot has not been sent")
+	}
+	if _, found := ms.sent.fields["website"]; found {
+		t.Errorf("Error: honeypot field has been sent with the message")
+	}
+}
+
+func TestController_SendMail_HoneypotLast(t *testing.T) {
+	at := &MockActiveTokens{mockValidate: func(key string) (*Token, error) {
+		if key != "TOKEN" {
+			return nil, fmt.Errorf("invalid token")
+		}
+		return &Token{}, nil
+	}}
+	c := newController(&MockMailServer{}, at, &MockTarpit{})
+	c.honeypot = "website"
+	c.recipients = map[string]*RecipientOptions{
+		"TO": {Fields: []*FieldSpec{{Name: "phone"}}},
+	}
+
+	// an invalid request gets the same error with a filled honeypot, so the honeypot cannot be found out
+	requests := []string{
+		`{"Token": "BAD","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"website": "http://spam.example.com"}}`,
+		`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY", "Fields": {"website": "http://spam.example.com", "fax": "0123"}}`,
+	}
+	for _, msg := range requests {
+		req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+		if status := doRequestController(req, c).Code; status != http.StatusBadRequest {
+			t.Errorf("Wrong status for %s: %d, should be %d", msg, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestController_SendMail_MinFillTime(t *testing.T) {
+	config := getConfig(10, 5)
+	at := newActiveTokens(&config)
+	c := newController(&MockMailServer{}, at, &MockTarpit{})
+	c.minFillTime = time.Second
+
+	send := func(token *Token) int {
+		msg := fmt.Sprintf(`{"Token": %q,"From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY"}`, token.String())
+		req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+		return doRequestController(req, c).Code
+	}
+	fast, err := at.New()
+	if err != nil {
+		t.Fatalf("Error in getting token: %v", err)
+	}
+	if status := send(fast); status != http.StatusBadRequest {
+		t.Errorf("Wrong status for a form filled too fast: %d, should be %d", status, http.StatusBadRequest)
+	}
+	if _, found := at.get(fast.String()); found {
+		t.Errorf("Error: token of a form filled too fast can be used again")
+	}
+
+	slow, err := at.New()
+	if err != nil {
+		t.Fatalf("Error in getting token: %v", err)
+	}
+	slow.Issued = slow.Issued.Add(-2 * time.Second)
+	if status := send(slow); status != http.StatusCreated {
+		t.Errorf("Wrong status for a form filled in time: %d, should be %d", status, http.StatusCreated)
+	}
+}
+
 // TODO other tests:
 // send mail with body size too big
 // send mail with json fields missing
@@ -200,6 +326,34 @@ func TestController_SendMail_EmptyBody(t *testing.T) {
 
 // ************************************************************************** //
 
+func TestController_InitFromConfig(t *testing.T) {
+	t.Parallel()
+	config := &ApplicationConfig{
+		RecipientOptions: map[string]*RecipientOptions{"TO": {Confirm: &ReplyOptions{}}},
+		UploadLimit:      1024,
+		ConfirmRedirect:  "https://example.com/thanks",
+		HoneypotField:    "website",
+		MinFillTime:      3,
+		PowDifficulty:    10,
+		CleanupInterval:  10,
+	}
+	c, err := InitController(config, &MockMailServer{}, &MockMailServer{}, &MockActiveTokens{}, &MockTarpit{}, nil)
+	if err != nil {
+		t.Fatalf("Error initializing the controller: %v", err)
+	}
+	if c.recipients["TO"] == nil || c.uploadLimit != 1024 || c.confirmations == nil || c.confirmRedirect != "https://example.com/thanks" {
+		t.Errorf("The recipient settings were not taken from the config: %+v", c)
+	}
+	if c.honeypot != "website" || c.minFillTime != 3*time.Second || c.pow == nil || c.captcha != nil || c.spam != nil {
+		t.Errorf("The checks were not taken from the config: %+v", c)
+	}
+
+	config.PowMaxDifficulty = 5
+	if _, err := InitController(config, &MockMailServer{}, &MockMailServer{}, &MockActiveTokens{}, &MockTarpit{}, nil); err == nil {
+		t.Errorf("Error: controller with an invalid proof of work was initialized")
+	}
+}
+
 // HELPER METHODS
 func doRequestDefault(req *http.Request) *httptest.ResponseRecorder {
 	// empty mocks to initialize controller
@@ -210,10 +364,14 @@ func doRequestDefault(req *http.Request) *httptest.ResponseRecorder {
 	return doRequest(req, ms, at, tp)
 }
 func doRequest(req *http.Request, ms MailServerInterface, at ActiveTokensInterface, tp TarpitInterface) *httptest.ResponseRecorder {
-	c := InitController(ms, at, tp)
+	return doRequestController(req, newController(ms, at, tp))
+}
+func doRequestController(req *http.Request, c *Controller) *httptest.ResponseRecorder {
 	router := httprouter.New()
 	router.GET("/token", c.GetToken)
 	router.POST("/send", c.SendMail)
+	router.GET("/confirm/:id", c.ConfirmMail)
+	router.GET("/pow.js", c.ProofOfWorkScript)
 
 	rr := httptest.NewRecorder()
 
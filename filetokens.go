@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fileTokenNew marks a log line that records a newly issued token
+	fileTokenNew = "N"
+	// fileTokenUsed marks a log line that records a token that has been used
+	fileTokenUsed = "U"
+)
+
+// FileTokens implements ActiveTokensInterface with an append-only log file, so that active tokens survive a restart.
+// Every issued and every used token is appended to the log, on startup the log is replayed into memory.
+// The cleanup ticker rewrites the log with only the tokens that are still active.
+type FileTokens struct {
+	tokens          *ActiveTokens
+	fileName        string
+	file            *os.File
+	cleanupInterval int
+	sync.Mutex
+}
+
+// New creates a new token and records it in the log before it is handed out
+func (ft *FileTokens) New() (*Token, error) {
+	ft.Lock()
+	defer ft.Unlock()
+	token, err := ft.tokens.New()
+	if err != nil {
+		return nil, err
+	}
+	if err := ft.append(fileTokenNew, token.String(), strconv.FormatInt(token.Expires.UnixNano(), 10)); err != nil {
+		ft.tokens.remove(token.String())
+		return nil, err
+	}
+	return token, nil
+}
+
+// Validate checks the token like ActiveTokens.Validate does. The usage is recorded in the log
+// before the token is accepted, so that a token can not be used again after a restart.
+func (ft *FileTokens) Validate(key string) (*Token, error) {
+	ft.Lock()
+	defer ft.Unlock()
+	if _, ok := ft.tokens.get(key); !ok {
+		return nil, errors.New("token did not exist")
+	}
+	if err := ft.append(fileTokenUsed, key); err != nil {
+		return nil, err
+	}
+	return ft.tokens.Validate(key)
+}
+
+// Clean deletes the expired tokens and compacts the log file
+func (ft *FileTokens) Clean() int {
+	ft.Lock()
+	defer ft.Unlock()
+	i := ft.tokens.Clean()
+	if err := ft.compact(); err != nil {
+		log.Printf("ERROR compacting token file %s: %v", ft.fileName, err)
+	}
+	return i
+}
+
+// SetupTicker creates a ticker that calls Clean() in regular intervals (config.CleanupInterval)
+func (ft *FileTokens) SetupTicker() {
+	ticker := time.NewTicker(time.Second * time.Duration(ft.cleanupInterval))
+	go func() {
+		for t := range ticker.C {
+			deleted := ft.Clean()
+			if deleted > 0 {
+				log.Printf("[%s] Cleaning up %d active tokens", t, deleted)
+			}
+		}
+	}()
+}
+
+// append writes one line to the log
+func (ft *FileTokens) append(fields ...string) error {
+	_, err := fmt.Fprintln(ft.file, strings.Join(fields, " "))
+	return err
+}
+
+// load replays the log file into memory, tokens that have been used or are expired are skipped.
+// The log only records the expiration, so the time of issue is derived from the lifetime.
+func (ft *FileTokens) load() error {
+	file, err := os.Open(ft.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 3 && fields[0] == fileTokenNew:
+			nanos, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				log.Printf("ERROR skipping invalid expiration in token file: %v", scanner.Text())
+				continue
+			}
+			token, err := parseToken(fields[1], time.Unix(0, nanos))
+			if err != nil {
+				log.Printf("ERROR skipping invalid token in token file: %v", err)
+				continue
+			}
+			token.Issued = token.Expires.Add(-time.Duration(ft.tokens.lifetime) * time.Second)
+			ft.tokens.add(token)
+		case len(fields) == 2 && fields[0] == fileTokenUsed:
+			ft.tokens.remove(fields[1])
+		case len(fields) == 0:
+			// a crash may have left an empty line
+		default:
+			// a crash may have left a partial last line, it can not describe a handed out token
+			log.Printf("ERROR skipping invalid line in token file: %v", scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	ft.tokens.Clean()
+	return nil
+}
+
+// compact replaces the log file with one that only contains the active tokens
+func (ft *FileTokens) compact() error {
+	tmpName := ft.fileName + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	ft.tokens.each(func(key string, token *Token) {
+		fmt.Fprintln(w, fileTokenNew, key, token.Expires.UnixNano())
+	})
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, ft.fileName); err != nil {
+		return err
+	}
+	return ft.open()
+}
+
+// open (re)opens the log file for appending
+func (ft *FileTokens) open() error {
+	file, err := os.OpenFile(ft.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if ft.file != nil {
+		ft.file.Close()
+	}
+	ft.file = file
+	return nil
+}
+
+// newFileTokens loads the token file and returns a FileTokens without starting the cleanup ticker
+func newFileTokens(config *ApplicationConfig) (*FileTokens, error) {
+	if config.TokenFile == "" {
+		return nil, errors.New("tokenFile must be set for the file token store")
+	}
+	ft := &FileTokens{
+		tokens:          newActiveTokens(config),
+		fileName:        config.TokenFile,
+		cleanupInterval: config.CleanupInterval,
+	}
+	if err := ft.load(); err != nil {
+		return nil, err
+	}
+	if err := ft.compact(); err != nil {
+		return nil, err
+	}
+	return ft, nil
+}
+
+// InitFileTokens is the factory function to initialize the file backed token store
+func InitFileTokens(config *ApplicationConfig) (*FileTokens, error) {
+	ft, err := newFileTokens(config)
+	if err != nil {
+		return nil, err
+	}
+	ft.SetupTicker()
+	return ft, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileTokens_SurviveRestart(t *testing.T) {
+	t.Parallel()
+	config, dir := getFileTokensConfig(t, 10)
+	defer os.RemoveAll(dir)
+
+	store, err := newFileTokens(&config)
+	if err != nil {
+		t.Fatalf("Error initializing file tokens: %v", err)
+	}
+	token, err := store.New()
+	if err != nil {
+		t.Fatalf("Error in getting new token: %v", err)
+	}
+
+	// simulate a restart by loading the same file again
+	restarted, err := newFileTokens(&config)
+	if err != nil {
+		t.Fatalf("Error re-initializing file tokens: %v", err)
+	}
+	exists, found := restarted.tokens.get(token.String())
+	if !found {
+		t.Fatalf("Error: token did not survive restart: %v", token.String())
+	}
+	// the monotonic clock reading is lost in the file, so compare the wall clock only
+	if exists.String() != token.String() || !exists.Expires.Equal(token.Expires) {
+		t.Errorf("Error: restored token differs from issued token")
+	}
+	if _, err := restarted.Validate(token.String()); err != nil {
+		t.Errorf("Error: restored token did not validate: %v", err)
+	}
+}
+
+func TestFileTokens_UsedTokenStaysUsed(t *testing.T) {
+	t.Parallel()
+	config, dir := getFileTokensConfig(t, 10)
+	defer os.RemoveAll(dir)
+
+	store, err := newFileTokens(&config)
+	if err != nil {
+		t.Fatalf("Error initializing file tokens: %v", err)
+	}
+	token, err := store.New()
+	if err != nil {
+		t.Fatalf("Error in getting new token: %v", err)
+	}
+	if _, err := store.Validate(token.String()); err != nil {
+		t.Fatalf("Error: token validation returned error: %v", err)
+	}
+	if _, err := store.Validate(token.String()); err == nil {
+		t.Errorf("Error: token could be used twice")
+	}
+
+	restarted, err := newFileTokens(&config)
+	if err != nil {
+		t.Fatalf("Error re-initializing file tokens: %v", err)
+	}
+	if _, err := restarted.Validate(token.String()); err == nil {
+		t.Errorf("Error: used token is valid again after restart")
+	}
+}
+
+func TestFileTokens_CleanCompactsFile(t *testing.T) {
+	t.Parallel()
+	config, dir := getFileTokensConfig(t, 1)
+	defer os.RemoveAll(dir)
+
+	store, err := newFileTokens(&config)
+	if err != nil {
+		t.Fatalf("Error initializing file tokens: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.New(); err != nil {
+			t.Fatalf("Error in getting new token: %v", err)
+		}
+	}
+	if lines := countLines(t, config.TokenFile); lines != 3 {
+		t.Errorf("Error: token file should have 3 lines but has %v", lines)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if deleted := store.Clean(); deleted != 3 {
+		t.Errorf("clean method returned %v but should have returned 3", deleted)
+	}
+	if lines := countLines(t, config.TokenFile); lines != 0 {
+		t.Errorf("Error: token file should be empty after clean but has %v lines", lines)
+	}
+
+	// the store must still be usable after compaction
+	if _, err := store.New(); err != nil {
+		t.Fatalf("Error in getting new token after clean: %v", err)
+	}
+	if lines := countLines(t, config.TokenFile); lines != 1 {
+		t.Errorf("Error: token file should have 1 line but has %v", lines)
+	}
+}
+
+func TestFileTokens_SkipsCorruptLines(t *testing.T) {
+	t.Parallel()
+	config, dir := getFileTokensConfig(t, 10)
+	defer os.RemoveAll(dir)
+
+	content := "N 00000000-0000-0000-0000-000000000001 " + formatNanos(time.Now().Add(time.Minute)) + "\n" +
+		"garbage\n" +
+		"N 00000000-0000-0000-0000-0000000"
+	if err := ioutil.WriteFile(config.TokenFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Error writing token file: %v", err)
+	}
+	store, err := newFileTokens(&config)
+	if err != nil {
+		t.Fatalf("Error initializing file tokens: %v", err)
+	}
+	if store.tokens.Len() != 1 {
+		t.Errorf("Error: expected 1 restored token but got %v", store.tokens.Len())
+	}
+}
+
+func TestActiveTokens_InitTokenStore(t *testing.T) {
+	t.Parallel()
+	config := getConfig(1, 1)
+	config.TokenStore = "unknown"
+	if _, err := InitTokenStore(&config); err == nil {
+		t.Errorf("Error: unknown token store should return an error")
+	}
+	config.TokenStore = "file"
+	if _, err := InitTokenStore(&config); err == nil {
+		t.Errorf("Error: file token store without file should return an error")
+	}
+}
+
+// HELPER METHODS
+func getFileTokensConfig(t *testing.T, lifetime int) (ApplicationConfig, string) {
+	dir, err := ioutil.TempDir("", "mailbridge-tokens")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	config := getConfig(lifetime, 60)
+	config.TokenStore = "file"
+	config.TokenFile = filepath.Join(dir, "tokens.log")
+	return config, dir
+}
+func countLines(t *testing.T, fileName string) int {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Error opening %s: %v", fileName, err)
+	}
+	defer file.Close()
+	i := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		i++
+	}
+	return i
+}
+func formatNanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
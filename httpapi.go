@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	// apiTimeout is the maximal time of a request to a mail provider
+	apiTimeout = 30 * time.Second
+	// apiErrorLength is the maximal length of an error response of a mail provider that is kept
+	apiErrorLength = 1024
+)
+
+// mailAPI builds the request to the API of a mail provider for an envelope
+type mailAPI interface {
+	newRequest(envelope *Envelope) (*http.Request, error)
+}
+
+// HTTPProvider implements MailServerInterface, it delivers the mails through the HTTP API of a transactional mail provider
+type HTTPProvider struct {
+	name     string
+	composer *Composer
+	api      mailAPI
+	client   *http.Client
+}
+
+// InitHTTPProvider is the factory method to initialize a HTTPProvider for the transport in the config
+func InitHTTPProvider(config *ApplicationConfig) (*HTTPProvider, error) {
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("transport %v needs an apiKey", config.Transport)
+	}
+	var api mailAPI
+	switch config.Transport {
+	case TransportSendGrid:
+		api = &sendGridAPI{endpoint: apiEndpoint(config, "https://api.sendgrid.com"), key: config.APIKey}
+	case TransportMailgun:
+		if config.APIDomain == "" {
+			return nil, errors.New("transport mailgun needs an apiDomain")
+		}
+		api = &mailgunAPI{endpoint: apiEndpoint(config, "https://api.mailgun.net"), domain: config.APIDomain, key: config.APIKey}
+	case TransportSES:
+		if config.APIKeyID == "" || config.APIRegion == "" {
+			return nil, errors.New("transport ses needs an apiKeyId and an apiRegion")
+		}
+		api = &sesAPI{
+			endpoint: apiEndpoint(config, "https://email."+config.APIRegion+".amazonaws.com"),
+			region:   config.APIRegion,
+			keyID:    config.APIKeyID,
+			secret:   config.APIKey,
+			now:      time.Now,
+		}
+	default:
+		return nil, fmt.Errorf("unknown mail provider %q", config.Transport)
+	}
+	return &HTTPProvider{
+		name:     config.Transport,
+		composer: InitComposer(config),
+		api:      api,
+		client:   &http.Client{Timeout: apiTimeout},
+	}, nil
+}
+
+// apiEndpoint returns the configured endpoint or the default endpoint of the provider
+func apiEndpoint(config *ApplicationConfig, defaultEndpoint string) string {
+	if config.APIEndpoint != "" {
+		return strings.TrimSuffix(config.APIEndpoint, "/")
+	}
+	return defaultEndpoint
+}
+
+// Send composes the mail and posts it to the API of the provider
+func (p *HTTPProvider) Send(mail *EmailMessage) error {
+	envelope, err := p.composer.Compose(mail)
+	if err != nil {
+		return err
+	}
+	req, err := p.api.newRequest(envelope)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, apiErrorLength))
+	if err := apiError(p.name, resp.StatusCode, body); err != nil {
+		return err
+	}
+	log.Printf("Mail Sent: %v via %v\n", envelope.To, p.name)
+	return nil
+}
+
+// Queued implements MailServerInterface, the mails are sent right away
+func (p *HTTPProvider) Queued() bool {
+	return false
+}
+
+// apiError maps the status of the response to an error. Only a rejection of the payload itself, like an invalid
+// address or a message that is too large, is permanent. Invalid keys and wrong endpoints are configuration errors,
+// the mails are retried until the configuration has been fixed, as are rate limits, timeouts and server errors.
+func apiError(name string, status int, body []byte) error {
+	if status >= 200 && status < 300 {
+		return nil
+	}
+	err := fmt.Errorf("%v answered with status %d: %s", name, status, bytes.TrimSpace(body))
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return &PermanentError{Err: err}
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		log.Printf("ERROR: %v rejected the request with status %d, check the key and the endpoint of the API", name, status)
+	}
+	return err
+}
+
+// sendGridAPI posts the mail to the v3 mail send API, which does not take raw MIME messages.
+// The composed message is split into its parts again.
+type sendGridAPI struct {
+	endpoint string
+	key      string
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Filename    string `json:"filename"`
+	Type        string `json:"type,omitempty"`
+	Disposition string `json:"disposition"`
+}
+
+type sendGridPersonalization struct {
+	To  []*sendGridAddress `json:"to"`
+	CC  []*sendGridAddress `json:"cc,omitempty"`
+	BCC []*sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridMessage struct {
+	Personalizations []*sendGridPersonalization `json:"personalizations"`
+	From             *sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress           `json:"reply_to,omitempty"`
+	Subject          string                     `json:"subject"`
+	Content          []*sendGridContent         `json:"content"`
+	Attachments      []*sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+func (api *sendGridAPI) newRequest(envelope *Envelope) (*http.Request, error) {
+	parsed, err := parseMessage(envelope.Data)
+	if err != nil {
+		return nil, err
+	}
+	// the API writes its own header, the envelope recipients that are not in To or Cc are blind copies
+	personalization := &sendGridPersonalization{}
+	inHeader := make(map[string]bool)
+	for _, to := range parsed.to {
+		personalization.To = append(personalization.To, &sendGridAddress{Email: to.Address, Name: to.Name})
+		inHeader[strings.ToLower(to.Address)] = true
+	}
+	for _, cc := range parsed.cc {
+		personalization.CC = append(personalization.CC, &sendGridAddress{Email: cc.Address, Name: cc.Name})
+		inHeader[strings.ToLower(cc.Address)] = true
+	}
+	for _, to := range envelope.To {
+		if !inHeader[strings.ToLower(to)] {
+			personalization.BCC = append(personalization.BCC, &sendGridAddress{Email: to})
+		}
+	}
+	message := &sendGridMessage{
+		Personalizations: []*sendGridPersonalization{personalization},
+		From:             &sendGridAddress{Email: parsed.from.Address, Name: parsed.from.Name},
+		Subject:          parsed.subject,
+	}
+	if parsed.replyTo != nil {
+		message.ReplyTo = &sendGridAddress{Email: parsed.replyTo.Address, Name: parsed.replyTo.Name}
+	}
+	if parsed.text != "" {
+		message.Content = append(message.Content, &sendGridContent{Type: "text/plain", Value: parsed.text})
+	}
+	if parsed.html != "" {
+		message.Content = append(message.Content, &sendGridContent{Type: "text/html", Value: parsed.html})
+	}
+	for _, attachment := range parsed.attachments {
+		message.Attachments = append(message.Attachments, &sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(attachment.Data),
+			Filename:    attachment.Filename,
+			Type:        attachment.ContentType,
+			Disposition: "attachment",
+		})
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", api.endpoint+"/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+api.key)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// mailgunAPI posts the raw MIME message to the messages.mime API of a Mailgun domain
+type mailgunAPI struct {
+	endpoint string
+	domain   string
+	key      string
+}
+
+func (api *mailgunAPI) newRequest(envelope *Envelope) (*http.Request, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, to := range envelope.To {
+		if err := w.WriteField("to", to); err != nil {
+			return nil, err
+		}
+	}
+	part, err := w.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(envelope.Data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", api.endpoint+"/v3/"+api.domain+"/messages.mime", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("api", api.key)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, nil
+}
+
+// parsedMessage holds the parts of a composed message for APIs that do not take raw MIME messages
+type parsedMessage struct {
+	from        *netmail.Address
+	replyTo     *netmail.Address
+	to          []*netmail.Address
+	cc          []*netmail.Address
+	subject     string
+	text        string
+	html        string
+	attachments []*Attachment
+}
+
+// parseMessage splits a composed message into its headers, bodies and attachments
+func parseMessage(data []byte) (*parsedMessage, error) {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	parsed := &parsedMessage{}
+	if parsed.from, err = netmail.ParseAddress(msg.Header.Get("From")); err != nil {
+		return nil, err
+	}
+	if replyTo := msg.Header.Get("Reply-To"); replyTo != "" {
+		if parsed.replyTo, err = netmail.ParseAddress(replyTo); err != nil {
+			return nil, err
+		}
+	}
+	if parsed.to, err = msg.Header.AddressList("To"); err != nil {
+		return nil, err
+	}
+	if parsed.cc, err = msg.Header.AddressList("Cc"); err != nil && err != netmail.ErrHeaderNotPresent {
+		return nil, err
+	}
+	if parsed.subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		return nil, err
+	}
+	if err := parsed.walk(textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// walk collects the text, html and attachment parts of a MIME entity
+func (p *parsedMessage) walk(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			// NextPart decodes quoted-printable parts already
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := p.walk(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	switch {
+	case disposition == "attachment":
+		p.attachments = append(p.attachments, &Attachment{Filename: dispositionParams["filename"], ContentType: mediaType, Data: content})
+	case mediaType == "text/html":
+		p.html = string(content)
+	default:
+		p.text = string(content)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProvider_SendGrid(t *testing.T) {
+	t.Parallel()
+	var received sendGridMessage
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/mail/send" || r.Header.Get("Authorization") != "Bearer KEY" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	p := newTestHTTPProvider(t, TransportSendGrid, api.URL)
+	msg := newTestMessage()
+	msg.subject = "Grüße"
+	msg.attachments = []*Attachment{{Filename: "cv.pdf", ContentType: "application/pdf", Data: pdfContent}}
+	if err := p.Send(msg); err != nil {
+		t.Fatalf("Error sending through SendGrid: %v", err)
+	}
+	if len(received.Personalizations) != 1 || received.Personalizations[0].To[0].Email != "to@example.com" {
+		t.Errorf("Wrong recipients: %+v", received.Personalizations)
+	}
+	if received.From.Email != "noreply@example.com" || received.ReplyTo.Email != "from@example.com" || received.Subject != "Grüße" {
+		t.Errorf("Wrong headers: %+v %+v %v", received.From, received.ReplyTo, received.Subject)
+	}
+	if len(received.Content) != 1 || received.Content[0].Type != "text/plain" || received.Content[0].Value != "BODY" {
+		t.Errorf("Wrong content: %+v", received.Content)
+	}
+	if len(received.Attachments) != 1 || received.Attachments[0].Filename != "cv.pdf" {
+		t.Errorf("Wrong attachments: %+v", received.Attachments)
+	}
+}
+
+func TestHTTPProvider_SendGridCopies(t *testing.T) {
+	t.Parallel()
+	var received sendGridMessage
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	p := newTestHTTPProvider(t, TransportSendGrid, api.URL)
+	p.composer.recipients = map[string]*RecipientOptions{"id1": {CC: []string{"cc@example.com"}, BCC: []string{"bcc@example.com"}}}
+	if err := p.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error sending through SendGrid: %v", err)
+	}
+	personalization := received.Personalizations[0]
+	if len(personalization.To) != 1 || len(personalization.CC) != 1 || personalization.CC[0].Email != "cc@example.com" {
+		t.Errorf("Wrong recipients: %+v", personalization)
+	}
+	if len(personalization.BCC) != 1 || personalization.BCC[0].Email != "bcc@example.com" {
+		t.Errorf("Blind copy was not sent as bcc: %+v", personalization.BCC)
+	}
+}
+
+func TestHTTPProvider_Mailgun(t *testing.T) {
+	t.Parallel()
+	var to []string
+	var subject string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if r.URL.Path != "/v3/mg.example.com/messages.mime" || user != "api" || password != "KEY" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("message")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parsed, err := mail.ReadMessage(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, subject = r.MultipartForm.Value["to"], parsed.Header.Get("Subject")
+		w.Write([]byte(`{"id": "<1@mg.example.com>", "message": "Queued. Thank you."}`))
+	}))
+	defer api.Close()
+
+	p := newTestHTTPProvider(t, TransportMailgun, api.URL)
+	if err := p.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error sending through Mailgun: %v", err)
+	}
+	if len(to) != 1 || to[0] != "to@example.com" || subject != "SUBJECT" {
+		t.Errorf("Wrong message: %v %v", to, subject)
+	}
+}
+
+func TestHTTPProvider_SES(t *testing.T) {
+	t.Parallel()
+	var received sesMessage
+	var authorization string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if r.URL.Path != "/v2/email/outbound-emails" || r.Header.Get("X-Amz-Date") != "20240102T030405Z" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"MessageId": "1"}`))
+	}))
+	defer api.Close()
+
+	p := newTestHTTPProvider(t, TransportSES, api.URL)
+	p.api.(*sesAPI).now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	if err := p.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error sending through SES: %v", err)
+	}
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=KEYID/20240102/eu-west-1/ses/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=") {
+		t.Errorf("Wrong authorization: %v", authorization)
+	}
+	if received.FromEmailAddress != "noreply@example.com" || received.Destination.ToAddresses[0] != "to@example.com" {
+		t.Errorf("Wrong envelope: %+v", received)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(received.Content.Raw.Data))
+	if err != nil || parsed.Header.Get("Subject") != "SUBJECT" {
+		t.Errorf("Wrong raw message: %v", err)
+	}
+}
+
+func TestHTTPProvider_Errors(t *testing.T) {
+	t.Parallel()
+	statuses := map[int]bool{
+		http.StatusBadRequest:            true,
+		http.StatusUnauthorized:          false,
+		http.StatusForbidden:             false,
+		http.StatusNotFound:              false,
+		http.StatusRequestEntityTooLarge: true,
+		http.StatusUnprocessableEntity:   true,
+		http.StatusRequestTimeout:        false,
+		http.StatusTooManyRequests:       false,
+		http.StatusInternalServerError:   false,
+		http.StatusServiceUnavailable:    false,
+	}
+	for status, permanent := range statuses {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"errors": [{"message": "something went wrong"}]}`, status)
+		}))
+		err := newTestHTTPProvider(t, TransportSendGrid, api.URL).Send(newTestMessage())
+		api.Close()
+		if err == nil || !strings.Contains(err.Error(), "something went wrong") {
+			t.Errorf("Status %d: expected the error of the provider, got %v", status, err)
+		}
+		if isPermanentError(err) != permanent {
+			t.Errorf("Status %d: permanent error is %v but should be %v", status, isPermanentError(err), permanent)
+		}
+	}
+
+	// the provider cannot be reached
+	api := httptest.NewServer(http.NotFoundHandler())
+	api.Close()
+	if err := newTestHTTPProvider(t, TransportSendGrid, api.URL).Send(newTestMessage()); err == nil || isPermanentError(err) {
+		t.Errorf("Expected a temporary error for an unreachable provider, got %v", err)
+	}
+}
+
+func TestHTTPProvider_InvalidConfig(t *testing.T) {
+	t.Parallel()
+	configs := map[string]*ApplicationConfig{
+		"no key":       {Transport: TransportSendGrid},
+		"no domain":    {Transport: TransportMailgun, APIKey: "KEY"},
+		"no region":    {Transport: TransportSES, APIKey: "KEY", APIKeyID: "KEYID"},
+		"unknown name": {Transport: "postmark", APIKey: "KEY"},
+	}
+	for name, config := range configs {
+		if _, err := InitHTTPProvider(config); err == nil {
+			t.Errorf("%s: invalid provider config was accepted", name)
+		}
+	}
+}
+
+func TestSES_SignV4(t *testing.T) {
+	t.Parallel()
+	// get-vanilla from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("Wrong signature:\n%v\nshould be\n%v", got, expected)
+	}
+}
+
+func TestHTTPProvider_ParseMessage(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-templates")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	options := &RecipientOptions{
+		TextTemplate: writeTemplate(t, dir, "mail.txt", "Text: {{.Body}}"),
+		HTMLTemplate: writeTemplate(t, dir, "mail.html", "<p>{{.Body}}</p>"),
+	}
+	if err := options.load(); err != nil {
+		t.Fatalf("Error loading templates: %v", err)
+	}
+	msg := newTestMessage()
+	msg.body = "Größe: 3 = 1 + 2"
+	msg.attachments = []*Attachment{{Filename: "cv.pdf", ContentType: "application/pdf", Data: bytes.Repeat(pdfContent, 10)}}
+	raw, err := composeMessage(msg, "Website <noreply@example.com>", &Recipients{To: []string{"to@example.com"}}, options)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+
+	parsed, err := parseMessage(raw)
+	if err != nil {
+		t.Fatalf("Error parsing message: %v", err)
+	}
+	if parsed.from.Name != "Website" || parsed.replyTo.Address != "from@example.com" || parsed.subject != "SUBJECT" {
+		t.Errorf("Wrong headers: %v %v %v", parsed.from, parsed.replyTo, parsed.subject)
+	}
+	if parsed.text != "Text: Größe: 3 = 1 + 2" || parsed.html != "<p>Größe: 3 = 1 &#43; 2</p>" {
+		t.Errorf("Wrong bodies: %q %q", parsed.text, parsed.html)
+	}
+	if len(parsed.attachments) != 1 || !bytes.Equal(parsed.attachments[0].Data, bytes.Repeat(pdfContent, 10)) {
+		t.Errorf("Wrong attachments: %+v", parsed.attachments)
+	}
+}
+
+// HELPER METHODS
+func newTestHTTPProvider(t *testing.T, transport string, endpoint string) *HTTPProvider {
+	config := &ApplicationConfig{
+		Sender:       "noreply@example.com",
+		RecipientMap: map[string]string{"id1": "to@example.com"},
+		Transport:    transport,
+		APIKey:       "KEY",
+		APIKeyID:     "KEYID",
+		APIDomain:    "mg.example.com",
+		APIRegion:    "eu-west-1",
+		APIEndpoint:  endpoint,
+	}
+	p, err := InitHTTPProvider(config)
+	if err != nil {
+		t.Fatalf("Error creating HTTP provider: %v", err)
+	}
+	return p
+}
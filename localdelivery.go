@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultSendmailPath is the usual location of the sendmail binary
+	defaultSendmailPath = "/usr/sbin/sendmail"
+	// sendmailTimeout is the maximal runtime of the sendmail binary
+	sendmailTimeout = time.Minute
+)
+
+// sendmailPermanentExitCodes are the exit codes of sysexits.h that a retry will not fix:
+// EX_USAGE, EX_DATAERR, EX_NOINPUT, EX_NOUSER and EX_NOHOST
+var sendmailPermanentExitCodes = map[int]bool{64: true, 65: true, 66: true, 67: true, 68: true}
+
+// mboxFromRe matches the lines of a message that have to be quoted in a mbox file (mboxrd)
+var mboxFromRe = regexp.MustCompile(`(?m)^(>*From )`)
+
+// Sendmail implements MailServerInterface, it pipes the mails to a local sendmail binary
+type Sendmail struct {
+	composer *Composer
+	path     string
+}
+
+// InitSendmail is the factory method to initialize a Sendmail
+func InitSendmail(config *ApplicationConfig) *Sendmail {
+	path := config.SendmailPath
+	if path == "" {
+		path = defaultSendmailPath
+	}
+	return &Sendmail{composer: InitComposer(config), path: path}
+}
+
+// Send pipes the message to sendmail. The envelope recipients are passed as arguments instead of -t,
+// so that they match the envelope exactly and do not depend on the headers of the message.
+func (s *Sendmail) Send(mail *EmailMessage) error {
+	envelope, err := s.composer.Compose(mail)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"-i", "-f", envelope.From, "--"}, envelope.To...)
+	cmd := exec.Command(s.path, args...)
+	cmd.Stdin = bytes.NewReader(envelope.Data)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(sendmailTimeout, func() { cmd.Process.Kill() })
+	err = cmd.Wait()
+	timer.Stop()
+	if err != nil {
+		var exitErr *exec.ExitError
+		permanent := errors.As(err, &exitErr) && sendmailPermanentExitCodes[exitErr.ExitCode()]
+		err = fmt.Errorf("%v failed: %v: %s", s.path, err, bytes.TrimSpace(output.Bytes()))
+		if permanent {
+			return &PermanentError{Err: err}
+		}
+		return err
+	}
+	log.Printf("Mail Sent: %v via %v\n", envelope.To, s.path)
+	return nil
+}
+
+// Queued implements MailServerInterface, the mails are delivered right away
+func (s *Sendmail) Queued() bool {
+	return false
+}
+
+// Maildir implements MailServerInterface, it writes every mail as a file into the new directory of a Maildir
+type Maildir struct {
+	composer *Composer
+	dir      string
+	hostname string
+	counter  uint64
+}
+
+// InitMaildir is the factory method to initialize a Maildir, the directories are created if they do not exist
+func InitMaildir(config *ApplicationConfig) (*Maildir, error) {
+	if config.MaildirPath == "" {
+		return nil, errors.New("transport maildir needs a maildirPath")
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(config.MaildirPath, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &Maildir{composer: InitComposer(config), dir: config.MaildirPath, hostname: hostname}, nil
+}
+
+// Send writes the message into tmp and moves it to new once it is complete, so that readers never see partial files
+func (m *Maildir) Send(mail *EmailMessage) error {
+	envelope, err := m.composer.Compose(mail)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&m.counter, 1), m.hostname)
+	tmp := filepath.Join(m.dir, "tmp", name)
+	if err := writeFileSync(tmp, localMessage(envelope)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(m.dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Printf("Mail Sent: %v to %v\n", envelope.To, m.dir)
+	return nil
+}
+
+// Queued implements MailServerInterface, the mails are delivered right away
+func (m *Maildir) Queued() bool {
+	return false
+}
+
+// Mbox implements MailServerInterface, it appends every mail to a mbox file
+type Mbox struct {
+	composer *Composer
+	path     string
+	sync.Mutex
+}
+
+// InitMbox is the factory method to initialize a Mbox
+func InitMbox(config *ApplicationConfig) (*Mbox, error) {
+	if config.MboxPath == "" {
+		return nil, errors.New("transport mbox needs a mboxPath")
+	}
+	return &Mbox{composer: InitComposer(config), path: config.MboxPath}, nil
+}
+
+// Send appends the message with a From_ line, lines starting with From are quoted with > (mboxrd).
+// The file is not locked against other processes, the whole message is appended with a single write.
+func (m *Mbox) Send(mail *EmailMessage) error {
+	envelope, err := m.composer.Compose(mail)
+	if err != nil {
+		return err
+	}
+	var entry bytes.Buffer
+	fmt.Fprintf(&entry, "From %s %s\n", envelope.From, time.Now().UTC().Format(time.ANSIC))
+	entry.Write(mboxFromRe.ReplaceAll(localMessage(envelope), []byte(">$1")))
+	entry.WriteString("\n")
+
+	m.Lock()
+	defer m.Unlock()
+	file, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(entry.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	log.Printf("Mail Sent: %v to %v\n", envelope.To, m.path)
+	return nil
+}
+
+// Queued implements MailServerInterface, the mails are delivered right away
+func (m *Mbox) Queued() bool {
+	return false
+}
+
+// localMessage returns the message with Return-Path and Delivered-To headers and local line endings
+func localMessage(envelope *Envelope) []byte {
+	var message bytes.Buffer
+	message.WriteString("Return-Path: <" + envelope.From + ">\n")
+	for _, to := range envelope.To {
+		message.WriteString("Delivered-To: " + to + "\n")
+	}
+	message.Write(bytes.Replace(envelope.Data, []byte("\r\n"), []byte("\n"), -1))
+	if !bytes.HasSuffix(message.Bytes(), []byte("\n")) {
+		message.WriteString("\n")
+	}
+	return message.Bytes()
+}
+
+// writeFileSync writes a new file and syncs it to disk
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
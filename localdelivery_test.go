@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSendmail_Send(t *testing.T) {
+	t.Parallel()
+	dir := tempDeliveryDir(t)
+	defer os.RemoveAll(dir)
+	sendmail := writeSendmail(t, dir, 0)
+
+	s := InitSendmail(newTestLocalConfig(sendmail))
+	if err := s.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error piping mail to sendmail: %v", err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if strings.TrimSpace(string(args)) != "-i -f noreply@example.com -- to@example.com" {
+		t.Errorf("Wrong sendmail arguments: %s", args)
+	}
+	message, _ := ioutil.ReadFile(filepath.Join(dir, "message"))
+	if !bytes.Contains(message, []byte("Subject: SUBJECT\r\n")) {
+		t.Errorf("Message was not piped to sendmail: %s", message)
+	}
+}
+
+func TestSendmail_ExitCodes(t *testing.T) {
+	t.Parallel()
+	codes := map[int]bool{75: false, 67: true, 1: false}
+	for code, permanent := range codes {
+		dir := tempDeliveryDir(t)
+		s := InitSendmail(newTestLocalConfig(writeSendmail(t, dir, code)))
+		err := s.Send(newTestMessage())
+		os.RemoveAll(dir)
+		if err == nil {
+			t.Errorf("Exit code %d: expected an error", code)
+			continue
+		}
+		if isPermanentError(err) != permanent {
+			t.Errorf("Exit code %d: permanent error is %v but should be %v", code, isPermanentError(err), permanent)
+		}
+	}
+	s := InitSendmail(&ApplicationConfig{RecipientMap: map[string]string{"id1": "to@example.com"}, SendmailPath: "/nonexistent/sendmail"})
+	if err := s.Send(newTestMessage()); err == nil {
+		t.Errorf("Error: missing sendmail binary did not fail")
+	}
+}
+
+func TestMaildir_Send(t *testing.T) {
+	t.Parallel()
+	dir := tempDeliveryDir(t)
+	defer os.RemoveAll(dir)
+	config := newTestLocalConfig("")
+	config.MaildirPath = filepath.Join(dir, "Maildir")
+
+	m, err := InitMaildir(config)
+	if err != nil {
+		t.Fatalf("Error creating Maildir: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Send(newTestMessage()); err != nil {
+			t.Fatalf("Error writing mail to Maildir: %v", err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(config.MaildirPath, "new", "*"))
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 mails in new, got %d", len(files))
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(config.MaildirPath, "tmp", "*")); len(tmp) != 0 {
+		t.Errorf("Expected no leftovers in tmp, got %v", tmp)
+	}
+	message, _ := ioutil.ReadFile(files[0])
+	if !bytes.HasPrefix(message, []byte("Return-Path: <noreply@example.com>\nDelivered-To: to@example.com\n")) || bytes.Contains(message, []byte("\r\n")) {
+		t.Errorf("Wrong Maildir message: %q", message)
+	}
+}
+
+func TestMbox_Send(t *testing.T) {
+	t.Parallel()
+	dir := tempDeliveryDir(t)
+	defer os.RemoveAll(dir)
+	config := newTestLocalConfig("")
+	config.MboxPath = filepath.Join(dir, "mbox")
+
+	m, err := InitMbox(config)
+	if err != nil {
+		t.Fatalf("Error creating mbox: %v", err)
+	}
+	msg := newTestMessage()
+	msg.body = "From here on\n>From there"
+	for i := 0; i < 2; i++ {
+		if err := m.Send(msg); err != nil {
+			t.Fatalf("Error appending mail to mbox: %v", err)
+		}
+	}
+	content, _ := ioutil.ReadFile(config.MboxPath)
+	var separators int
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "From ") {
+			separators++
+			if !strings.HasPrefix(line, "From noreply@example.com ") {
+				t.Errorf("Wrong From_ line: %v", line)
+			}
+		}
+	}
+	if separators != 2 {
+		t.Errorf("Expected 2 messages in mbox, got %d", separators)
+	}
+	if !strings.Contains(string(content), "\n>From here on\n>>From there\n") {
+		t.Errorf("From lines of the body were not quoted: %q", content)
+	}
+}
+
+// HELPER METHODS
+func tempDeliveryDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mailbridge-delivery")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	return dir
+}
+
+// writeSendmail writes a fake sendmail that stores its arguments and input in dir and exits with the given code
+func writeSendmail(t *testing.T, dir string, code int) string {
+	path := filepath.Join(dir, "sendmail")
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat > " + filepath.Join(dir, "message") +
+		"\necho 'sendmail says no' >&2\nexit " + strconv.Itoa(code) + "\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatalf("Error writing fake sendmail: %v", err)
+	}
+	return path
+}
+
+func newTestLocalConfig(sendmail string) *ApplicationConfig {
+	return &ApplicationConfig{
+		Sender:       "noreply@example.com",
+		RecipientMap: map[string]string{"id1": "to@example.com"},
+		SendmailPath: sendmail,
+	}
+}
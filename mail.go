@@ -2,9 +2,13 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/smtp"
+	"net/textproto"
+	"sync"
 	"time"
 )
 
@@ -14,82 +18,229 @@ type EmailMessage struct {
 	subject     string
 	body        string
 	recipientID string
+	fields      map[string]string
+	attachments []*Attachment
+	ticket      string
+	autoReply   bool
+	confirmLink string
+	// completed are the recipient domains that an earlier attempt of the MX delivery has finished
+	completed []string
+	// spamTag is put in front of the subject for the recipient, the submitter never sees it
+	spamTag string
+	// envelope is the rendered message that the spam scanner has checked, it is delivered as it is
+	envelope *Envelope
+}
+
+// emailMessageJSON is the serialized representation of an EmailMessage, e.g. in the mail queue
+type emailMessageJSON struct {
+	From        string            `json:"from"`
+	Subject     string            `json:"subject"`
+	Body        string            `json:"body"`
+	RecipientID string            `json:"recipientId"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	Attachments []*Attachment     `json:"attachments,omitempty"`
+	Ticket      string            `json:"ticket,omitempty"`
+	AutoReply   bool              `json:"autoReply,omitempty"`
+	ConfirmLink string            `json:"confirmLink,omitempty"`
+	Completed   []string          `json:"completed,omitempty"`
+	SpamTag     string            `json:"spamTag,omitempty"`
+	Envelope    *Envelope         `json:"envelope,omitempty"`
+}
+
+// MarshalJSON serializes the message, the fields of EmailMessage are not exported
+func (mail *EmailMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&emailMessageJSON{
+		From:        mail.from,
+		Subject:     mail.subject,
+		Body:        mail.body,
+		RecipientID: mail.recipientID,
+		Fields:      mail.fields,
+		Attachments: mail.attachments,
+		Ticket:      mail.ticket,
+		AutoReply:   mail.autoReply,
+		ConfirmLink: mail.confirmLink,
+		Completed:   mail.completed,
+		SpamTag:     mail.spamTag,
+		Envelope:    mail.envelope,
+	})
+}
+
+// UnmarshalJSON restores a message that has been serialized with MarshalJSON
+func (mail *EmailMessage) UnmarshalJSON(data []byte) error {
+	var m emailMessageJSON
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	mail.from = m.From
+	mail.subject = m.Subject
+	mail.body = m.Body
+	mail.recipientID = m.RecipientID
+	mail.fields = m.Fields
+	mail.attachments = m.Attachments
+	mail.ticket = m.Ticket
+	mail.autoReply = m.AutoReply
+	mail.confirmLink = m.ConfirmLink
+	mail.completed = m.Completed
+	mail.spamTag = m.SpamTag
+	mail.envelope = m.Envelope
+	return nil
+}
+
+// recipientSubject returns the subject for the recipient, tagged if the spam checks rated the message as spam.
+// Auto replies and confirmation mails to the submitter use the subject without the tag.
+func (mail *EmailMessage) recipientSubject() string {
+	return mail.spamTag + mail.subject
+}
+
+// PermanentError is a delivery error that a retry will not fix, e.g. a rejected recipient
+type PermanentError struct {
+	Err error
+}
+
+// Error implements error
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// isPermanentError returns true for a PermanentError or if a SMTP server rejected the mail with a 5xx code
+func isPermanentError(err error) bool {
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return true
+	}
+	var protocolErr *textproto.Error
+	return errors.As(err, &protocolErr) && protocolErr.Code >= 500
 }
 
 // MailServerInterface is the object for all sending things
 type MailServerInterface interface {
 	Send(*EmailMessage) error
+	// Queued returns true if Send only accepts the mails, they are delivered later
+	Queued() bool
 }
 
 // MailServer implements MailServerInterface
 type MailServer struct {
-	host         string
-	port         string
-	authUser     string
-	authPassword string
-	recipientMap map[string]string
+	host          string
+	port          string
+	authUser      string
+	authPassword  string
+	authMechanism string
+	authTokenFile string
+	tlsMode       string
+	tlsConfig     *tls.Config
+	composer      *Composer
+	slots         chan struct{}
+	timeout       time.Duration
+	// acquireTimeout is the maximal wait for a free connection slot, the HTTP request may be waiting for it
+	acquireTimeout time.Duration
+	idleTimeout    time.Duration
+	idle           []*smtpConnection
+	sync.Mutex
 }
 
 // InitMailServer is the factory method to initialize a MailServer
-func InitMailServer(config *ApplicationConfig) *MailServer {
-	return &MailServer{
-		host:         config.SMTPHost,
-		port:         config.SMTPPort,
-		authUser:     config.SMTPAuthUser,
-		authPassword: config.SMTPAuthPassword,
-		recipientMap: config.RecipientMap,
+func InitMailServer(config *ApplicationConfig) (*MailServer, error) {
+	server, err := newMailServer(&config.SMTPConfig, InitComposer(config))
+	if err != nil {
+		return nil, err
 	}
+	if server.idleTimeout > 0 {
+		server.SetupTicker()
+	}
+	return server, nil
+}
 
+// newMailServer creates a MailServer for the given SMTP settings
+func newMailServer(config *SMTPConfig, composer *Composer) (*MailServer, error) {
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	server := &MailServer{
+		host:          config.SMTPHost,
+		port:          config.SMTPPort,
+		authUser:      config.SMTPAuthUser,
+		authPassword:  config.SMTPAuthPassword,
+		authMechanism: config.authMechanism(),
+		authTokenFile: config.SMTPAuthTokenFile,
+		tlsMode:       config.tlsMode(),
+		tlsConfig:     tlsConfig,
+		composer:      composer,
+		timeout:       smtpTimeout,
+		idleTimeout:   time.Duration(config.SMTPIdleTimeout) * time.Second,
+	}
+	if config.SMTPMaxConnections > 0 {
+		server.slots = make(chan struct{}, config.SMTPMaxConnections)
+		server.acquireTimeout = time.Duration(config.SMTPAcquireTimeout) * time.Second
+		if server.acquireTimeout <= 0 {
+			server.acquireTimeout = defaultSMTPAcquireTimeout * time.Second
+		}
+	}
+	return server, nil
 }
 
 // Send does the actual sending of the mail
 func (server *MailServer) Send(mail *EmailMessage) error {
-	// check that we are allowed to send email to this recipient
-	// and we know who that is
-	to, ok := server.recipientMap[mail.recipientID]
-	if !ok {
-		return fmt.Errorf("No email for id %v", mail.recipientID)
+	// look up the recipient and construct the data block, this also validates all header values
+	envelope, err := server.composer.Compose(mail)
+	if err != nil {
+		return err
 	}
+	return server.deliver(envelope)
+}
 
-	// construct the data block
-	message := fmt.Sprintf("From: %s\r\n", mail.from)
-	message += fmt.Sprintf("To: %s\r\n", to)
-	message += fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z))
-	message += fmt.Sprintf("Subject: %s\r\n", mail.subject)
-	message += "\r\n" + mail.body
-
-	// setup Authentication and TLS Configuration
-	auth := smtp.PlainAuth("", server.authUser, server.authPassword, server.host)
+// Queued implements MailServerInterface, the mails are sent right away
+func (server *MailServer) Queued() bool {
+	return false
+}
 
-	// TLS config
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         server.host,
+// deliver sends a composed envelope over a pooled connection
+func (server *MailServer) deliver(envelope *Envelope) error {
+	// wait for a free connection slot if the number of connections is limited
+	if server.slots != nil {
+		timer := time.NewTimer(server.acquireTimeout)
+		select {
+		case server.slots <- struct{}{}:
+			timer.Stop()
+		case <-timer.C:
+			// a temporary error, the mail queue or the client retries the mail
+			return fmt.Errorf("no free connection to %v within %v", server.host, server.acquireTimeout)
+		}
+		defer func() { <-server.slots }()
 	}
 
-	// Connect to the remote SMTP server.
-	connStr := fmt.Sprintf("%s:%s", server.host, server.port)
-	client, err := smtp.Dial(connStr)
+	conn, err := server.acquire()
 	if err != nil {
-		log.Printf("Dial\n")
 		return err
 	}
-
-	client.StartTLS(tlsConfig)
-
-	// step 1: Use Auth
-	if err = client.Auth(auth); err != nil {
-		log.Printf("Auth")
+	if err := conn.send(envelope); err != nil {
+		// the state of the transaction is unknown, the connection cannot be reused
+		conn.client.Close()
 		return err
 	}
+	server.release(conn)
+	log.Printf("Mail Sent: %v\n", envelope.To)
+	return nil
+}
+
+// transfer sends one envelope over an established connection
+func transfer(client *smtp.Client, envelope *Envelope) error {
 	// Set the sender and recipient first
-	if err := client.Mail(mail.from); err != nil {
+	if err := client.Mail(envelope.From); err != nil {
 		log.Printf("Mail")
 		return err
 	}
-	if err := client.Rcpt(to); err != nil {
-		log.Printf("Rcpt")
-		return err
+	for _, to := range envelope.To {
+		if err := client.Rcpt(to); err != nil {
+			log.Printf("Rcpt")
+			return err
+		}
 	}
 
 	// Send the email body.
@@ -98,7 +249,7 @@ func (server *MailServer) Send(mail *EmailMessage) error {
 		log.Printf("Data")
 		return err
 	}
-	_, err = fmt.Fprintf(wc, message)
+	_, err = wc.Write(envelope.Data)
 	if err != nil {
 		log.Printf("print body")
 		return err
@@ -108,13 +259,5 @@ func (server *MailServer) Send(mail *EmailMessage) error {
 		log.Printf("close")
 		return err
 	}
-
-	// close the connection.
-	err = client.Quit()
-	if err != nil {
-		log.Printf("quit")
-		return err
-	}
-	log.Printf("Mail Sent: %v\n", to)
 	return nil
 }
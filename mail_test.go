@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+)
+
+func TestMail_IsPermanentError(t *testing.T) {
+	t.Parallel()
+	errs := map[error]bool{
+		&textproto.Error{Code: 550, Msg: "no such user"}:                                true,
+		&textproto.Error{Code: 451, Msg: "try again later"}:                             false,
+		fmt.Errorf("auth failed: %v", &textproto.Error{Code: 535, Msg: "bad auth"}):     false,
+		fmt.Errorf("wrapped: %w", &textproto.Error{Code: 554, Msg: "rejected as spam"}): true,
+		&PermanentError{Err: errors.New("invalid API key")}:                             true,
+		errors.New("connection refused"):                                                false,
+	}
+	for err, permanent := range errs {
+		if got := isPermanentError(err); got != permanent {
+			t.Errorf("isPermanentError(%v) is %v but should be %v", err, got, permanent)
+		}
+	}
+}
+
+// HELPER METHODS
+
+// sendTestMail sends a message through a MailServer with the given SMTP settings
+func sendTestMail(t *testing.T, config *SMTPConfig) error {
+	return newTestMailServer(t, config).Send(newTestMessage())
+}
+
+// newTestMailServer creates a MailServer that sends all mails for id1 to to@example.com
+func newTestMailServer(t *testing.T, config *SMTPConfig) *MailServer {
+	composer := &Composer{sender: "noreply@example.com", recipientMap: map[string]string{"id1": "to@example.com"}}
+	server, err := newMailServer(config, composer)
+	if err != nil {
+		t.Fatalf("Error creating mail server: %v", err)
+	}
+	return server
+}
+
+func newTestMessage() *EmailMessage {
+	return &EmailMessage{from: "from@example.com", recipientID: "id1", subject: "SUBJECT", body: "BODY"}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	netmail "net/mail"
 	"os"
 	"regexp"
 
@@ -18,29 +19,151 @@ const (
 	VERSION = "0.1.0"
 	// EmailRegexp is a regular expression to validate email addresses
 	EmailRegexp = `^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`
+	// TransportSMTP sends all mails through the configured SMTP server or relays
+	TransportSMTP = "smtp"
+	// TransportMX delivers the mails directly to the mail exchangers of the recipient domains
+	TransportMX = "mx"
+	// TransportSendGrid delivers through the v3 mail send API of SendGrid
+	TransportSendGrid = "sendgrid"
+	// TransportMailgun delivers raw MIME messages through the messages API of Mailgun
+	TransportMailgun = "mailgun"
+	// TransportSES delivers raw MIME messages through the v2 API of Amazon SES
+	TransportSES = "ses"
+	// TransportSendmail pipes the mails to a local sendmail binary
+	TransportSendmail = "sendmail"
+	// TransportMaildir writes the mails into a local Maildir
+	TransportMaildir = "maildir"
+	// TransportMbox appends the mails to a local mbox file
+	TransportMbox = "mbox"
 )
 
 // ApplicationConfig represents the configuration that is filled from the config file
 type ApplicationConfig struct {
-	Port             string            `json:"port"`
-	SMTPHost         string            `json:"smtpHost"`
-	SMTPPort         string            `json:"smtpPort"`
-	SMTPAuthUser     string            `json:"smtpAuthUser"`
-	SMTPAuthPassword string            `json:"smtpAuthPassword"`
-	RecipientMap     map[string]string `json:"recipients"`
-	Lifetime         int               `json:"lifetime"`
-	CleanupInterval  int               `json:"cleanupInterval"`
-	TarpitInterval   int               `json:"tarpitInterval"`
+	SMTPConfig
+	Port                  string                       `json:"port"`
+	Sender                string                       `json:"sender"`
+	RecipientMap          map[string]string            `json:"recipients"`
+	RecipientOptions      map[string]*RecipientOptions `json:"recipientOptions"`
+	Lifetime              int                          `json:"lifetime"`
+	CleanupInterval       int                          `json:"cleanupInterval"`
+	TarpitInterval        int                          `json:"tarpitInterval"`
+	UploadLimit           int64                        `json:"uploadLimit"`
+	TokenStore            string                       `json:"tokenStore"`
+	TokenFile             string                       `json:"tokenFile"`
+	TokenSecret           string                       `json:"tokenSecret"`
+	QueueDir              string                       `json:"queueDir"`
+	QueueWorkers          int                          `json:"queueWorkers"`
+	QueueRetryInterval    int                          `json:"queueRetryInterval"`
+	QueueMaxAge           int                          `json:"queueMaxAge"`
+	Transport             string                       `json:"transport"`
+	Relays                []*SMTPConfig                `json:"relays"`
+	RelayFailureThreshold int                          `json:"relayFailureThreshold"`
+	RelayCooldown         int                          `json:"relayCooldown"`
+	MXHelo                string                       `json:"mxHelo"`
+	MXPort                string                       `json:"mxPort"`
+	MXTLS                 string                       `json:"mxTLS"`
+	MXInsecureSkipVerify  bool                         `json:"mxInsecureSkipVerify"`
+	APIKey                string                       `json:"apiKey"`
+	APIKeyID              string                       `json:"apiKeyId"`
+	APIDomain             string                       `json:"apiDomain"`
+	APIRegion             string                       `json:"apiRegion"`
+	APIEndpoint           string                       `json:"apiEndpoint"`
+	SendmailPath          string                       `json:"sendmailPath"`
+	MaildirPath           string                       `json:"maildirPath"`
+	MboxPath              string                       `json:"mboxPath"`
+	AutoReplyPerAddress   int                          `json:"autoReplyPerAddress"`
+	AutoReplyTotal        int                          `json:"autoReplyTotal"`
+	AutoReplyInterval     int                          `json:"autoReplyInterval"`
+	ConfirmURL            string                       `json:"confirmURL"`
+	ConfirmLifetime       int                          `json:"confirmLifetime"`
+	ConfirmRedirect       string                       `json:"confirmRedirect"`
+	PowDifficulty         int                          `json:"powDifficulty"`
+	PowMaxDifficulty      int                          `json:"powMaxDifficulty"`
+	PowThreshold          int                          `json:"powThreshold"`
+	CaptchaProvider       string                       `json:"captchaProvider"`
+	CaptchaSecret         string                       `json:"captchaSecret"`
+	CaptchaVerifyURL      string                       `json:"captchaVerifyURL"`
+	CaptchaHostnames      []string                     `json:"captchaHostnames"`
+	CaptchaAction         string                       `json:"captchaAction"`
+	HoneypotField         string                       `json:"honeypotField"`
+	MinFillTime           int                          `json:"minFillTime"`
+	Spam                  *SpamConfig                  `json:"spam"`
+	QuarantineDir         string                       `json:"quarantineDir"`
+	QuarantineMaxAge      int                          `json:"quarantineMaxAge"`
+	SpamScanner           *SpamScannerConfig           `json:"spamScanner"`
 }
 
-// validateConfig validates the configuration, currently simply validates the email addresses
+// validateConfig validates the configuration: the SMTP settings, the sender, the email addresses and the options of the recipients
 func (c *ApplicationConfig) validateConfig() error {
+	switch c.Transport {
+	case "", TransportSMTP, TransportMX, TransportSendGrid, TransportMailgun, TransportSES, TransportSendmail, TransportMaildir, TransportMbox:
+	default:
+		return fmt.Errorf("config Error: unknown transport %q", c.Transport)
+	}
+	if err := c.SMTPConfig.validate(); err != nil {
+		return fmt.Errorf("config Error: %v", err)
+	}
+	for i, relay := range c.Relays {
+		if relay == nil || relay.SMTPHost == "" {
+			return fmt.Errorf("config Error: relay %d has no smtpHost", i)
+		}
+		if err := relay.validate(); err != nil {
+			return fmt.Errorf("config Error: relay %v: %v", relay.SMTPHost, err)
+		}
+	}
+	if c.Sender != "" {
+		if _, err := netmail.ParseAddress(c.Sender); err != nil {
+			return fmt.Errorf("config Error: invalid sender %q: %v", c.Sender, err)
+		}
+	}
+	if c.HoneypotField != "" && !fieldNameRe.MatchString(c.HoneypotField) {
+		return fmt.Errorf("config Error: invalid honeypotField %q", c.HoneypotField)
+	}
+	if c.MinFillTime < 0 || (c.MinFillTime > 0 && c.MinFillTime >= c.Lifetime) {
+		return fmt.Errorf("config Error: minFillTime %d must be less than the token lifetime", c.MinFillTime)
+	}
+	if c.Spam != nil {
+		if err := c.Spam.load(); err != nil {
+			return fmt.Errorf("config Error: spam: %v", err)
+		}
+		if c.Spam.QuarantineScore > 0 && c.QuarantineDir == "" {
+			return fmt.Errorf("config Error: spam: quarantineScore needs a quarantineDir")
+		}
+	}
+	if c.SpamScanner != nil {
+		if err := c.SpamScanner.load(); err != nil {
+			return fmt.Errorf("config Error: spamScanner: %v", err)
+		}
+		if c.SpamScanner.QuarantineScore > 0 && c.QuarantineDir == "" {
+			return fmt.Errorf("config Error: spamScanner: quarantineScore needs a quarantineDir")
+		}
+	}
 	Re := regexp.MustCompile(EmailRegexp)
 	for _, v := range c.RecipientMap {
 		if !Re.MatchString(v) {
 			return fmt.Errorf("config Error: not a email address: %v", v)
 		}
 	}
+	for id, options := range c.RecipientOptions {
+		if _, ok := c.RecipientMap[id]; !ok {
+			return fmt.Errorf("config Error: options for unknown recipient: %v", id)
+		}
+		if options == nil {
+			continue
+		}
+		if err := options.load(); err != nil {
+			return fmt.Errorf("config Error: recipient %v: %v", id, err)
+		}
+		if options.AutoReply != nil && options.AutoReply.Sender == "" && options.Sender == "" && c.Sender == "" {
+			return fmt.Errorf("config Error: recipient %v: auto reply needs a sender", id)
+		}
+		if options.Confirm != nil && options.Confirm.Sender == "" && options.Sender == "" && c.Sender == "" {
+			return fmt.Errorf("config Error: recipient %v: confirmation needs a sender", id)
+		}
+		if options.Confirm != nil && c.ConfirmURL == "" {
+			return fmt.Errorf("config Error: recipient %v: confirmation needs a confirmURL", id)
+		}
+	}
 	return nil
 }
 
@@ -83,6 +206,7 @@ func main() {
 
 	var configFile = flag.String("configFile", "config.json", "Configuration File")
 	var versionAndExit = flag.Bool("version", false, "print application version and exit")
+	var releaseID = flag.String("release", "", "send the quarantined message with this id through the transport and exit")
 	flag.Parse()
 
 	// print only version and exit
@@ -100,15 +224,80 @@ func main() {
 	router := httprouter.New()
 
 	// initialize mail server and map of active tokens
-	mailServer := InitMailServer(config)
-	activeTokens := InitActiveTokens(config)
+	var mailServer MailServerInterface
+	switch {
+	case config.Transport == TransportMX:
+		// deliver directly to the mail exchangers of the recipients
+		mailServer, err = InitMXDelivery(config)
+	case config.Transport == TransportSendGrid, config.Transport == TransportMailgun, config.Transport == TransportSES:
+		// deliver through the HTTP API of a mail provider
+		mailServer, err = InitHTTPProvider(config)
+	case config.Transport == TransportSendmail:
+		mailServer = InitSendmail(config)
+	case config.Transport == TransportMaildir:
+		mailServer, err = InitMaildir(config)
+	case config.Transport == TransportMbox:
+		mailServer, err = InitMbox(config)
+	case len(config.Relays) > 0:
+		// fail over between several relays instead of the single smtpHost
+		mailServer, err = InitRelays(config)
+	default:
+		mailServer, err = InitMailServer(config)
+	}
+	if err != nil {
+		log.Fatalf("Could not initialize mail server: %v", err)
+	}
+	var quarantine *Quarantine
+	if config.QuarantineDir != "" {
+		quarantine, err = InitQuarantine(config)
+		if err != nil {
+			log.Fatalf("Could not initialize quarantine: %v", err)
+		}
+	}
+	if *releaseID != "" {
+		// release a quarantined message right through the transport, without any further checks
+		if quarantine == nil {
+			log.Fatalf("Could not release message: no quarantineDir configured")
+		}
+		if err := quarantine.Release(*releaseID, mailServer); err != nil {
+			log.Fatalf("Could not release message %v: %v", *releaseID, err)
+		}
+		os.Exit(0)
+	}
+	if config.QueueDir != "" {
+		// deliver through the persistent queue instead of sending synchronously
+		queue, err := InitMailQueue(config, mailServer)
+		if err != nil {
+			log.Fatalf("Could not initialize mail queue: %v", err)
+		}
+		mailServer = queue
+	}
+	// auto replies are not sent to the sinks
+	replyServer := mailServer
+	if config.hasSinks() {
+		// notify the webhooks and chats of the recipients besides or instead of the mail
+		mailServer = InitDispatcher(config, mailServer)
+	}
+	if config.hasAutoReplies() {
+		// acknowledge the accepted messages to their submitters
+		mailServer = InitAutoResponder(config, mailServer, replyServer, InitReplyLimiter(config))
+	}
+	activeTokens, err := InitTokenStore(config)
+	if err != nil {
+		log.Fatalf("Could not initialize token store: %v", err)
+	}
 	tarpit := InitTarpit(config)
 
 	// initialize the Controller
-	c := InitController(mailServer, activeTokens, tarpit)
+	c, err := InitController(config, mailServer, replyServer, activeTokens, tarpit, quarantine)
+	if err != nil {
+		log.Fatalf("Could not initialize controller: %v", err)
+	}
 
 	// now set up the router
 	router.GET("/api/token", c.GetToken)
 	router.POST("/api/send", c.SendMail)
+	router.GET("/api/confirm/:id", c.ConfirmMail)
+	router.GET("/api/pow.js", c.ProofOfWorkScript)
 	log.Fatal(http.ListenAndServe(":"+config.Port, router))
 }
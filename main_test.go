@@ -12,6 +12,62 @@ func TestMain_ValidateApplicationConfig(t *testing.T) {
 	if err := config.validateConfig(); err != nil {
 		t.Errorf("Error in config validation but should not %v", err)
 	}
+	config.RecipientOptions = map[string]*RecipientOptions{"unknown": {}}
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error in config validation: options for unknown recipient should return error but do not")
+	}
+	config.RecipientOptions = map[string]*RecipientOptions{"test1": {}}
+	if err := config.validateConfig(); err != nil {
+		t.Errorf("Error in config validation but should not %v", err)
+	}
+	config.Sender = "Website <noreply@example.com>"
+	if err := config.validateConfig(); err != nil {
+		t.Errorf("Error in config validation but should not %v", err)
+	}
+	config.Sender = "Website"
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error in config validation: invalid sender should return error but does not")
+	}
+	config.Sender = ""
+	config.Relays = []*SMTPConfig{{SMTPHost: "mail1.example.com"}, {SMTPHost: "mail2.example.com", SMTPTLS: SMTPTLSImplicit}}
+	if err := config.validateConfig(); err != nil {
+		t.Errorf("Error in config validation but should not %v", err)
+	}
+	config.Relays = append(config.Relays, &SMTPConfig{SMTPPort: "25"})
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error in config validation: relay without host should return error but does not")
+	}
+	config.Relays = nil
+	config.RecipientOptions = map[string]*RecipientOptions{"test1": {AutoReply: &ReplyOptions{}}}
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error in config validation: auto reply without sender should return error but does not")
+	}
+	config.Sender = "noreply@example.com"
+	if err := config.validateConfig(); err != nil {
+		t.Errorf("Error in config validation but should not %v", err)
+	}
+	config.RecipientOptions = map[string]*RecipientOptions{"test1": {Confirm: &ReplyOptions{}}}
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error in config validation: confirmation without confirmURL should return error but does not")
+	}
+	config.ConfirmURL = "https://forms.example.com"
+	if err := config.validateConfig(); err != nil {
+		t.Errorf("Error in config validation but should not %v", err)
+	}
+	config.HoneypotField = "bad name"
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error in config validation: invalid honeypot field should return error but does not")
+	}
+	config.HoneypotField = "website"
+	config.Lifetime = 60
+	config.MinFillTime = 60
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error in config validation: minFillTime beyond the lifetime should return error but does not")
+	}
+	config.MinFillTime = 3
+	if err := config.validateConfig(); err != nil {
+		t.Errorf("Error in config validation but should not %v", err)
+	}
 	config.RecipientMap["wrong"] = "wrong_example.com"
 	if err := config.validateConfig(); err == nil {
 		t.Errorf("Error in config validation: should return error but does not")
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TemplateData is the data that is passed to the mail templates of a recipient
+type TemplateData struct {
+	From        string
+	Subject     string
+	Body        string
+	RecipientID string
+	Fields      []Field
+	Date        time.Time
+	Ticket      string
+	ConfirmLink string
+}
+
+// newTemplateData returns the data of the mail for the templates of a recipient
+func newTemplateData(mail *EmailMessage, options *RecipientOptions, now time.Time) *TemplateData {
+	return &TemplateData{
+		From:        mail.from,
+		Subject:     mail.subject,
+		Body:        mail.body,
+		RecipientID: mail.recipientID,
+		Fields:      options.orderedFields(mail.fields),
+		Date:        now,
+		Ticket:      mail.ticket,
+		ConfirmLink: mail.confirmLink,
+	}
+}
+
+// mimeEntity is a MIME body part with its content headers
+type mimeEntity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Envelope is a composed message together with the addresses of the SMTP envelope
+type Envelope struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// Composer turns an EmailMessage into an Envelope that can be handed over to a transport
+type Composer struct {
+	sender       string
+	recipientMap map[string]string
+	recipients   map[string]*RecipientOptions
+}
+
+// Compose looks up the recipient of the mail and renders the message.
+// The sender of the recipient takes precedence over the global sender.
+func (c *Composer) Compose(mail *EmailMessage) (*Envelope, error) {
+	if mail.autoReply {
+		return c.composeAutoReply(mail)
+	}
+	if mail.confirmLink != "" {
+		return c.composeConfirmation(mail)
+	}
+	// the message that the spam scanner checked is delivered without rendering it again
+	if mail.envelope != nil {
+		return mail.envelope, nil
+	}
+	// check that we are allowed to send email to this recipient
+	// and we know who that is
+	to, ok := c.recipientMap[mail.recipientID]
+	if !ok {
+		return nil, fmt.Errorf("No email for id %v", mail.recipientID)
+	}
+	options := c.recipients[mail.recipientID]
+	sender := c.sender
+	if options != nil && options.Sender != "" {
+		sender = options.Sender
+	}
+
+	recipients := options.route(mail, to)
+	data, err := composeMessage(mail, sender, recipients, options)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := recipients.envelope()
+	if err != nil {
+		return nil, err
+	}
+
+	// the envelope sender is the author of the message, see composeMessage
+	from := sender
+	if from == "" {
+		from = mail.from
+	}
+	address, err := netmail.ParseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{From: address.Address, To: addresses, Data: data}, nil
+}
+
+// InitComposer is the factory method to initialize a Composer
+func InitComposer(config *ApplicationConfig) *Composer {
+	return &Composer{
+		sender:       config.Sender,
+		recipientMap: config.RecipientMap,
+		recipients:   config.RecipientOptions,
+	}
+}
+
+// headerField is a single field of the message header
+type headerField struct {
+	name  string
+	value string
+}
+
+// messageHeader collects the header fields of a message. Values that would break out of
+// their header field are never written, the first of them is recorded as error instead.
+type messageHeader struct {
+	fields []headerField
+	err    error
+}
+
+// set adds a header field with a value that is written as it is
+func (h *messageHeader) set(name string, value string) {
+	if strings.ContainsAny(value, "\r\n") {
+		if h.err == nil {
+			h.err = fmt.Errorf("line break in header %v", name)
+		}
+		return
+	}
+	h.fields = append(h.fields, headerField{name: name, value: value})
+}
+
+// setText adds a header field with unstructured text, non-ASCII text is encoded as RFC 2047 encoded-words
+func (h *messageHeader) setText(name string, value string) {
+	if strings.ContainsAny(value, "\r\n") {
+		h.set(name, value)
+		return
+	}
+	h.set(name, mime.QEncoding.Encode("utf-8", value))
+}
+
+// setAddress adds a header field with an address, a non-ASCII display name is encoded
+func (h *messageHeader) setAddress(name string, address *netmail.Address) {
+	if strings.ContainsAny(address.Name+address.Address, "\r\n") {
+		h.set(name, address.Name+address.Address)
+		return
+	}
+	h.set(name, address.String())
+}
+
+// setAddressList adds a header field with a comma separated list of addresses
+func (h *messageHeader) setAddressList(name string, addresses []*netmail.Address) {
+	values := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if strings.ContainsAny(address.Name+address.Address, "\r\n") {
+			h.set(name, address.Name+address.Address)
+			return
+		}
+		values = append(values, address.String())
+	}
+	h.set(name, strings.Join(values, ", "))
+}
+
+// parseAddresses parses a list of recipient addresses
+func parseAddresses(list []string) ([]*netmail.Address, error) {
+	addresses := make([]*netmail.Address, 0, len(list))
+	for _, to := range list {
+		address, err := netmail.ParseAddress(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %v", to, err)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// writeTo writes the header fields, lines longer than 78 characters are folded at white space
+func (h *messageHeader) writeTo(buf *bytes.Buffer) {
+	for _, field := range h.fields {
+		line := field.name + ":"
+		for _, word := range strings.Split(field.value, " ") {
+			if len(line)+1+len(word) > 78 {
+				buf.WriteString(line + "\r\n")
+				line = ""
+			}
+			line += " " + word
+		}
+		buf.WriteString(line + "\r\n")
+	}
+}
+
+// composeMessage returns the complete message for the given mail and recipients, blind copies are left out of the header.
+// If the recipient has templates, the body is rendered with them, with both a text and a html template
+// the message is multipart/alternative. Without templates the body is sent as plain text,
+// followed by the custom fields. Attachments turn the message into multipart/mixed.
+// With a sender, the message is sent from this address and the submitter goes into Reply-To,
+// without a sender the submitter is the author of the message.
+// An error is returned if an address is not valid or a header value contains a line break.
+func composeMessage(mail *EmailMessage, sender string, recipients *Recipients, options *RecipientOptions) ([]byte, error) {
+	submitter, err := netmail.ParseAddress(mail.from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid submitter %q: %v", mail.from, err)
+	}
+	from := submitter
+	if sender != "" {
+		from, err = netmail.ParseAddress(sender)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sender %q: %v", sender, err)
+		}
+	}
+	to, err := parseAddresses(recipients.To)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := parseAddresses(recipients.CC)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := newMessageID(from.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entity, err := renderBody(mail, options, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(mail.attachments) > 0 {
+		entity, err = attachFiles(entity, mail.attachments)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header := &messageHeader{}
+	header.setAddress("From", from)
+	if from != submitter {
+		header.setAddress("Reply-To", submitter)
+	}
+	header.setAddressList("To", to)
+	if len(cc) > 0 {
+		header.setAddressList("Cc", cc)
+	}
+	header.set("Date", now.Format(time.RFC1123Z))
+	header.setText("Subject", mail.recipientSubject())
+	header.set("Message-ID", messageID)
+	if mail.ticket != "" {
+		header.set("X-Mailbridge-Ticket", mail.ticket)
+	}
+	header.set("MIME-Version", "1.0")
+	if header.err != nil {
+		return nil, header.err
+	}
+
+	var buf bytes.Buffer
+	header.writeTo(&buf)
+	entity.writeTo(&buf)
+	return buf.Bytes(), nil
+}
+
+// newMessageID returns a globally unique Message-ID in the domain of the given address
+func newMessageID(address string) (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		domain = address[at+1:]
+	}
+	return fmt.Sprintf("<%d.%X@%s>", time.Now().UnixNano(), buf, domain), nil
+}
+
+// renderBody returns the text of the mail, rendered by the templates of the recipient if there are any
+func renderBody(mail *EmailMessage, options *RecipientOptions, now time.Time) (*mimeEntity, error) {
+	data := newTemplateData(mail, options, now)
+	if !options.hasTemplates() {
+		var text bytes.Buffer
+		text.WriteString(mail.body)
+		if len(data.Fields) > 0 {
+			text.WriteString("\r\n")
+			for _, field := range data.Fields {
+				fmt.Fprintf(&text, "\r\n%s: %s", field.Label, field.Value)
+			}
+		}
+		return textEntity("text/plain; charset=utf-8", text.Bytes()), nil
+	}
+
+	var text, html bytes.Buffer
+	if options.textTemplate != nil {
+		if err := options.textTemplate.Execute(&text, data); err != nil {
+			return nil, fmt.Errorf("could not render text template: %v", err)
+		}
+	} else {
+		// html only, the plain text alternative is the submitted body
+		text.WriteString(mail.body)
+	}
+	if options.htmlTemplate == nil {
+		return textEntity("text/plain; charset=utf-8", text.Bytes()), nil
+	}
+	if err := options.htmlTemplate.Execute(&html, data); err != nil {
+		return nil, fmt.Errorf("could not render html template: %v", err)
+	}
+
+	// the preferred alternative comes last
+	return multipartEntity("alternative",
+		textEntity("text/plain; charset=utf-8", text.Bytes()),
+		textEntity("text/html; charset=utf-8", html.Bytes()))
+}
+
+// attachFiles returns a multipart/mixed entity with the given body first and the attachments after it
+func attachFiles(body *mimeEntity, attachments []*Attachment) (*mimeEntity, error) {
+	entities := []*mimeEntity{body}
+	for _, attachment := range attachments {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", attachment.ContentType)
+		header.Set("Content-Transfer-Encoding", "base64")
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		header.Set("Content-Disposition", disposition)
+		entities = append(entities, &mimeEntity{header: header, body: encodeBase64Lines(attachment.Data)})
+	}
+	return multipartEntity("mixed", entities...)
+}
+
+// textEntity returns a quoted-printable encoded text entity with the given content type
+func textEntity(contentType string, content []byte) *mimeEntity {
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	w.Write(content)
+	w.Close()
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &mimeEntity{header: header, body: body.Bytes()}
+}
+
+// multipartEntity returns a multipart entity of the given subtype that contains the given parts
+func multipartEntity(subtype string, parts ...*mimeEntity) (*mimeEntity, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, entity := range parts {
+		part, err := w.CreatePart(entity.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(entity.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": w.Boundary()}))
+	return &mimeEntity{header: header, body: body.Bytes()}, nil
+}
+
+// writeTo writes the headers of the entity in a stable order, followed by an empty line and the body
+func (entity *mimeEntity) writeTo(buf *bytes.Buffer) {
+	keys := make([]string, 0, len(entity.header))
+	for key := range entity.header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range entity.header[key] {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(entity.body)
+}
+
+// encodeBase64Lines encodes the data in base64 with lines of 76 characters
+func encodeBase64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	return buf.Bytes()
+}
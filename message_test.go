@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessage_ComposePlain(t *testing.T) {
+	t.Parallel()
+	msg := &EmailMessage{from: "from@example.com", recipientID: "id1", subject: "SUBJECT", body: "BODY"}
+	raw, err := composeMessage(msg, "", &Recipients{To: []string{"to@example.com"}}, nil)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing composed message: %v", err)
+	}
+	if subject := parsed.Header.Get("Subject"); subject != "SUBJECT" {
+		t.Errorf("Wrong subject: %v", subject)
+	}
+	if to, err := parsed.Header.AddressList("To"); err != nil || len(to) != 1 || to[0].Address != "to@example.com" {
+		t.Errorf("Wrong recipient: %v", parsed.Header.Get("To"))
+	}
+	if body := readBody(t, parsed); body != "BODY" {
+		t.Errorf("Wrong body: %v", string(body))
+	}
+}
+
+func TestMessage_ComposeHeaders(t *testing.T) {
+	t.Parallel()
+	subject := "Grüße aus Köln, " + strings.Repeat("eine sehr lange Betreffzeile ", 5)
+	msg := &EmailMessage{from: "Jürgen Müller <juergen@example.com>", recipientID: "id1", subject: subject, body: "Schöne Grüße"}
+	raw, err := composeMessage(msg, "", &Recipients{To: []string{"to@example.com"}}, nil)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Header line longer than 78 characters: %v", line)
+		}
+		if line == "" {
+			break
+		}
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing composed message: %v", err)
+	}
+	decoder := new(mime.WordDecoder)
+	if decoded, err := decoder.DecodeHeader(parsed.Header.Get("Subject")); err != nil || decoded != subject {
+		t.Errorf("Wrong subject: %q (%v)", decoded, err)
+	}
+	from, err := parsed.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Jürgen Müller" || from[0].Address != "juergen@example.com" {
+		t.Errorf("Wrong sender: %v (%v)", parsed.Header.Get("From"), err)
+	}
+	if id := parsed.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Wrong Message-ID: %v", id)
+	}
+	if version := parsed.Header.Get("MIME-Version"); version != "1.0" {
+		t.Errorf("Wrong MIME-Version: %v", version)
+	}
+	if cType := parsed.Header.Get("Content-Type"); cType != "text/plain; charset=utf-8" {
+		t.Errorf("Wrong content type: %v", cType)
+	}
+	if body := readBody(t, parsed); body != "Schöne Grüße" {
+		t.Errorf("Wrong body: %v", body)
+	}
+}
+
+func TestMessage_HeaderInjection(t *testing.T) {
+	t.Parallel()
+	messages := []*EmailMessage{
+		{from: "from@example.com", subject: "Hello\r\nBcc: victim@example.com", body: "BODY"},
+		{from: "from@example.com", subject: "Hello\nBcc: victim@example.com", body: "BODY"},
+		{from: "from@example.com\r\nBcc: victim@example.com", subject: "Hello", body: "BODY"},
+		{from: "\"Evil\r\nBcc: victim@example.com\" <from@example.com>", subject: "Hello", body: "BODY"},
+		{from: "not an address", subject: "Hello", body: "BODY"},
+	}
+	for _, msg := range messages {
+		if raw, err := composeMessage(msg, "", &Recipients{To: []string{"to@example.com"}}, nil); err == nil {
+			t.Errorf("Error: header injection was not rejected: %q", string(raw))
+		}
+	}
+
+	requests := []SendMailRequest{
+		{Token: "TOKEN", From: "from@example.com", To: "TO", Subject: "Hello\r\nBcc: victim@example.com", Body: "BODY"},
+		{Token: "TOKEN", From: "from@example.com\nBcc: victim@example.com", To: "TO", Subject: "Hello", Body: "BODY"},
+		{Token: "TOKEN", From: "FROM", To: "TO", Subject: "Hello", Body: "BODY"},
+	}
+	for _, request := range requests {
+		if err := request.Validate(); err == nil {
+			t.Errorf("Error: invalid request validated: %+v", request)
+		}
+	}
+}
+
+func TestMessage_ComposeSender(t *testing.T) {
+	t.Parallel()
+	composer := &Composer{
+		sender:       "Website <noreply@example.com>",
+		recipientMap: map[string]string{"id1": "support@example.com", "id2": "sales@example.com"},
+		recipients:   map[string]*RecipientOptions{"id2": {Sender: "sales-form@example.com"}},
+	}
+	msg := &EmailMessage{from: "Jane Doe <jane@example.org>", recipientID: "id1", subject: "SUBJECT", body: "BODY"}
+	envelope, err := composer.Compose(msg)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	if envelope.From != "noreply@example.com" || len(envelope.To) != 1 || envelope.To[0] != "support@example.com" {
+		t.Errorf("Wrong envelope: %v -> %v", envelope.From, envelope.To)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(envelope.Data))
+	if err != nil {
+		t.Fatalf("Error parsing composed message: %v", err)
+	}
+	if from, err := parsed.Header.AddressList("From"); err != nil || from[0].String() != "\"Website\" <noreply@example.com>" {
+		t.Errorf("Wrong From header: %v", parsed.Header.Get("From"))
+	}
+	if replyTo, err := parsed.Header.AddressList("Reply-To"); err != nil || replyTo[0].Name != "Jane Doe" || replyTo[0].Address != "jane@example.org" {
+		t.Errorf("Wrong Reply-To header: %v", parsed.Header.Get("Reply-To"))
+	}
+	if id := parsed.Header.Get("Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Message-ID not in sender domain: %v", id)
+	}
+
+	// the sender of the recipient overrides the global one
+	msg.recipientID = "id2"
+	envelope, err = composer.Compose(msg)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	if envelope.From != "sales-form@example.com" {
+		t.Errorf("Wrong envelope sender: %v", envelope.From)
+	}
+
+	// without any sender, the submitter is the author
+	composer.sender = ""
+	msg.recipientID = "id1"
+	envelope, err = composer.Compose(msg)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	parsed, _ = mail.ReadMessage(bytes.NewReader(envelope.Data))
+	if envelope.From != "jane@example.org" || parsed.Header.Get("Reply-To") != "" {
+		t.Errorf("Wrong envelope sender %v or Reply-To %v", envelope.From, parsed.Header.Get("Reply-To"))
+	}
+
+	// unknown recipients are rejected
+	msg.recipientID = "unknown"
+	if _, err := composer.Compose(msg); err == nil {
+		t.Errorf("Error: unknown recipient composed")
+	}
+}
+
+func TestMessage_ComposeFields(t *testing.T) {
+	t.Parallel()
+	msg := &EmailMessage{
+		from: "from@example.com", recipientID: "id1", subject: "SUBJECT", body: "BODY",
+		fields: map[string]string{"phone": "0123", "company": "ACME"},
+	}
+	raw, err := composeMessage(msg, "", &Recipients{To: []string{"to@example.com"}}, nil)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing composed message: %v", err)
+	}
+	if body := readBody(t, parsed); body != "BODY\r\n\r\ncompany: ACME\r\nphone: 0123" {
+		t.Errorf("Wrong body: %q", body)
+	}
+}
+
+func TestMessage_ComposeTemplates(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-templates")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &RecipientOptions{
+		TextTemplate: writeTemplate(t, dir, "mail.txt", "Message from {{.From}}:\n{{.Body}}{{range .Fields}}\n{{.Label}}: {{.Value}}{{end}}"),
+		HTMLTemplate: writeTemplate(t, dir, "mail.html", "<p>Message from {{.From}}:</p><p>{{.Body}}</p>"),
+	}
+	if err := options.load(); err != nil {
+		t.Fatalf("Error loading templates: %v", err)
+	}
+
+	msg := &EmailMessage{
+		from: "from@example.com", recipientID: "id1", subject: "SUBJECT", body: "<script>alert(1)</script>",
+		fields: map[string]string{"phone": "0123"},
+	}
+	raw, err := composeMessage(msg, "", &Recipients{To: []string{"to@example.com"}}, options)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	parts := readAlternatives(t, raw)
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 alternatives, got %d", len(parts))
+	}
+	if text := parts["text/plain"]; text != "Message from from@example.com:\r\n<script>alert(1)</script>\r\nphone: 0123" {
+		t.Errorf("Wrong text part: %v", text)
+	}
+	// the html template must escape the submitted body
+	if html := parts["text/html"]; html != "<p>Message from from@example.com:</p><p>&lt;script&gt;alert(1)&lt;/script&gt;</p>" {
+		t.Errorf("Wrong html part: %v", html)
+	}
+}
+
+func TestMessage_ComposeTextTemplateOnly(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-templates")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &RecipientOptions{TextTemplate: writeTemplate(t, dir, "mail.txt", "[{{.RecipientID}}] {{.Subject}}")}
+	if err := options.load(); err != nil {
+		t.Fatalf("Error loading templates: %v", err)
+	}
+	msg := &EmailMessage{from: "from@example.com", recipientID: "id1", subject: "SUBJECT", body: "BODY"}
+	raw, err := composeMessage(msg, "", &Recipients{To: []string{"to@example.com"}}, options)
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing composed message: %v", err)
+	}
+	if cType := parsed.Header.Get("Content-Type"); !strings.HasPrefix(cType, "text/plain") {
+		t.Errorf("Wrong content type: %v", cType)
+	}
+	if body := readBody(t, parsed); body != "[id1] SUBJECT" {
+		t.Errorf("Wrong body: %v", body)
+	}
+}
+
+func TestMessage_InvalidTemplate(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-templates")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := &RecipientOptions{HTMLTemplate: writeTemplate(t, dir, "mail.html", "{{.From")}
+	if err := options.load(); err == nil {
+		t.Errorf("Error: invalid template should not load")
+	}
+	options = &RecipientOptions{TextTemplate: filepath.Join(dir, "missing.txt")}
+	if err := options.load(); err == nil {
+		t.Errorf("Error: missing template should not load")
+	}
+}
+
+// HELPER METHODS
+func writeTemplate(t *testing.T, dir string, name string, content string) string {
+	fileName := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatalf("Error writing template: %v", err)
+	}
+	return fileName
+}
+
+// readBody returns the decoded body of a single part message
+func readBody(t *testing.T, parsed *mail.Message) string {
+	if encoding := parsed.Header.Get("Content-Transfer-Encoding"); encoding != "quoted-printable" {
+		t.Fatalf("Wrong transfer encoding: %v", encoding)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatalf("Error decoding body: %v", err)
+	}
+	return string(body)
+}
+
+// readAlternatives parses a multipart/alternative message and returns the parts by media type
+func readAlternatives(t *testing.T, raw []byte) map[string]string {
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing composed message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Wrong content type: %v (%v)", mediaType, err)
+	}
+	parts := make(map[string]string)
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		content, _ := ioutil.ReadAll(part)
+		parts[partType] = string(content)
+	}
+	return parts
+}
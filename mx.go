@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMXPort is the SMTP port of mail exchangers
+	defaultMXPort = "25"
+	// mxLookupTimeout is the maximal time for the DNS lookup of the MX records
+	mxLookupTimeout = 10 * time.Second
+)
+
+// MXResolver looks up the MX records and the addresses of a domain, it is implemented by *net.Resolver
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// MXDelivery implements MailServerInterface, it delivers the mails to the mail exchangers of the recipient domains without a smarthost
+type MXDelivery struct {
+	composer  *Composer
+	resolver  MXResolver
+	helo      string
+	port      string
+	tlsMode   string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+// InitMXDelivery is the factory method to initialize a MXDelivery with the resolver of the system
+func InitMXDelivery(config *ApplicationConfig) (*MXDelivery, error) {
+	return newMXDelivery(config, net.DefaultResolver)
+}
+
+// newMXDelivery creates a MXDelivery that looks up the MX records with the given resolver
+func newMXDelivery(config *ApplicationConfig, resolver MXResolver) (*MXDelivery, error) {
+	m := &MXDelivery{
+		composer: InitComposer(config),
+		resolver: resolver,
+		helo:     config.MXHelo,
+		port:     config.MXPort,
+		tlsMode:  config.MXTLS,
+		timeout:  smtpTimeout,
+		tlsConfig: &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: config.MXInsecureSkipVerify,
+		},
+	}
+	if m.helo == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		m.helo = hostname
+	}
+	if m.port == "" {
+		m.port = defaultMXPort
+	}
+	switch m.tlsMode {
+	case "":
+		m.tlsMode = SMTPTLSStartTLS
+	case SMTPTLSNone, SMTPTLSStartTLS, SMTPTLSRequireStartTLS:
+	default:
+		return nil, fmt.Errorf("unknown mxTLS mode %q", m.tlsMode)
+	}
+	return m, nil
+}
+
+// Send composes the mail and delivers it to every recipient domain. The domains that are done, because they
+// accepted the mail or rejected it permanently, are recorded in the message, so that a retry of the mail
+// queue only delivers to the remaining domains. The error is temporary as long as a domain is left.
+func (m *MXDelivery) Send(mail *EmailMessage) error {
+	envelope, err := m.composer.Compose(mail)
+	if err != nil {
+		return err
+	}
+
+	byDomain := make(map[string][]string)
+	var domains []string
+	for _, to := range envelope.To {
+		at := strings.LastIndex(to, "@")
+		if at < 0 {
+			return fmt.Errorf("recipient %v has no domain", to)
+		}
+		domain := strings.ToLower(to[at+1:])
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], to)
+	}
+	completed := make(map[string]bool)
+	for _, domain := range mail.completed {
+		completed[domain] = true
+	}
+	var temporaryErr, permanentErr error
+	for _, domain := range domains {
+		if completed[domain] {
+			continue
+		}
+		err := m.deliverDomain(domain, &Envelope{From: envelope.From, To: byDomain[domain], Data: envelope.Data})
+		switch {
+		case err == nil:
+		case isPermanentError(err):
+			log.Printf("ERROR: %v rejected the mail permanently: %v", domain, err)
+			permanentErr = err
+		default:
+			temporaryErr = err
+			continue
+		}
+		mail.completed = append(mail.completed, domain)
+	}
+	if temporaryErr != nil {
+		return temporaryErr
+	}
+	return permanentErr
+}
+
+// Queued implements MailServerInterface, the mails are sent right away
+func (m *MXDelivery) Queued() bool {
+	return false
+}
+
+// deliverDomain tries the mail exchangers of a domain in the order of their preference.
+// A permanent 5xx rejection ends the delivery, on other errors the next mail exchanger is tried.
+func (m *MXDelivery) deliverDomain(domain string, envelope *Envelope) error {
+	hosts, err := m.lookup(domain)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, host := range hosts {
+		err := m.deliverHost(host, envelope)
+		if err == nil {
+			log.Printf("Mail Sent: %v via %v\n", envelope.To, host)
+			return nil
+		}
+		if isPermanentError(err) {
+			return err
+		}
+		log.Printf("ERROR: mail exchanger %v of %v failed: %v", host, domain, err)
+		lastErr = err
+	}
+	return lastErr
+}
+
+// lookup returns the mail exchangers of a domain ordered by preference. Without MX records,
+// the domain itself is the mail exchanger (RFC 5321), a null MX (RFC 7505) rejects the mail permanently.
+func (m *MXDelivery) lookup(domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mxLookupTimeout)
+	defer cancel()
+	records, err := m.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, fmt.Errorf("MX lookup for %v failed: %v", domain, err)
+		}
+		records = nil
+	}
+	if len(records) == 0 {
+		// a domain that does not exist at all (NXDOMAIN) will not come into existence by retrying
+		if _, err := m.resolver.LookupHost(ctx, domain); err != nil {
+			if isNotFound(err) {
+				return nil, &PermanentError{Err: fmt.Errorf("domain %v does not exist", domain)}
+			}
+			return nil, fmt.Errorf("address lookup for %v failed: %v", domain, err)
+		}
+		return []string{domain}, nil
+	}
+	if len(records) == 1 && (records[0].Host == "." || records[0].Host == "") {
+		return nil, &textproto.Error{Code: 556, Msg: fmt.Sprintf("domain %v does not accept mail", domain)}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		hosts = append(hosts, strings.TrimSuffix(record.Host, "."))
+	}
+	return hosts, nil
+}
+
+// deliverHost sends the envelope to a single mail exchanger
+func (m *MXDelivery) deliverHost(host string, envelope *Envelope) error {
+	tlsConfig := m.tlsConfig.Clone()
+	tlsConfig.ServerName = host
+	if m.tlsMode == SMTPTLSStartTLS {
+		// opportunistic encryption is better than none, most mail exchangers have certificates that do
+		// not match their host name, and a failed verification would make the delivery fail
+		tlsConfig.InsecureSkipVerify = true
+	}
+	client, conn, err := dialSMTP(host, m.port, m.tlsMode, tlsConfig, m.helo, m.timeout)
+	if err != nil {
+		return fmt.Errorf("connect to %v failed: %v", host, err)
+	}
+	defer client.Close()
+
+	conn.SetDeadline(time.Now().Add(m.timeout))
+	if err := transfer(client, envelope); err != nil {
+		return err
+	}
+	// the mail has been accepted already, an error on QUIT does not matter
+	client.Quit()
+	return nil
+}
+
+// isNotFound returns true if a DNS lookup found no such domain or no records of the requested type
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMXDelivery_PreferenceOrder(t *testing.T) {
+	t.Parallel()
+	primary := &fakeSMTPServer{rcptReply: "451 greylisted"}
+	primary.start(t)
+	defer primary.close()
+	_, port, _ := net.SplitHostPort(primary.listener.Addr().String())
+	backup := &fakeSMTPServer{address: "127.0.0.2:" + port}
+	backup.start(t)
+	defer backup.close()
+
+	resolver := fakeResolver{"example.com": {{Host: "127.0.0.2.", Pref: 20}, {Host: "127.0.0.1.", Pref: 10}}}
+	m := newTestMXDelivery(t, resolver, port)
+	if err := m.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error delivering to MX: %v", err)
+	}
+	if primary.connectionCount() != 1 {
+		t.Errorf("The preferred mail exchanger was not tried first")
+	}
+	messages := backup.delivered()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message on the backup mail exchanger, got %d", len(messages))
+	}
+	if messages[0].helo != "mailbridge.example.com" || messages[0].to[0] != "TO:<to@example.com>" {
+		t.Errorf("Wrong delivery to mail exchanger: %+v", messages[0])
+	}
+}
+
+func TestMXDelivery_PermanentRejection(t *testing.T) {
+	t.Parallel()
+	primary := &fakeSMTPServer{rcptReply: "550 no such user"}
+	primary.start(t)
+	defer primary.close()
+	_, port, _ := net.SplitHostPort(primary.listener.Addr().String())
+	backup := &fakeSMTPServer{address: "127.0.0.2:" + port}
+	backup.start(t)
+	defer backup.close()
+
+	resolver := fakeResolver{"example.com": {{Host: "127.0.0.1.", Pref: 10}, {Host: "127.0.0.2.", Pref: 20}}}
+	m := newTestMXDelivery(t, resolver, port)
+	if err := m.Send(newTestMessage()); !isPermanentError(err) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+	if n := backup.connectionCount(); n != 0 {
+		t.Errorf("A permanently rejected message must not be sent to the next mail exchanger")
+	}
+}
+
+func TestMXDelivery_AllFailed(t *testing.T) {
+	t.Parallel()
+	down := &fakeSMTPServer{}
+	down.start(t)
+	down.close()
+	_, port, _ := net.SplitHostPort(down.listener.Addr().String())
+
+	m := newTestMXDelivery(t, fakeResolver{"example.com": {{Host: "127.0.0.1.", Pref: 10}}}, port)
+	err := m.Send(newTestMessage())
+	if err == nil || isPermanentError(err) {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+}
+
+func TestMXDelivery_StartTLS(t *testing.T) {
+	t.Parallel()
+	dir := tempCertDir(t)
+	defer os.RemoveAll(dir)
+	server := &fakeSMTPServer{certificate: newTestCertificate(t, dir, "server", x509.ExtKeyUsageServerAuth), startTLS: true}
+	server.start(t)
+	defer server.close()
+	_, port, _ := net.SplitHostPort(server.listener.Addr().String())
+
+	m := newTestMXDelivery(t, fakeResolver{"example.com": {{Host: "127.0.0.1.", Pref: 10}}}, port)
+	m.tlsMode = SMTPTLSRequireStartTLS
+	if err := m.Send(newTestMessage()); err == nil {
+		t.Errorf("Error: mail was sent to a mail exchanger with an untrusted certificate")
+	}
+	m.tlsConfig.InsecureSkipVerify = true
+	if err := m.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error delivering to MX with STARTTLS: %v", err)
+	}
+	if messages := server.delivered(); len(messages) != 1 || !messages[0].encrypted {
+		t.Errorf("Message was not delivered over TLS: %+v", messages)
+	}
+}
+
+func TestMXDelivery_OpportunisticStartTLS(t *testing.T) {
+	t.Parallel()
+	dir := tempCertDir(t)
+	defer os.RemoveAll(dir)
+	// the self signed certificate does not match the host name either
+	server := &fakeSMTPServer{certificate: newTestCertificate(t, dir, "server", x509.ExtKeyUsageServerAuth), startTLS: true}
+	server.start(t)
+	defer server.close()
+	_, port, _ := net.SplitHostPort(server.listener.Addr().String())
+
+	m := newTestMXDelivery(t, fakeResolver{"example.com": {{Host: "localhost.", Pref: 10}}}, port)
+	if err := m.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error delivering to MX with a self signed certificate: %v", err)
+	}
+	if messages := server.delivered(); len(messages) != 1 || !messages[0].encrypted {
+		t.Errorf("Message was not delivered over TLS: %+v", messages)
+	}
+	if m.tlsConfig.InsecureSkipVerify {
+		t.Errorf("Error: the shared TLS config must keep the verification for the required modes")
+	}
+}
+
+func TestMXDelivery_Lookup(t *testing.T) {
+	t.Parallel()
+	resolver := fakeResolver{
+		"example.com": {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}, {Host: "mx3.example.com.", Pref: 20}},
+		"nomx.com":    {},
+		"nullmx.com":  {{Host: ".", Pref: 0}},
+		"broken.com":  nil,
+	}
+	m := newTestMXDelivery(t, resolver, "25")
+
+	hosts, err := m.lookup("example.com")
+	if err != nil || !reflect.DeepEqual(hosts, []string{"mx1.example.com", "mx2.example.com", "mx3.example.com"}) {
+		t.Errorf("Wrong mail exchangers: %v (%v)", hosts, err)
+	}
+	// without MX records, the domain itself receives the mail
+	hosts, err = m.lookup("nomx.com")
+	if err != nil || !reflect.DeepEqual(hosts, []string{"nomx.com"}) {
+		t.Errorf("Wrong implicit mail exchanger: %v (%v)", hosts, err)
+	}
+	if _, err := m.lookup("nxdomain.com"); !isPermanentError(err) {
+		t.Errorf("Expected a permanent error for a domain that does not exist, got %v", err)
+	}
+	if _, err := m.lookup("nullmx.com"); !isPermanentError(err) {
+		t.Errorf("Expected a permanent error for a null MX, got %v", err)
+	}
+	if _, err := m.lookup("broken.com"); err == nil || isPermanentError(err) {
+		t.Errorf("Expected a temporary error for a failing lookup, got %v", err)
+	}
+}
+
+func TestMXDelivery_PartialDelivery(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{}
+	server.start(t)
+	defer server.close()
+	_, port, _ := net.SplitHostPort(server.listener.Addr().String())
+
+	m := newTestMXDelivery(t, fakeResolver{"example.com": {{Host: "127.0.0.1.", Pref: 10}}, "other.com": nil}, port)
+	m.composer.recipients = map[string]*RecipientOptions{"id1": {CC: []string{"cc@other.com"}}}
+	mail := newTestMessage()
+	if err := m.Send(mail); err == nil || isPermanentError(err) {
+		t.Fatalf("Expected a temporary error for the failing domain, got %v", err)
+	}
+	if !reflect.DeepEqual(mail.completed, []string{"example.com"}) {
+		t.Errorf("Wrong completed domains: %v", mail.completed)
+	}
+
+	// the retry only delivers to the domain that failed before
+	m.resolver = fakeResolver{"example.com": {{Host: "127.0.0.1.", Pref: 10}}, "other.com": {{Host: "127.0.0.1.", Pref: 10}}}
+	if err := m.Send(mail); err != nil {
+		t.Fatalf("Error delivering the retry: %v", err)
+	}
+	messages := server.delivered()
+	if len(messages) != 2 || !reflect.DeepEqual(messages[1].to, []string{"TO:<cc@other.com>"}) {
+		t.Errorf("Wrong deliveries: %+v", messages)
+	}
+}
+
+// HELPER METHODS
+
+// fakeResolver returns the MX records from the map, a nil entry is a failing DNS server
+type fakeResolver map[string][]*net.MX
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if records == nil {
+		return nil, errors.New("server misbehaving")
+	}
+	return records, nil
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	records, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if records == nil {
+		return nil, errors.New("server misbehaving")
+	}
+	return []string{"127.0.0.1"}, nil
+}
+
+func newTestMXDelivery(t *testing.T, resolver MXResolver, port string) *MXDelivery {
+	config := &ApplicationConfig{
+		Sender:       "noreply@example.com",
+		RecipientMap: map[string]string{"id1": "to@example.com"},
+		MXHelo:       "mailbridge.example.com",
+		MXPort:       port,
+		MXTLS:        SMTPTLSStartTLS,
+	}
+	m, err := newMXDelivery(config, resolver)
+	if err != nil {
+		t.Fatalf("Error creating MX delivery: %v", err)
+	}
+	return m
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed" // the reference solver is served from the binary
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPowDifficulty is the highest difficulty in bits, beyond that browsers would need minutes
+	maxPowDifficulty = 32
+	// defaultPowStep is the number of additional difficulty bits at most, above the configured difficulty
+	defaultPowStep = 8
+	// defaultPowThreshold is the number of challenges per minute before the difficulty increases
+	defaultPowThreshold = 60
+	// maxPowNonceLength is the maximal length of a solution
+	maxPowNonceLength = 64
+)
+
+// powScript is the reference solver for the challenges
+//
+//go:embed pow.js
+var powScript []byte
+
+// powBucket counts the challenges that have been issued within one second
+type powBucket struct {
+	second int64
+	count  int
+}
+
+// ProofOfWork issues hashcash style challenges for tokens and verifies their solutions. A solution is a nonce,
+// so that the SHA-256 hash of the challenge, a colon and the nonce starts with the number of zero bits of the challenge.
+// The challenge is signed and bound to its token, so nothing has to be stored. As tokens can be used only once,
+// a solution can be used only once as well.
+// The difficulty is increased by one bit every time the challenges of the last minute double beyond the threshold.
+type ProofOfWork struct {
+	secret    []byte
+	minBits   int
+	maxBits   int
+	threshold int
+	buckets   [60]powBucket
+	sync.Mutex
+}
+
+// InitProofOfWork is the factory method to initialize ProofOfWork. The challenges are signed with the token secret,
+// so that all instances accept them. Without a token secret, a random secret is used.
+func InitProofOfWork(config *ApplicationConfig) (*ProofOfWork, error) {
+	if config.PowDifficulty <= 0 || config.PowDifficulty > maxPowDifficulty {
+		return nil, fmt.Errorf("powDifficulty must be between 1 and %d", maxPowDifficulty)
+	}
+	maxBits := config.PowMaxDifficulty
+	if maxBits <= 0 {
+		maxBits = config.PowDifficulty + defaultPowStep
+	}
+	if maxBits > maxPowDifficulty {
+		maxBits = maxPowDifficulty
+	}
+	if maxBits < config.PowDifficulty {
+		return nil, errors.New("powMaxDifficulty must not be less than powDifficulty")
+	}
+	threshold := config.PowThreshold
+	if threshold <= 0 {
+		threshold = defaultPowThreshold
+	}
+	secret := []byte(config.TokenSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &ProofOfWork{secret: secret, minBits: config.PowDifficulty, maxBits: maxBits, threshold: threshold}, nil
+}
+
+// Challenge returns a new challenge for the token and its difficulty in bits
+func (p *ProofOfWork) Challenge(token string) (string, int) {
+	difficulty := p.record(time.Now())
+	prefix := strconv.Itoa(difficulty) + ":" + token
+	return fmt.Sprintf("%s:%X", prefix, p.sign(prefix)), difficulty
+}
+
+// Verify checks that the challenge has been issued for the token and that the nonce solves it
+func (p *ProofOfWork) Verify(token string, challenge string, nonce string) error {
+	if nonce == "" || len(nonce) > maxPowNonceLength {
+		return errors.New("missing or invalid proof of work")
+	}
+	at := strings.LastIndex(challenge, ":")
+	if at < 0 {
+		return errors.New("malformed challenge")
+	}
+	prefix, signature := challenge[:at], challenge[at+1:]
+	if !hmac.Equal([]byte(fmt.Sprintf("%X", p.sign(prefix))), []byte(signature)) {
+		return errors.New("invalid challenge signature")
+	}
+	parts := strings.SplitN(prefix, ":", 2)
+	difficulty, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 || parts[1] != token {
+		return errors.New("challenge does not belong to the token")
+	}
+	if powZeroBits(challenge, nonce) < difficulty {
+		return errors.New("proof of work does not solve the challenge")
+	}
+	return nil
+}
+
+// record counts a challenge and returns the difficulty for the number of challenges within the last minute
+func (p *ProofOfWork) record(now time.Time) int {
+	second := now.Unix()
+	p.Lock()
+	defer p.Unlock()
+	bucket := &p.buckets[second%int64(len(p.buckets))]
+	if bucket.second != second {
+		bucket.second = second
+		bucket.count = 0
+	}
+	bucket.count++
+
+	count := 0
+	for _, b := range p.buckets {
+		if second-b.second < int64(len(p.buckets)) {
+			count += b.count
+		}
+	}
+	difficulty := p.minBits
+	for n := p.threshold; count > n && difficulty < p.maxBits; n *= 2 {
+		difficulty++
+	}
+	return difficulty
+}
+
+// sign returns the HMAC of the difficulty and the token of a challenge. The secret may be the one of the
+// signed tokens, so the challenge is prefixed to keep the signatures apart.
+func (p *ProofOfWork) sign(prefix string) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte("pow:" + prefix))
+	return mac.Sum(nil)
+}
+
+// powZeroBits returns the number of leading zero bits of the hash of the challenge and the nonce
+func powZeroBits(challenge string, nonce string) int {
+	hash := sha256.Sum256([]byte(challenge + ":" + nonce))
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
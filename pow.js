@@ -0,0 +1,29 @@
+// Reference solver for the proof of work challenges of mailbridge.
+// mailbridgeSolve(challenge, difficulty) resolves to a nonce, so that the SHA-256 hash of
+// challenge + ":" + nonce starts with difficulty zero bits. Send the challenge and the nonce
+// with the token as Challenge and Nonce to /api/send.
+(function (global) {
+  "use strict";
+
+  function zeroBits(hash) {
+    var bytes = new Uint8Array(hash);
+    var zeros = 0;
+    for (var i = 0; i < bytes.length; i++) {
+      if (bytes[i] !== 0) {
+        return zeros + Math.clz32(bytes[i]) - 24;
+      }
+      zeros += 8;
+    }
+    return zeros;
+  }
+
+  global.mailbridgeSolve = async function (challenge, difficulty) {
+    var encoder = new TextEncoder();
+    for (var nonce = 0; ; nonce++) {
+      var hash = await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce));
+      if (zeroBits(hash) >= difficulty) {
+        return String(nonce);
+      }
+    }
+  };
+})(this);
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProofOfWork_Verify(t *testing.T) {
+	t.Parallel()
+	p := newTestProofOfWork(t, 8)
+	challenge, difficulty := p.Challenge("TOKEN")
+	if difficulty != 8 {
+		t.Errorf("Expected difficulty 8 without load, got %d", difficulty)
+	}
+	nonce := solveTestChallenge(challenge, difficulty)
+	if err := p.Verify("TOKEN", challenge, nonce); err != nil {
+		t.Fatalf("Error verifying a valid solution: %v", err)
+	}
+
+	invalid := map[string][3]string{
+		"missing nonce":  {"TOKEN", challenge, ""},
+		"other token":    {"OTHER", challenge, nonce},
+		"forged":         {"TOKEN", strings.Replace(challenge, "8:", "1:", 1), nonce},
+		"malformed":      {"TOKEN", "TOKEN", nonce},
+		"wrong solution": {"TOKEN", challenge, nonce + "x"},
+	}
+	for name, args := range invalid {
+		// a wrong nonce may solve the challenge by chance, skip that case
+		if name == "wrong solution" && powZeroBits(challenge, args[2]) >= difficulty {
+			continue
+		}
+		if err := p.Verify(args[0], args[1], args[2]); err == nil {
+			t.Errorf("%s: invalid proof of work was accepted", name)
+		}
+	}
+
+	// another instance with the same secret accepts the challenge
+	other := newTestProofOfWork(t, 8)
+	if err := other.Verify("TOKEN", challenge, nonce); err != nil {
+		t.Errorf("Error verifying the solution on another instance: %v", err)
+	}
+}
+
+func TestProofOfWork_AdaptiveDifficulty(t *testing.T) {
+	t.Parallel()
+	p := newTestProofOfWork(t, 8)
+	p.threshold = 10
+	p.maxBits = 11
+	now := time.Now()
+	expected := map[int]int{1: 8, 10: 8, 11: 9, 21: 10, 41: 11, 100: 11}
+	for i := 1; i <= 100; i++ {
+		difficulty := p.record(now)
+		if want, ok := expected[i]; ok && difficulty != want {
+			t.Errorf("Expected difficulty %d after %d challenges, got %d", want, i, difficulty)
+		}
+	}
+	// after a minute, the load is forgotten
+	if difficulty := p.record(now.Add(time.Minute)); difficulty != 8 {
+		t.Errorf("Expected difficulty 8 after a minute, got %d", difficulty)
+	}
+}
+
+func TestProofOfWork_InvalidConfig(t *testing.T) {
+	t.Parallel()
+	invalid := []*ApplicationConfig{
+		{PowDifficulty: 33},
+		{PowDifficulty: 10, PowMaxDifficulty: 9},
+	}
+	for _, config := range invalid {
+		if _, err := InitProofOfWork(config); err == nil {
+			t.Errorf("Error: invalid proof of work config %+v should return error", config)
+		}
+	}
+}
+
+func TestController_ProofOfWork(t *testing.T) {
+	t.Parallel()
+	ms := &MockMailServer{}
+	at := &MockActiveTokens{mockNew: func() (*Token, error) {
+		token := &Token{}
+		return token, token.Init(60)
+	}}
+	tp := &MockTarpit{}
+	c := newController(ms, at, tp)
+	c.pow = newTestProofOfWork(t, 4)
+
+	req, _ := http.NewRequest("GET", "/token", nil)
+	rr := doRequestController(req, c)
+	var response TokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error in un-marshalling token response: %v", err)
+	}
+	if response.Challenge == "" || response.Difficulty != 4 {
+		t.Fatalf("Expected a challenge in the token response, got %+v", response)
+	}
+	if tp.calledWait != 0 {
+		t.Errorf("The tarpit must not be used with proof of work")
+	}
+
+	send := func(nonce string) int {
+		msg := `{"Token": "` + response.Token + `","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY",
+			"Challenge": "` + response.Challenge + `", "Nonce": "` + nonce + `"}`
+		req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+		return doRequestController(req, c).Code
+	}
+	if status := send(""); status != http.StatusBadRequest {
+		t.Errorf("Wrong status without proof of work: %d, should be %d", status, http.StatusBadRequest)
+	}
+	if status := send(solveTestChallenge(response.Challenge, response.Difficulty)); status != http.StatusCreated {
+		t.Errorf("Wrong status with proof of work: %d, should be %d", status, http.StatusCreated)
+	}
+}
+
+func TestController_ProofOfWorkScript(t *testing.T) {
+	t.Parallel()
+	req, _ := http.NewRequest("GET", "/pow.js", nil)
+	rr := doRequestController(req, newController(&MockMailServer{}, &MockActiveTokens{}, &MockTarpit{}))
+	body, _ := ioutil.ReadAll(rr.Body)
+	if rr.Code != http.StatusOK || !strings.Contains(string(body), "mailbridgeSolve") {
+		t.Errorf("The solver script was not served: %d", rr.Code)
+	}
+}
+
+// HELPER METHODS
+func newTestProofOfWork(t *testing.T, difficulty int) *ProofOfWork {
+	p, err := InitProofOfWork(&ApplicationConfig{PowDifficulty: difficulty, TokenSecret: "0123456789abcdef"})
+	if err != nil {
+		t.Fatalf("Error creating proof of work: %v", err)
+	}
+	return p
+}
+
+func solveTestChallenge(challenge string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		if powZeroBits(challenge, strconv.Itoa(nonce)) >= difficulty {
+			return strconv.Itoa(nonce)
+		}
+	}
+}
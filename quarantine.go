@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	// defaultQuarantineMaxAge is the time in seconds that a quarantined message is kept, 30 days
+	defaultQuarantineMaxAge = 2592000
+	// quarantineCleanupInterval is the interval of the runs that delete the old quarantined messages
+	quarantineCleanupInterval = time.Hour
+)
+
+// quarantineIDRe matches the IDs of quarantined messages, they are the file names in the quarantine
+var quarantineIDRe = regexp.MustCompile(`^[0-9]+-[0-9A-F]+$`)
+
+// Quarantine stores suspicious messages in a directory instead of sending them. The files have the format
+// of the mail queue, so a message that turns out to be fine can be released by moving its file into the
+// active directory of the queue, or by sending it with Release. Messages older than maxAge are deleted.
+type Quarantine struct {
+	dir    string
+	maxAge time.Duration
+}
+
+// InitQuarantine is the factory method to initialize the Quarantine, the directory is created if it does not exist
+func InitQuarantine(config *ApplicationConfig) (*Quarantine, error) {
+	q, err := newQuarantine(config)
+	if err != nil {
+		return nil, err
+	}
+	q.SetupTicker()
+	return q, nil
+}
+
+// newQuarantine creates the Quarantine without starting the cleanup ticker
+func newQuarantine(config *ApplicationConfig) (*Quarantine, error) {
+	if err := os.MkdirAll(config.QuarantineDir, 0700); err != nil {
+		return nil, err
+	}
+	maxAge := config.QuarantineMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultQuarantineMaxAge
+	}
+	return &Quarantine{dir: config.QuarantineDir, maxAge: time.Duration(maxAge) * time.Second}, nil
+}
+
+// Store writes the message with the reason for its quarantine. The file is written under a temporary
+// name first and then renamed, so that a crash never leaves a half written message.
+func (q *Quarantine) Store(mail *EmailMessage, reason string) error {
+	id, err := newQueueID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	raw, err := json.Marshal(&QueuedMessage{
+		ID:          id,
+		Message:     mail,
+		Created:     now,
+		NextAttempt: now,
+		LastError:   reason,
+	})
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(q.dir, id+".json")
+	if err := ioutil.WriteFile(name+".tmp", raw, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	log.Printf("Message from %v quarantined as %v: %v", mail.from, id, reason)
+	return nil
+}
+
+// Release sends the quarantined message with the given ID through the mail server and deletes it from the quarantine
+func (q *Quarantine) Release(id string, mailServer MailServerInterface) error {
+	if !quarantineIDRe.MatchString(id) {
+		return fmt.Errorf("invalid quarantine id %q", id)
+	}
+	name := filepath.Join(q.dir, id+".json")
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var qm QueuedMessage
+	if err := json.Unmarshal(raw, &qm); err != nil {
+		return err
+	}
+	if err := mailServer.Send(qm.Message); err != nil {
+		return err
+	}
+	log.Printf("Quarantined message %v released", id)
+	return os.Remove(name)
+}
+
+// Clean deletes the quarantined messages that are older than maxAge, and the files that a crash left
+// half written, and returns how many were deleted
+func (q *Quarantine) Clean() int {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		log.Printf("ERROR reading quarantine: %v", err)
+		return 0
+	}
+	i := 0
+	for _, file := range files {
+		if file.IsDir() || time.Since(file.ModTime()) <= q.maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(q.dir, file.Name())); err != nil {
+			log.Printf("ERROR removing quarantined message %v: %v", file.Name(), err)
+			continue
+		}
+		i++
+	}
+	return i
+}
+
+// SetupTicker creates a ticker that calls Clean() in regular intervals
+func (q *Quarantine) SetupTicker() {
+	ticker := time.NewTicker(quarantineCleanupInterval)
+	go func() {
+		for t := range ticker.C {
+			deleted := q.Clean()
+			if deleted > 0 {
+				log.Printf("[%s] Cleaning up %d quarantined messages", t, deleted)
+			}
+		}
+	}()
+}
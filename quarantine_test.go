@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuarantine_Release(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-quarantine")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := newQuarantine(&ApplicationConfig{QuarantineDir: dir})
+	if err != nil {
+		t.Fatalf("Error initializing quarantine: %v", err)
+	}
+	if err := q.Store(newTestMessage(), "suspicious"); err != nil {
+		t.Fatalf("Error storing message: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 quarantined message, got %d", len(files))
+	}
+	id := strings.TrimSuffix(filepath.Base(files[0]), ".json")
+
+	if err := q.Release("../"+id, &FailingMailServer{}); err == nil {
+		t.Errorf("Error: a path outside the quarantine was released")
+	}
+	// a failed send keeps the message in the quarantine
+	if err := q.Release(id, &FailingMailServer{failures: -1}); err == nil {
+		t.Errorf("Error: release succeeded without sending")
+	}
+	ms := &FailingMailServer{}
+	if err := q.Release(id, ms); err != nil {
+		t.Fatalf("Error releasing message: %v", err)
+	}
+	if ms.sentCount() != 1 || ms.sent[0].body != "BODY" {
+		t.Errorf("The released message was not sent")
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("The released message must be removed from the quarantine")
+	}
+}
+
+func TestQuarantine_Clean(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-quarantine")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := newQuarantine(&ApplicationConfig{QuarantineDir: dir, QuarantineMaxAge: 60})
+	if err != nil {
+		t.Fatalf("Error initializing quarantine: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.Store(newTestMessage(), "suspicious"); err != nil {
+			t.Fatalf("Error storing message: %v", err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(files[0], old, old)
+
+	if n := q.Clean(); n != 1 {
+		t.Errorf("Expected 1 cleaned message, got %d", n)
+	}
+	if _, err := os.Stat(files[1]); err != nil {
+		t.Errorf("A recent message must be kept: %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// queueActiveDir is the sub directory of the spool that holds messages waiting for delivery
+	queueActiveDir = "active"
+	// queueDeadDir is the sub directory of the spool that holds messages that could not be delivered
+	queueDeadDir = "dead"
+	// queueTmpDir is the sub directory of the spool used to write messages atomically
+	queueTmpDir = "tmp"
+)
+
+// QueuedMessage is a message in the spool directory together with its delivery state
+type QueuedMessage struct {
+	ID          string        `json:"id"`
+	Message     *EmailMessage `json:"message"`
+	Created     time.Time     `json:"created"`
+	NextAttempt time.Time     `json:"nextAttempt"`
+	Attempts    int           `json:"attempts"`
+	LastError   string        `json:"lastError,omitempty"`
+}
+
+// MailQueue implements MailServerInterface. It writes every message to a spool directory and returns
+// immediately, a pool of workers then delivers the messages through the wrapped mail server.
+// Failed deliveries are retried with exponential backoff until the message is older than maxAge,
+// then it is moved to the dead letter directory.
+type MailQueue struct {
+	server        MailServerInterface
+	dir           string
+	workers       int
+	retryInterval time.Duration
+	maxAge        time.Duration
+	pending       chan string
+	inFlight      map[string]bool
+	sync.Mutex
+}
+
+// Send stores the message in the spool and schedules it for delivery
+func (q *MailQueue) Send(mail *EmailMessage) error {
+	id, err := newQueueID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	qm := &QueuedMessage{
+		ID:          id,
+		Message:     mail,
+		Created:     now,
+		NextAttempt: now,
+	}
+	if err := q.write(qm); err != nil {
+		return err
+	}
+	q.schedule(id)
+	return nil
+}
+
+// Queued implements MailServerInterface, the mails are only accepted and delivered later by the workers
+func (q *MailQueue) Queued() bool {
+	return true
+}
+
+// Flush schedules all messages in the spool whose next delivery attempt is due.
+// It returns the number of scheduled messages, this is called regularly by the ticker.
+func (q *MailQueue) Flush() int {
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, queueActiveDir))
+	if err != nil {
+		log.Printf("ERROR reading mail queue: %v", err)
+		return 0
+	}
+	i := 0
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		qm, err := q.read(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			log.Printf("ERROR reading queued message %s: %v", file.Name(), err)
+			continue
+		}
+		if time.Now().Before(qm.NextAttempt) {
+			continue
+		}
+		if q.schedule(qm.ID) {
+			i++
+		}
+	}
+	return i
+}
+
+// SetupTicker starts the delivery workers and a ticker that calls Flush() in regular intervals
+func (q *MailQueue) SetupTicker() {
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+	ticker := time.NewTicker(q.retryInterval)
+	go func() {
+		for t := range ticker.C {
+			scheduled := q.Flush()
+			if scheduled > 0 {
+				log.Printf("[%s] Retrying %d queued messages", t, scheduled)
+			}
+		}
+	}()
+}
+
+// schedule hands the message over to the workers unless it is already being processed.
+// If all workers are busy, the message stays in the spool and is picked up by the next Flush.
+func (q *MailQueue) schedule(id string) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.inFlight[id] {
+		return false
+	}
+	select {
+	case q.pending <- id:
+		q.inFlight[id] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// work is the loop of a single delivery worker
+func (q *MailQueue) work() {
+	for id := range q.pending {
+		q.deliver(id)
+		q.Lock()
+		delete(q.inFlight, id)
+		q.Unlock()
+	}
+}
+
+// deliver makes one delivery attempt for the queued message with the given id
+func (q *MailQueue) deliver(id string) {
+	qm, err := q.read(id)
+	if err != nil {
+		// the message may have been delivered by an earlier attempt already
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR reading queued message %s: %v", id, err)
+		}
+		return
+	}
+	if time.Now().Before(qm.NextAttempt) {
+		return
+	}
+
+	err = q.server.Send(qm.Message)
+	if err == nil {
+		if err := os.Remove(q.path(queueActiveDir, id)); err != nil {
+			log.Printf("ERROR removing delivered message %s: %v", id, err)
+		}
+		return
+	}
+
+	qm.Attempts++
+	qm.LastError = err.Error()
+	if isPermanentError(err) || time.Since(qm.Created) > q.maxAge {
+		// a permanent rejection is not retried
+		log.Printf("ERROR giving up on message %s after %d attempts: %v", id, qm.Attempts, err)
+		if err := q.bury(qm); err != nil {
+			log.Printf("ERROR moving message %s to dead letters: %v", id, err)
+		}
+		return
+	}
+	qm.NextAttempt = time.Now().Add(q.backoff(qm.Attempts))
+	log.Printf("Delivery of message %s failed (attempt %d), retry at %v: %v", id, qm.Attempts, qm.NextAttempt, err)
+	if err := q.write(qm); err != nil {
+		log.Printf("ERROR updating queued message %s: %v", id, err)
+	}
+}
+
+// backoff returns the time to wait after the given number of failed attempts,
+// it doubles with every attempt and never exceeds maxAge
+func (q *MailQueue) backoff(attempts int) time.Duration {
+	if attempts > 30 {
+		return q.maxAge
+	}
+	wait := q.retryInterval << uint(attempts-1)
+	if wait <= 0 || wait > q.maxAge {
+		return q.maxAge
+	}
+	return wait
+}
+
+// bury moves a queued message to the dead letter directory
+func (q *MailQueue) bury(qm *QueuedMessage) error {
+	if err := q.write(qm); err != nil {
+		return err
+	}
+	return os.Rename(q.path(queueActiveDir, qm.ID), q.path(queueDeadDir, qm.ID))
+}
+
+// write stores the queued message in the active directory. The file is written to the tmp
+// directory first and then renamed, so that a crash never leaves a half written message.
+func (q *MailQueue) write(qm *QueuedMessage) error {
+	raw, err := json.Marshal(qm)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(queueTmpDir, qm.ID)
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(queueActiveDir, qm.ID))
+}
+
+// sweep removes the files that a crash left in the tmp directory, they never made it into the spool
+func (q *MailQueue) sweep() int {
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, queueTmpDir))
+	if err != nil {
+		log.Printf("ERROR reading mail queue: %v", err)
+		return 0
+	}
+	i := 0
+	for _, file := range files {
+		if err := os.Remove(filepath.Join(q.dir, queueTmpDir, file.Name())); err != nil {
+			log.Printf("ERROR removing %s from mail queue: %v", file.Name(), err)
+			continue
+		}
+		i++
+	}
+	return i
+}
+
+// read loads the queued message with the given id from the active directory
+func (q *MailQueue) read(id string) (*QueuedMessage, error) {
+	raw, err := ioutil.ReadFile(q.path(queueActiveDir, id))
+	if err != nil {
+		return nil, err
+	}
+	var qm QueuedMessage
+	if err := json.Unmarshal(raw, &qm); err != nil {
+		return nil, err
+	}
+	return &qm, nil
+}
+
+// path returns the file name of a message in the given sub directory of the spool
+func (q *MailQueue) path(sub string, id string) string {
+	return filepath.Join(q.dir, sub, id+".json")
+}
+
+// newQueueID returns a unique, time ordered identifier for a queued message
+func newQueueID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%X", time.Now().UnixNano(), buf), nil
+}
+
+// newMailQueue creates the spool directories and returns a MailQueue without starting the workers
+func newMailQueue(server MailServerInterface, dir string, workers int, retryInterval, maxAge time.Duration) (*MailQueue, error) {
+	for _, sub := range []string{queueActiveDir, queueDeadDir, queueTmpDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &MailQueue{
+		server:        server,
+		dir:           dir,
+		workers:       workers,
+		retryInterval: retryInterval,
+		maxAge:        maxAge,
+		pending:       make(chan string, workers*16),
+		inFlight:      make(map[string]bool),
+	}, nil
+}
+
+// InitMailQueue is the factory method to initialize a MailQueue that delivers through the given server.
+// Messages left in the spool from an earlier run are picked up immediately, partially written ones are removed.
+func InitMailQueue(config *ApplicationConfig, server MailServerInterface) (*MailQueue, error) {
+	workers := config.QueueWorkers
+	if workers <= 0 {
+		workers = 2
+	}
+	retryInterval := config.QueueRetryInterval
+	if retryInterval <= 0 {
+		retryInterval = 30
+	}
+	maxAge := config.QueueMaxAge
+	if maxAge <= 0 {
+		maxAge = 86400
+	}
+	q, err := newMailQueue(server, config.QueueDir, workers,
+		time.Duration(retryInterval)*time.Second, time.Duration(maxAge)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if swept := q.sweep(); swept > 0 {
+		log.Printf("Removed %d partially written messages from the mail queue", swept)
+	}
+	q.SetupTicker()
+	q.Flush()
+	return q, nil
+}
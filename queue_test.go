@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mock mail server that fails a configurable number of times before it succeeds
+type FailingMailServer struct {
+	failures  int
+	permanent bool
+	calls     int
+	sent      []*EmailMessage
+	sync.Mutex
+}
+
+func (ms *FailingMailServer) Send(m *EmailMessage) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.calls++
+	if ms.failures < 0 || ms.calls <= ms.failures {
+		if ms.permanent {
+			return &PermanentError{Err: errors.New("recipient rejected")}
+		}
+		return errors.New("mail server unavailable")
+	}
+	ms.sent = append(ms.sent, m)
+	return nil
+}
+
+func (ms *FailingMailServer) Queued() bool {
+	return false
+}
+
+func (ms *FailingMailServer) sentCount() int {
+	ms.Lock()
+	defer ms.Unlock()
+	return len(ms.sent)
+}
+
+func TestMailQueue_SendDelivers(t *testing.T) {
+	t.Parallel()
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	ms := &FailingMailServer{}
+	q, err := newMailQueue(ms, dir, 1, 10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("Error creating mail queue: %v", err)
+	}
+	q.SetupTicker()
+
+	msg := &EmailMessage{from: "from@example.com", recipientID: "id1", subject: "SUBJECT", body: "BODY"}
+	if err := q.Send(msg); err != nil {
+		t.Fatalf("Error queueing message: %v", err)
+	}
+
+	waitFor(t, func() bool { return ms.sentCount() == 1 })
+	if ms.sent[0].subject != "SUBJECT" || ms.sent[0].recipientID != "id1" {
+		t.Errorf("Delivered message differs from queued message: %+v", ms.sent[0])
+	}
+	waitFor(t, func() bool { return countFiles(t, dir, queueActiveDir) == 0 })
+}
+
+func TestMailQueue_RetryWithBackoff(t *testing.T) {
+	t.Parallel()
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	ms := &FailingMailServer{failures: 2}
+	q, err := newMailQueue(ms, dir, 2, 10*time.Millisecond, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Error creating mail queue: %v", err)
+	}
+	q.SetupTicker()
+
+	if err := q.Send(&EmailMessage{recipientID: "id1"}); err != nil {
+		t.Fatalf("Error queueing message: %v", err)
+	}
+	waitFor(t, func() bool { return ms.sentCount() == 1 })
+	if ms.calls != 3 {
+		t.Errorf("Expected 3 delivery attempts, got %d", ms.calls)
+	}
+	waitFor(t, func() bool { return countFiles(t, dir, queueActiveDir) == 0 })
+	if n := countFiles(t, dir, queueDeadDir); n != 0 {
+		t.Errorf("Expected no dead letters, got %d", n)
+	}
+}
+
+func TestMailQueue_DeadLetter(t *testing.T) {
+	t.Parallel()
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	ms := &FailingMailServer{failures: -1}
+	q, err := newMailQueue(ms, dir, 1, 10*time.Millisecond, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error creating mail queue: %v", err)
+	}
+	q.SetupTicker()
+
+	if err := q.Send(&EmailMessage{recipientID: "id1"}); err != nil {
+		t.Fatalf("Error queueing message: %v", err)
+	}
+	waitFor(t, func() bool { return countFiles(t, dir, queueDeadDir) == 1 })
+	if n := countFiles(t, dir, queueActiveDir); n != 0 {
+		t.Errorf("Expected empty active queue, got %d", n)
+	}
+	if ms.sentCount() != 0 {
+		t.Errorf("Message should never have been delivered")
+	}
+}
+
+func TestMailQueue_PermanentError(t *testing.T) {
+	t.Parallel()
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	ms := &FailingMailServer{failures: -1, permanent: true}
+	q, err := newMailQueue(ms, dir, 1, 10*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating mail queue: %v", err)
+	}
+	q.SetupTicker()
+
+	if err := q.Send(&EmailMessage{recipientID: "id1"}); err != nil {
+		t.Fatalf("Error queueing message: %v", err)
+	}
+	// a permanent error is not retried until maxAge
+	waitFor(t, func() bool { return countFiles(t, dir, queueDeadDir) == 1 })
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.calls != 1 {
+		t.Errorf("Expected 1 delivery attempt, got %d", ms.calls)
+	}
+}
+
+func TestMailQueue_RecoverSpool(t *testing.T) {
+	t.Parallel()
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	// queue a message without workers, as if the application died before delivery
+	ms := &FailingMailServer{}
+	q, err := newMailQueue(ms, dir, 1, 10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("Error creating mail queue: %v", err)
+	}
+	// the checked message and the delivery state survive the restart
+	mail := &EmailMessage{recipientID: "id1", spamTag: "[SPAM] ", completed: []string{"example.com"}, envelope: &Envelope{From: "noreply@example.com", To: []string{"to@example.com"}, Data: []byte("DATA")}}
+	if err := q.Send(mail); err != nil {
+		t.Fatalf("Error queueing message: %v", err)
+	}
+	if n := countFiles(t, dir, queueActiveDir); n != 1 {
+		t.Fatalf("Expected 1 spooled message, got %d", n)
+	}
+
+	// a new queue on the same directory must deliver it
+	q2, err := newMailQueue(ms, dir, 1, 10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("Error creating mail queue: %v", err)
+	}
+	q2.SetupTicker()
+	waitFor(t, func() bool { return ms.sentCount() == 1 })
+	recovered := ms.sent[0]
+	if recovered.spamTag != mail.spamTag || !reflect.DeepEqual(recovered.completed, mail.completed) || !reflect.DeepEqual(recovered.envelope, mail.envelope) {
+		t.Errorf("Wrong recovered message: %+v", recovered)
+	}
+}
+
+func TestMailQueue_SweepTmp(t *testing.T) {
+	t.Parallel()
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+	if _, err := newMailQueue(&FailingMailServer{}, dir, 1, time.Second, time.Second); err != nil {
+		t.Fatalf("Error creating mail queue: %v", err)
+	}
+	// a crash between write and rename leaves the message in the tmp directory
+	if err := ioutil.WriteFile(filepath.Join(dir, queueTmpDir, "1-ABC.json"), []byte("{"), 0600); err != nil {
+		t.Fatalf("Error writing tmp file: %v", err)
+	}
+
+	config := &ApplicationConfig{QueueDir: dir}
+	if _, err := InitMailQueue(config, &FailingMailServer{}); err != nil {
+		t.Fatalf("Error initializing mail queue: %v", err)
+	}
+	if n := countFiles(t, dir, queueTmpDir); n != 0 {
+		t.Errorf("Expected an empty tmp directory, got %d files", n)
+	}
+}
+
+func TestMailQueue_Backoff(t *testing.T) {
+	t.Parallel()
+	q := &MailQueue{retryInterval: time.Second, maxAge: time.Minute}
+	expected := map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 7: time.Minute, 100: time.Minute}
+	for attempts, wait := range expected {
+		if got := q.backoff(attempts); got != wait {
+			t.Errorf("backoff(%d) is %v but should be %v", attempts, got, wait)
+		}
+	}
+}
+
+func TestController_SendMail_Queued(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+	q, err := newMailQueue(&MockMailServer{}, dir, 1, time.Second, time.Second)
+	if err != nil {
+		t.Fatalf("Error creating mail queue: %v", err)
+	}
+
+	msg := string(`{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "BODY"}`)
+	req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+	rr := doRequest(req, q, &MockActiveTokens{}, &MockTarpit{})
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Errorf("Wrong status: %d, should be %d", status, http.StatusAccepted)
+	}
+}
+
+// HELPER METHODS
+func tempQueueDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mailbridge-queue")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	return dir
+}
+func countFiles(t *testing.T, dir string, sub string) int {
+	files, err := filepath.Glob(filepath.Join(dir, sub, "*.json"))
+	if err != nil {
+		t.Fatalf("Error listing %s: %v", sub, err)
+	}
+	return len(files)
+}
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within 5 seconds")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	netmail "net/mail"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"unicode/utf8"
+)
+
+const (
+	// FieldTypeText accepts any value, this is the default
+	FieldTypeText = "text"
+	// FieldTypeEmail accepts email addresses
+	FieldTypeEmail = "email"
+	// FieldTypePhone accepts phone numbers
+	FieldTypePhone = "phone"
+	// FieldTypeNumber accepts decimal numbers
+	FieldTypeNumber = "number"
+	// PhoneRegexp is a regular expression to validate phone numbers
+	PhoneRegexp = `^\+?[0-9][0-9 ()/.\-]{2,29}$`
+	// NumberRegexp is a regular expression to validate decimal numbers
+	NumberRegexp = `^[+\-]?[0-9]+([.,][0-9]+)?$`
+)
+
+var (
+	fieldEmailRe  = regexp.MustCompile("(?i)" + EmailRegexp)
+	fieldPhoneRe  = regexp.MustCompile(PhoneRegexp)
+	fieldNumberRe = regexp.MustCompile(NumberRegexp)
+)
+
+// RecipientOptions holds the optional settings of a recipient, keyed by the same ID as the recipients map
+type RecipientOptions struct {
+	Sender       string            `json:"sender"`
+	To           []string          `json:"to"`
+	CC           []string          `json:"cc"`
+	BCC          []string          `json:"bcc"`
+	Routes       []*RouteRule      `json:"routes"`
+	TextTemplate string            `json:"textTemplate"`
+	HTMLTemplate string            `json:"htmlTemplate"`
+	Fields       []*FieldSpec      `json:"fields"`
+	Attachments  *AttachmentLimits `json:"attachments"`
+	Sinks        []*SinkConfig     `json:"sinks"`
+	AutoReply    *ReplyOptions     `json:"autoReply"`
+	Confirm      *ReplyOptions     `json:"confirm"`
+	CaptchaScore float64           `json:"captchaScore"`
+	textTemplate *texttemplate.Template
+	htmlTemplate *htmltemplate.Template
+}
+
+// FieldSpec declares a custom form field that is allowed for a recipient
+type FieldSpec struct {
+	Name      string `json:"name"`
+	Label     string `json:"label"`
+	Type      string `json:"type"`
+	Required  bool   `json:"required"`
+	MaxLength int    `json:"maxLength"`
+}
+
+// Field is a custom form field with its value, as it is rendered into the mail
+type Field struct {
+	Name  string
+	Label string
+	Value string
+}
+
+// load checks the sender, addresses, routes, field, sink, auto reply and confirmation declarations and parses the configured template files
+func (o *RecipientOptions) load() error {
+	if o.Sender != "" {
+		if _, err := netmail.ParseAddress(o.Sender); err != nil {
+			return fmt.Errorf("invalid sender %q: %v", o.Sender, err)
+		}
+	}
+	if o.CaptchaScore < 0 || o.CaptchaScore > 1 {
+		return fmt.Errorf("captchaScore %v is not between 0 and 1", o.CaptchaScore)
+	}
+	if err := checkAddresses(o.To, o.CC, o.BCC); err != nil {
+		return err
+	}
+	for i, rule := range o.Routes {
+		if rule == nil {
+			return fmt.Errorf("route %d is empty", i)
+		}
+		if err := rule.load(); err != nil {
+			return fmt.Errorf("route %d: %v", i, err)
+		}
+	}
+	names := make(map[string]bool)
+	for _, spec := range o.Fields {
+		if spec.Name == "" {
+			return errors.New("field without name")
+		}
+		if names[spec.Name] {
+			return fmt.Errorf("field %v declared twice", spec.Name)
+		}
+		names[spec.Name] = true
+		switch spec.Type {
+		case "", FieldTypeText, FieldTypeEmail, FieldTypePhone, FieldTypeNumber:
+		default:
+			return fmt.Errorf("field %v has unknown type %v", spec.Name, spec.Type)
+		}
+	}
+	if o.TextTemplate != "" {
+		t, err := texttemplate.New(filepath.Base(o.TextTemplate)).ParseFiles(o.TextTemplate)
+		if err != nil {
+			return fmt.Errorf("could not parse text template: %v", err)
+		}
+		o.textTemplate = t
+	}
+	if o.HTMLTemplate != "" {
+		t, err := htmltemplate.New(filepath.Base(o.HTMLTemplate)).ParseFiles(o.HTMLTemplate)
+		if err != nil {
+			return fmt.Errorf("could not parse html template: %v", err)
+		}
+		o.htmlTemplate = t
+	}
+	if o.AutoReply != nil {
+		if err := o.AutoReply.load(defaultAutoReplySubject, defaultAutoReplyTextTemplate); err != nil {
+			return fmt.Errorf("auto reply: %v", err)
+		}
+	}
+	if o.Confirm != nil {
+		if err := o.Confirm.load(defaultConfirmSubject, defaultConfirmTextTemplate); err != nil {
+			return fmt.Errorf("confirm: %v", err)
+		}
+	}
+	for i, sink := range o.Sinks {
+		if sink == nil {
+			return fmt.Errorf("sink %d is empty", i)
+		}
+		if err := sink.load(); err != nil {
+			return fmt.Errorf("sink %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// hasTemplates returns true if the recipient has at least one template, a nil receiver has none
+func (o *RecipientOptions) hasTemplates() bool {
+	return o != nil && (o.textTemplate != nil || o.htmlTemplate != nil)
+}
+
+// validateFields checks the submitted custom fields against the declared fields.
+// Without declared fields, any field is allowed.
+func (o *RecipientOptions) validateFields(fields map[string]string) error {
+	if o == nil || len(o.Fields) == 0 {
+		return nil
+	}
+	var msg []string
+	declared := make(map[string]bool)
+	for _, spec := range o.Fields {
+		declared[spec.Name] = true
+		value, ok := fields[spec.Name]
+		if !ok || value == "" {
+			if spec.Required {
+				msg = append(msg, fmt.Sprintf("Field %v must be set", spec.Name))
+			}
+			continue
+		}
+		if err := spec.check(value); err != nil {
+			msg = append(msg, err.Error())
+		}
+	}
+	for name := range fields {
+		if !declared[name] {
+			msg = append(msg, fmt.Sprintf("Field %v is not allowed", name))
+		}
+	}
+	if len(msg) > 0 {
+		sort.Strings(msg)
+		return errors.New(strings.Join(msg, "\n"))
+	}
+	return nil
+}
+
+// orderedFields returns the submitted fields in the order of their declaration,
+// without declared fields they are ordered by name. Empty fields are skipped.
+func (o *RecipientOptions) orderedFields(fields map[string]string) []Field {
+	var ordered []Field
+	if o != nil && len(o.Fields) > 0 {
+		for _, spec := range o.Fields {
+			if value := fields[spec.Name]; value != "" {
+				ordered = append(ordered, Field{Name: spec.Name, Label: spec.label(), Value: value})
+			}
+		}
+		return ordered
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value := fields[name]; value != "" {
+			ordered = append(ordered, Field{Name: name, Label: name, Value: value})
+		}
+	}
+	return ordered
+}
+
+// check validates a single non-empty value against type and length of the declaration
+func (spec *FieldSpec) check(value string) error {
+	if spec.MaxLength > 0 && utf8.RuneCountInString(value) > spec.MaxLength {
+		return fmt.Errorf("Field %v is longer than %d characters", spec.Name, spec.MaxLength)
+	}
+	switch spec.Type {
+	case FieldTypeEmail:
+		if !fieldEmailRe.MatchString(value) {
+			return fmt.Errorf("Field %v is not an email address", spec.Name)
+		}
+	case FieldTypePhone:
+		if !fieldPhoneRe.MatchString(value) {
+			return fmt.Errorf("Field %v is not a phone number", spec.Name)
+		}
+	case FieldTypeNumber:
+		if !fieldNumberRe.MatchString(value) {
+			return fmt.Errorf("Field %v is not a number", spec.Name)
+		}
+	}
+	return nil
+}
+
+// label returns the label of the field in the mail, defaults to the name
+func (spec *FieldSpec) label() string {
+	if spec.Label != "" {
+		return spec.Label
+	}
+	return spec.Name
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecipient_LoadFieldSpecs(t *testing.T) {
+	t.Parallel()
+	invalid := [][]*FieldSpec{
+		{{Name: ""}},
+		{{Name: "phone"}, {Name: "phone"}},
+		{{Name: "age", Type: "integer"}},
+	}
+	for _, fields := range invalid {
+		options := &RecipientOptions{Fields: fields}
+		if err := options.load(); err == nil {
+			t.Errorf("Error: invalid field declaration %+v should not load", fields[len(fields)-1])
+		}
+	}
+	options := getFieldOptions()
+	if err := options.load(); err != nil {
+		t.Errorf("Error loading valid field declarations: %v", err)
+	}
+}
+
+func TestRecipient_ValidateFields(t *testing.T) {
+	t.Parallel()
+	options := getFieldOptions()
+
+	valid := []map[string]string{
+		{"phone": "+49 (0)30 123-456", "company": "ACME"},
+		{"phone": "030/123456", "order": "4711", "contact": "Support@Example.com"},
+		{"phone": "0123", "order": "-12.5"},
+	}
+	for _, fields := range valid {
+		if err := options.validateFields(fields); err != nil {
+			t.Errorf("Error: valid fields %v did not validate: %v", fields, err)
+		}
+	}
+
+	invalid := map[string]map[string]string{
+		"must be set":        {"company": "ACME"},
+		"not a phone number": {"phone": "call me"},
+		"not a number":       {"phone": "0123", "order": "12 pieces"},
+		"not an email":       {"phone": "0123", "contact": "nobody"},
+		"longer than":        {"phone": "0123", "company": strings.Repeat("x", 21)},
+		"not allowed":        {"phone": "0123", "password": "secret"},
+	}
+	for expected, fields := range invalid {
+		err := options.validateFields(fields)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Error: fields %v should fail with %q but got %v", fields, expected, err)
+		}
+	}
+}
+
+func TestRecipient_ValidateFieldsWithoutDeclaration(t *testing.T) {
+	t.Parallel()
+	var options *RecipientOptions
+	if err := options.validateFields(map[string]string{"anything": "goes"}); err != nil {
+		t.Errorf("Error: undeclared fields should be allowed without declarations: %v", err)
+	}
+	options = &RecipientOptions{}
+	if err := options.validateFields(map[string]string{"anything": "goes"}); err != nil {
+		t.Errorf("Error: undeclared fields should be allowed without declarations: %v", err)
+	}
+}
+
+func TestRecipient_OrderedFields(t *testing.T) {
+	t.Parallel()
+	fields := map[string]string{"company": "ACME", "phone": "0123", "order": ""}
+
+	// declaration order and labels
+	ordered := getFieldOptions().orderedFields(fields)
+	if len(ordered) != 2 {
+		t.Fatalf("Expected 2 fields, got %v", ordered)
+	}
+	if ordered[0].Label != "Phone number" || ordered[0].Value != "0123" || ordered[1].Label != "company" {
+		t.Errorf("Wrong field order or labels: %v", ordered)
+	}
+
+	// alphabetical without declaration
+	var options *RecipientOptions
+	ordered = options.orderedFields(fields)
+	if len(ordered) != 2 || ordered[0].Name != "company" || ordered[1].Name != "phone" {
+		t.Errorf("Wrong field order: %v", ordered)
+	}
+}
+
+// HELPER METHODS
+func getFieldOptions() *RecipientOptions {
+	return &RecipientOptions{
+		Fields: []*FieldSpec{
+			{Name: "phone", Label: "Phone number", Type: FieldTypePhone, Required: true},
+			{Name: "company", MaxLength: 20},
+			{Name: "order", Type: FieldTypeNumber},
+			{Name: "contact", Type: FieldTypeEmail},
+		},
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRelayFailureThreshold is the number of consecutive failures after which a relay is taken out of rotation
+	defaultRelayFailureThreshold = 3
+	// defaultRelayCooldown is the time in seconds a failing relay is left out before it is tried again
+	defaultRelayCooldown = 60
+)
+
+// errNoRelay is returned if all relays are out of rotation
+var errNoRelay = errors.New("no SMTP relay available")
+
+// Relays implements MailServerInterface, it sends through an ordered list of SMTP relays and fails over to the next one
+// if a relay cannot be reached, rejects the credentials or answers with a temporary 4xx error.
+type Relays struct {
+	composer  *Composer
+	relays    []*relay
+	threshold int
+	cooldown  time.Duration
+}
+
+// relay is a single SMTP server with the state of its circuit breaker
+type relay struct {
+	server    *MailServer
+	failures  int
+	openUntil time.Time
+	sync.Mutex
+}
+
+// InitRelays is the factory method to initialize Relays from the relays in the config
+func InitRelays(config *ApplicationConfig) (*Relays, error) {
+	threshold := config.RelayFailureThreshold
+	if threshold <= 0 {
+		threshold = defaultRelayFailureThreshold
+	}
+	cooldown := config.RelayCooldown
+	if cooldown <= 0 {
+		cooldown = defaultRelayCooldown
+	}
+	r, err := newRelays(config.Relays, InitComposer(config), threshold, time.Duration(cooldown)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	for _, relay := range r.relays {
+		if relay.server.idleTimeout > 0 {
+			relay.server.SetupTicker()
+		}
+	}
+	return r, nil
+}
+
+// newRelays creates Relays for the given SMTP settings
+func newRelays(configs []*SMTPConfig, composer *Composer, threshold int, cooldown time.Duration) (*Relays, error) {
+	r := &Relays{composer: composer, threshold: threshold, cooldown: cooldown}
+	for _, config := range configs {
+		server, err := newMailServer(config, composer)
+		if err != nil {
+			return nil, fmt.Errorf("relay %v: %v", config.SMTPHost, err)
+		}
+		r.relays = append(r.relays, &relay{server: server})
+	}
+	return r, nil
+}
+
+// Send composes the mail once and tries the relays in order until one accepts it
+func (r *Relays) Send(mail *EmailMessage) error {
+	envelope, err := r.composer.Compose(mail)
+	if err != nil {
+		return err
+	}
+
+	lastErr := errNoRelay
+	for _, relay := range r.relays {
+		if !relay.available() {
+			continue
+		}
+		err := relay.server.deliver(envelope)
+		if err == nil || isPermanentError(err) {
+			// the relay works, a permanent rejection would not be different on the other relays
+			relay.succeeded()
+			return err
+		}
+		log.Printf("ERROR: relay %v failed, trying next one: %v", relay.server.host, err)
+		if relay.failed(r.threshold, r.cooldown) {
+			log.Printf("ERROR: relay %v is taken out of rotation for %v", relay.server.host, r.cooldown)
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// Queued implements MailServerInterface, the mails are sent right away
+func (r *Relays) Queued() bool {
+	return false
+}
+
+// Close quits the idle connections of all relays
+func (r *Relays) Close() {
+	for _, relay := range r.relays {
+		relay.server.Close()
+	}
+}
+
+// available returns false while the circuit breaker of the relay is open.
+// After the cooldown, the relay gets another chance, a single failure opens the circuit again.
+func (rl *relay) available() bool {
+	rl.Lock()
+	defer rl.Unlock()
+	return time.Now().After(rl.openUntil)
+}
+
+// succeeded closes the circuit breaker
+func (rl *relay) succeeded() {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.failures = 0
+	rl.openUntil = time.Time{}
+}
+
+// failed counts a failure and opens the circuit breaker when the threshold is reached, it returns true if it opened
+func (rl *relay) failed(threshold int, cooldown time.Duration) bool {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.failures++
+	if rl.failures < threshold {
+		return false
+	}
+	rl.openUntil = time.Now().Add(cooldown)
+	return true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelays_FailoverOnConnect(t *testing.T) {
+	t.Parallel()
+	// a relay that is down
+	down := &fakeSMTPServer{}
+	down.start(t)
+	down.close()
+	backup := &fakeSMTPServer{}
+	backup.start(t)
+	defer backup.close()
+
+	r := newTestRelays(t, 3, time.Minute, down, backup)
+	if err := r.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error sending mail with failover: %v", err)
+	}
+	if n := len(backup.delivered()); n != 1 {
+		t.Errorf("Expected 1 message on the backup relay, got %d", n)
+	}
+}
+
+func TestRelays_FailoverOnAuthAndTemporaryErrors(t *testing.T) {
+	t.Parallel()
+	failing := map[string]*fakeSMTPServer{
+		"auth":      {users: map[string]string{"user": "other password"}},
+		"temporary": {rcptReply: "451 try again later"},
+	}
+	for name, primary := range failing {
+		primary.start(t)
+		backup := &fakeSMTPServer{users: map[string]string{"user": "secret"}}
+		backup.start(t)
+
+		r := newTestRelays(t, 3, time.Minute, primary, backup)
+		err := r.Send(newTestMessage())
+		primary.close()
+		backup.close()
+		if err != nil {
+			t.Errorf("%s: error sending mail with failover: %v", name, err)
+			continue
+		}
+		if len(primary.delivered()) != 0 || len(backup.delivered()) != 1 {
+			t.Errorf("%s: message was not delivered through the backup relay", name)
+		}
+	}
+}
+
+func TestRelays_NoFailoverOnPermanentErrors(t *testing.T) {
+	t.Parallel()
+	primary := &fakeSMTPServer{rcptReply: "550 no such user"}
+	primary.start(t)
+	defer primary.close()
+	backup := &fakeSMTPServer{}
+	backup.start(t)
+	defer backup.close()
+
+	r := newTestRelays(t, 1, time.Minute, primary, backup)
+	if err := r.Send(newTestMessage()); !isPermanentError(err) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+	if n := len(backup.delivered()); n != 0 {
+		t.Errorf("A permanently rejected message must not be sent to the backup relay, got %d", n)
+	}
+	if !r.relays[0].available() {
+		t.Errorf("A permanent rejection must not take the relay out of rotation")
+	}
+}
+
+func TestRelays_CircuitBreaker(t *testing.T) {
+	t.Parallel()
+	primary := &fakeSMTPServer{rcptReply: "421 service not available"}
+	primary.start(t)
+	defer primary.close()
+	backup := &fakeSMTPServer{}
+	backup.start(t)
+	defer backup.close()
+
+	r := newTestRelays(t, 2, time.Hour, primary, backup)
+	for i := 0; i < 4; i++ {
+		if err := r.Send(newTestMessage()); err != nil {
+			t.Fatalf("Error sending mail %d: %v", i, err)
+		}
+	}
+	// after two failures, the primary relay is not tried anymore
+	if n := primary.connectionCount(); n != 2 {
+		t.Errorf("Expected 2 connections to the failing relay, got %d", n)
+	}
+	if n := len(backup.delivered()); n != 4 {
+		t.Errorf("Expected 4 messages on the backup relay, got %d", n)
+	}
+
+	// after the cooldown, it gets another chance, but a single failure takes it out again
+	r.relays[0].openUntil = time.Now().Add(-time.Second)
+	for i := 0; i < 2; i++ {
+		if err := r.Send(newTestMessage()); err != nil {
+			t.Fatalf("Error sending mail after cooldown: %v", err)
+		}
+	}
+	if n := primary.connectionCount(); n != 3 {
+		t.Errorf("Expected 3 connections to the failing relay, got %d", n)
+	}
+}
+
+func TestRelays_AllFailed(t *testing.T) {
+	t.Parallel()
+	primary := &fakeSMTPServer{rcptReply: "451 try again later"}
+	primary.start(t)
+	defer primary.close()
+
+	r := newTestRelays(t, 1, time.Hour, primary)
+	if err := r.Send(newTestMessage()); err == nil {
+		t.Errorf("Error: send succeeded without a working relay")
+	}
+	if err := r.Send(newTestMessage()); err != errNoRelay {
+		t.Errorf("Expected %v, got %v", errNoRelay, err)
+	}
+}
+
+// HELPER METHODS
+func newTestRelays(t *testing.T, threshold int, cooldown time.Duration, servers ...*fakeSMTPServer) *Relays {
+	var configs []*SMTPConfig
+	for _, server := range servers {
+		config := server.config()
+		config.SMTPTLS = SMTPTLSNone
+		if server.users != nil {
+			config.SMTPAuthUser = "user"
+			config.SMTPAuthPassword = "secret"
+		}
+		configs = append(configs, config)
+	}
+	composer := &Composer{sender: "noreply@example.com", recipientMap: map[string]string{"id1": "to@example.com"}}
+	r, err := newRelays(configs, composer, threshold, cooldown)
+	if err != nil {
+		t.Fatalf("Error creating relays: %v", err)
+	}
+	return r
+}
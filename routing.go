@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+)
+
+// Recipients are the addresses that a mail is sent to, blind copies are not written into the header
+type Recipients struct {
+	To  []string
+	CC  []string
+	BCC []string
+}
+
+// RouteRule sends the mails that match all of its conditions to other addresses than the recipient's
+type RouteRule struct {
+	Subject       []string          `json:"subject"`
+	Fields        map[string]string `json:"fields"`
+	SenderDomains []string          `json:"senderDomains"`
+	To            []string          `json:"to"`
+	CC            []string          `json:"cc"`
+	BCC           []string          `json:"bcc"`
+	fields        map[string]*regexp.Regexp
+}
+
+// load checks the conditions and addresses of the rule and compiles the field patterns
+func (r *RouteRule) load() error {
+	if len(r.Subject) == 0 && len(r.Fields) == 0 && len(r.SenderDomains) == 0 {
+		return errors.New("route without condition")
+	}
+	if len(r.To) == 0 {
+		return errors.New("route without to address")
+	}
+	if err := checkAddresses(r.To, r.CC, r.BCC); err != nil {
+		return err
+	}
+	r.fields = make(map[string]*regexp.Regexp)
+	for name, pattern := range r.Fields {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern for field %v: %v", name, err)
+		}
+		r.fields[name] = re
+	}
+	return nil
+}
+
+// matches returns true if the mail matches all conditions of the rule. Subject keywords and
+// sender domains are compared case insensitive, a sender domain matches its subdomains as well.
+func (r *RouteRule) matches(mail *EmailMessage) bool {
+	if len(r.Subject) > 0 {
+		subject := strings.ToLower(mail.subject)
+		found := false
+		for _, keyword := range r.Subject {
+			if strings.Contains(subject, strings.ToLower(keyword)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, re := range r.fields {
+		value, ok := mail.fields[name]
+		if !ok || !re.MatchString(value) {
+			return false
+		}
+	}
+	if len(r.SenderDomains) > 0 {
+		address, err := netmail.ParseAddress(mail.from)
+		if err != nil {
+			return false
+		}
+		domain := strings.ToLower(address.Address[strings.LastIndex(address.Address, "@")+1:])
+		found := false
+		for _, d := range r.SenderDomains {
+			d = strings.ToLower(d)
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the addresses of the first matching rule of the recipient. Without a matching rule,
+// the mail goes to the address of the recipient map and the additional addresses of the options.
+func (o *RecipientOptions) route(mail *EmailMessage, to string) *Recipients {
+	if o == nil {
+		return &Recipients{To: []string{to}}
+	}
+	for _, rule := range o.Routes {
+		if rule.matches(mail) {
+			return &Recipients{To: rule.To, CC: rule.CC, BCC: rule.BCC}
+		}
+	}
+	return &Recipients{To: append([]string{to}, o.To...), CC: o.CC, BCC: o.BCC}
+}
+
+// envelope returns the addresses of all recipients for the SMTP envelope, without duplicates
+func (r *Recipients) envelope() ([]string, error) {
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, list := range [][]string{r.To, r.CC, r.BCC} {
+		for _, to := range list {
+			address, err := netmail.ParseAddress(to)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipient %q: %v", to, err)
+			}
+			if key := strings.ToLower(address.Address); !seen[key] {
+				seen[key] = true
+				addresses = append(addresses, address.Address)
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// checkAddresses returns an error for the first address in the lists that cannot be parsed
+func checkAddresses(lists ...[]string) error {
+	for _, list := range lists {
+		for _, to := range list {
+			if _, err := netmail.ParseAddress(to); err != nil {
+				return fmt.Errorf("invalid address %q: %v", to, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRouting_LoadRoutes(t *testing.T) {
+	t.Parallel()
+	invalid := []*RecipientOptions{
+		{CC: []string{"not an address"}},
+		{Routes: []*RouteRule{{To: []string{"finance@example.com"}}}},
+		{Routes: []*RouteRule{{Subject: []string{"billing"}}}},
+		{Routes: []*RouteRule{{Subject: []string{"billing"}, To: []string{"finance@example.com"}, BCC: []string{"@example.com"}}}},
+		{Routes: []*RouteRule{{Fields: map[string]string{"topic": "("}, To: []string{"finance@example.com"}}}},
+	}
+	for _, options := range invalid {
+		if err := options.load(); err == nil {
+			t.Errorf("Error: invalid options %+v should not load", options)
+		}
+	}
+	options := getRoutingOptions()
+	if err := options.load(); err != nil {
+		t.Errorf("Error loading valid routes: %v", err)
+	}
+}
+
+func TestRouting_Route(t *testing.T) {
+	t.Parallel()
+	options := getRoutingOptions()
+	if err := options.load(); err != nil {
+		t.Fatalf("Error loading routes: %v", err)
+	}
+
+	tests := []struct {
+		mail     *EmailMessage
+		expected *Recipients
+	}{
+		{
+			&EmailMessage{from: "someone@example.org", subject: "Hello"},
+			&Recipients{To: []string{"to@example.com", "support@example.com"}, CC: []string{"team@example.com"}, BCC: []string{"archive@example.com"}},
+		},
+		{
+			&EmailMessage{from: "someone@example.org", subject: "Question about my BILLING address"},
+			&Recipients{To: []string{"finance@example.com"}},
+		},
+		{
+			&EmailMessage{from: "someone@example.org", subject: "Hello", fields: map[string]string{"topic": "Invoice"}},
+			&Recipients{To: []string{"finance@example.com"}},
+		},
+		{
+			&EmailMessage{from: "Partner <someone@Sales.Partner.com>", subject: "Hello"},
+			&Recipients{To: []string{"partners@example.com"}, CC: []string{"to@example.com"}},
+		},
+		{
+			&EmailMessage{from: "someone@notpartner.com", subject: "Hello", fields: map[string]string{"topic": "other"}},
+			&Recipients{To: []string{"to@example.com", "support@example.com"}, CC: []string{"team@example.com"}, BCC: []string{"archive@example.com"}},
+		},
+	}
+	for _, test := range tests {
+		if recipients := options.route(test.mail, "to@example.com"); !reflect.DeepEqual(recipients, test.expected) {
+			t.Errorf("Mail %q from %v was routed to %+v, expected %+v", test.mail.subject, test.mail.from, recipients, test.expected)
+		}
+	}
+
+	var none *RecipientOptions
+	if recipients := none.route(newTestMessage(), "to@example.com"); !reflect.DeepEqual(recipients.To, []string{"to@example.com"}) {
+		t.Errorf("Without options, the mail must go to the recipient map address, got %+v", recipients)
+	}
+}
+
+func TestRouting_ComposeCopies(t *testing.T) {
+	t.Parallel()
+	composer := &Composer{
+		sender:       "noreply@example.com",
+		recipientMap: map[string]string{"id1": "to@example.com"},
+		recipients: map[string]*RecipientOptions{"id1": {
+			To:  []string{"Support <support@example.com>"},
+			CC:  []string{"team@example.com", "TO@example.com"},
+			BCC: []string{"archive@example.com"},
+		}},
+	}
+	envelope, err := composer.Compose(newTestMessage())
+	if err != nil {
+		t.Fatalf("Error composing message: %v", err)
+	}
+	expected := []string{"to@example.com", "support@example.com", "team@example.com", "archive@example.com"}
+	if !reflect.DeepEqual(envelope.To, expected) {
+		t.Errorf("Expected the envelope recipients %v without duplicates, got %v", expected, envelope.To)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(envelope.Data)))
+	if err != nil {
+		t.Fatalf("Error parsing message: %v", err)
+	}
+	if to := msg.Header.Get("To"); to != `<to@example.com>, "Support" <support@example.com>` {
+		t.Errorf("Wrong To header: %q", to)
+	}
+	if cc := msg.Header.Get("Cc"); !strings.Contains(cc, "team@example.com") {
+		t.Errorf("Wrong Cc header: %q", cc)
+	}
+	if strings.Contains(string(envelope.Data), "archive@example.com") {
+		t.Errorf("Blind copy must not appear in the message")
+	}
+}
+
+// HELPER METHODS
+func getRoutingOptions() *RecipientOptions {
+	return &RecipientOptions{
+		To:  []string{"support@example.com"},
+		CC:  []string{"team@example.com"},
+		BCC: []string{"archive@example.com"},
+		Routes: []*RouteRule{
+			{Subject: []string{"billing", "invoice"}, To: []string{"finance@example.com"}},
+			{Fields: map[string]string{"topic": "^(invoice|payment)$"}, To: []string{"finance@example.com"}},
+			{SenderDomains: []string{"partner.com"}, To: []string{"partners@example.com"}, CC: []string{"to@example.com"}},
+		},
+	}
+}
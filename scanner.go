@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ScannerSpamd checks the messages with SpamAssassin's spamd over the SPAMC protocol
+	ScannerSpamd = "spamd"
+	// ScannerRspamd checks the messages with the HTTP protocol of rspamd
+	ScannerRspamd = "rspamd"
+	// defaultSpamdAddress is the address that spamd listens on by default
+	defaultSpamdAddress = "localhost:783"
+	// defaultRspamdURL is the URL of the normal worker of rspamd by default
+	defaultRspamdURL = "http://localhost:11333"
+	// defaultScannerTimeout is the time in seconds that a scan may take
+	defaultScannerTimeout = 30
+	// scannerResponseLimit is the maximal size of a scanner response that is read
+	scannerResponseLimit = 1 << 20
+)
+
+// SpamScannerConfig configures the check of the rendered messages by spamd or rspamd
+type SpamScannerConfig struct {
+	Type            string  `json:"type"`
+	Address         string  `json:"address"`
+	Password        string  `json:"password"`
+	Timeout         int     `json:"timeout"`
+	QuarantineScore float64 `json:"quarantineScore"`
+	DropScore       float64 `json:"dropScore"`
+	TagPrefix       string  `json:"tagPrefix"`
+}
+
+// load checks the type and sets the default address, timeout and tag prefix
+func (s *SpamScannerConfig) load() error {
+	switch s.Type {
+	case ScannerSpamd:
+		if s.Address == "" {
+			s.Address = defaultSpamdAddress
+		}
+	case ScannerRspamd:
+		if s.Address == "" {
+			s.Address = defaultRspamdURL
+		}
+		u, err := url.Parse(s.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("rspamd needs a http or https address")
+		}
+	default:
+		return fmt.Errorf("unknown spam scanner %q", s.Type)
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = defaultScannerTimeout
+	}
+	if s.TagPrefix == "" {
+		s.TagPrefix = defaultSpamTagPrefix
+	}
+	if strings.ContainsAny(s.TagPrefix, "\r\n") {
+		return errors.New("tagPrefix must not contain line breaks")
+	}
+	return nil
+}
+
+// ScanResult is the verdict of a spam scanner, Spam is the decision of the scanner itself
+type ScanResult struct {
+	Spam  bool
+	Score float64
+}
+
+// SpamScanner checks a rendered message, for being able to mock spamd and rspamd
+type SpamScanner interface {
+	Scan(envelope *Envelope) (*ScanResult, error)
+}
+
+// errScanFailed is returned if the spam scanner could not check a message, the message is not accepted unchecked
+var errScanFailed = errors.New("spam scanner failed")
+
+// SpamChecker renders every message and has it checked by the scanner before the message is held for confirmation,
+// sent or dispatched to the sinks. The checked message is pinned to the mail, so that the transports deliver exactly
+// the rendered message that has been checked. Messages that the scanner rates as spam get the tag prefix in front
+// of the subject for the recipient, messages with a high score are quarantined or dropped.
+// Auto replies and confirmation mails are our own and are not checked.
+type SpamChecker struct {
+	composer        *Composer
+	scanner         SpamScanner
+	quarantine      *Quarantine
+	quarantineScore float64
+	dropScore       float64
+	tagPrefix       string
+}
+
+// InitSpamChecker is the factory method to initialize a SpamChecker for the scanner in the config
+func InitSpamChecker(config *ApplicationConfig, quarantine *Quarantine) *SpamChecker {
+	s := config.SpamScanner
+	timeout := time.Duration(s.Timeout) * time.Second
+	var scanner SpamScanner
+	if s.Type == ScannerRspamd {
+		scanner = &rspamdScanner{url: strings.TrimSuffix(s.Address, "/"), password: s.Password, client: &http.Client{Timeout: timeout}}
+	} else {
+		scanner = &spamdScanner{address: s.Address, timeout: timeout}
+	}
+	return &SpamChecker{
+		composer:        InitComposer(config),
+		scanner:         scanner,
+		quarantine:      quarantine,
+		quarantineScore: s.QuarantineScore,
+		dropScore:       s.DropScore,
+		tagPrefix:       s.TagPrefix,
+	}
+}
+
+// Check renders and scans the mail. It returns true if the mail has been quarantined or dropped and must not be sent.
+// A tagged mail is rendered again with the tag, which is the only difference to the checked message.
+func (c *SpamChecker) Check(mail *EmailMessage) (bool, error) {
+	envelope, err := c.composer.Compose(mail)
+	if err != nil {
+		return false, err
+	}
+	result, err := c.scanner.Scan(envelope)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errScanFailed, err)
+	}
+	switch {
+	case c.dropScore > 0 && result.Score >= c.dropScore:
+		log.Printf("Message from %v dropped with spam score %g", mail.from, result.Score)
+		return true, nil
+	case c.quarantineScore > 0 && result.Score >= c.quarantineScore:
+		if c.quarantine == nil {
+			return false, errors.New("no quarantine for a suspicious message")
+		}
+		mail.envelope = envelope
+		return true, c.quarantine.Store(mail, fmt.Sprintf("spam scanner score %g", result.Score))
+	case result.Spam && mail.spamTag == "":
+		log.Printf("Message from %v tagged as spam by the scanner with score %g", mail.from, result.Score)
+		mail.spamTag = c.tagPrefix
+		if envelope, err = c.composer.Compose(mail); err != nil {
+			return false, err
+		}
+	}
+	mail.envelope = envelope
+	return false, nil
+}
+
+// spamdScanner checks the messages with the CHECK command of the SPAMC protocol.
+// An address that starts with a slash is a unix socket.
+type spamdScanner struct {
+	address string
+	timeout time.Duration
+}
+
+// Scan implements SpamScanner
+func (s *spamdScanner) Scan(envelope *Envelope) (*ScanResult, error) {
+	network := "tcp"
+	if strings.HasPrefix(s.address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, s.address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	fmt.Fprintf(conn, "CHECK SPAMC/1.5\r\nContent-length: %d\r\n\r\n", len(envelope.Data))
+	if _, err := conn.Write(envelope.Data); err != nil {
+		return nil, err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(io.LimitReader(conn, scannerResponseLimit)))
+	status, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	parts := strings.SplitN(status, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "SPAMD/") {
+		return nil, fmt.Errorf("invalid spamd response %q", status)
+	}
+	if parts[1] != "0" {
+		return nil, fmt.Errorf("spamd answered %q", status)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && header == nil {
+		return nil, err
+	}
+	return parseSpamdResult(header.Get("Spam"))
+}
+
+// parseSpamdResult parses the Spam header of spamd, e.g. "True ; 15.3 / 5.0"
+func parseSpamdResult(value string) (*ScanResult, error) {
+	parts := strings.SplitN(value, ";", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid spamd result %q", value)
+	}
+	scores := strings.SplitN(parts[1], "/", 2)
+	score, err := strconv.ParseFloat(strings.TrimSpace(scores[0]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spamd score %q", value)
+	}
+	flag := strings.ToLower(strings.TrimSpace(parts[0]))
+	return &ScanResult{Spam: flag == "true" || flag == "yes", Score: score}, nil
+}
+
+// rspamdScanner checks the messages with the checkv2 endpoint of rspamd
+type rspamdScanner struct {
+	url      string
+	password string
+	client   *http.Client
+}
+
+// rspamdResult is the part of the rspamd answer that is used
+type rspamdResult struct {
+	Score  float64 `json:"score"`
+	Action string  `json:"action"`
+}
+
+// Scan implements SpamScanner. The actions of rspamd that mark a message, or would reject it, are spam.
+// Greylisting and soft rejects are temporary decisions for SMTP and are ignored here.
+func (s *rspamdScanner) Scan(envelope *Envelope) (*ScanResult, error) {
+	req, err := http.NewRequest("POST", s.url+"/checkv2", bytes.NewReader(envelope.Data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("From", envelope.From)
+	for _, to := range envelope.To {
+		req.Header.Add("Rcpt", to)
+	}
+	if s.password != "" {
+		req.Header.Set("Password", s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, scannerResponseLimit))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd answered with status %d", resp.StatusCode)
+	}
+	var result rspamdResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("invalid rspamd response: %v", err)
+	}
+	switch result.Action {
+	case "reject", "add header", "rewrite subject":
+		return &ScanResult{Spam: true, Score: result.Score}, nil
+	}
+	return &ScanResult{Score: result.Score}, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpamdScanner_Scan(t *testing.T) {
+	t.Parallel()
+	spamd := newTestSpamd(t)
+	defer spamd.Close()
+	scanner := &spamdScanner{address: spamd.Addr().String(), timeout: time.Second}
+
+	result, err := scanner.Scan(&Envelope{Data: []byte("Subject: Hello\r\n\r\nJust a question.\r\n")})
+	if err != nil || result.Spam || result.Score != 1.5 {
+		t.Errorf("Error: ham scanned as %+v, %v", result, err)
+	}
+	result, err = scanner.Scan(&Envelope{Data: []byte("Subject: Hello\r\n\r\nCheap VIAGRA.\r\n")})
+	if err != nil || !result.Spam || result.Score != 15.3 {
+		t.Errorf("Error: spam scanned as %+v, %v", result, err)
+	}
+	if _, err := scanner.Scan(&Envelope{Data: []byte("BROKEN")}); err == nil {
+		t.Errorf("Error: spamd error should return error")
+	}
+	closed := &spamdScanner{address: "127.0.0.1:1", timeout: time.Second}
+	if _, err := closed.Scan(&Envelope{Data: []byte("Subject: Hello\r\n\r\n")}); err == nil {
+		t.Errorf("Error: unreachable spamd should return error")
+	}
+}
+
+func TestRspamdScanner_Scan(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.URL.Path != "/checkv2" || r.Header.Get("From") != "from@example.com" || r.Header.Get("Rcpt") != "to@example.com":
+			w.WriteHeader(http.StatusBadRequest)
+		case strings.Contains(string(body), "VIAGRA"):
+			w.Write([]byte(`{"score": 16.5, "required_score": 15, "action": "reject"}`))
+		case strings.Contains(string(body), "GREYLIST"):
+			w.Write([]byte(`{"score": 4.5, "required_score": 15, "action": "greylist"}`))
+		default:
+			w.Write([]byte(`{"score": 0.5, "required_score": 15, "action": "no action"}`))
+		}
+	}))
+	defer server.Close()
+	scanner := &rspamdScanner{url: server.URL, client: server.Client()}
+	envelope := func(body string) *Envelope {
+		return &Envelope{From: "from@example.com", To: []string{"to@example.com"}, Data: []byte("Subject: Hello\r\n\r\n" + body)}
+	}
+
+	expected := map[string]ScanResult{
+		"Just a question": {Spam: false, Score: 0.5},
+		"Cheap VIAGRA":    {Spam: true, Score: 16.5},
+		"GREYLIST":        {Spam: false, Score: 4.5},
+	}
+	for body, want := range expected {
+		result, err := scanner.Scan(envelope(body))
+		if err != nil || *result != want {
+			t.Errorf("Error: %q scanned as %+v, %v, should be %+v", body, result, err, want)
+		}
+	}
+	if _, err := scanner.Scan(&Envelope{From: "other@example.com", Data: []byte("x")}); err == nil {
+		t.Errorf("Error: rspamd error status should return error")
+	}
+}
+
+func TestSpamChecker_Check(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-scanner")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	checker, scanner := newTestSpamChecker(t, dir)
+	mail := func() *EmailMessage {
+		return &EmailMessage{from: "from@example.com", recipientID: "TO", subject: "Hello", body: "Body"}
+	}
+
+	// ham is delivered exactly as it has been checked
+	scanner.result = &ScanResult{Score: 1}
+	ham := mail()
+	if dropped, err := checker.Check(ham); err != nil || dropped {
+		t.Fatalf("Error: ham should be accepted: %v", err)
+	}
+	envelope, err := InitComposer(&ApplicationConfig{Sender: "noreply@example.com", RecipientMap: map[string]string{"TO": "to@example.com"}}).Compose(ham)
+	if err != nil || string(envelope.Data) != string(scanner.scanned) || !strings.Contains(string(envelope.Data), "Subject: Hello") {
+		t.Errorf("Error: the delivered message must be the checked one: %v %q", err, scanner.scanned)
+	}
+
+	// spam is tagged for the recipient
+	scanner.result = &ScanResult{Spam: true, Score: 6}
+	spam := mail()
+	if dropped, err := checker.Check(spam); err != nil || dropped || spam.subject != "Hello" {
+		t.Errorf("Error: spam should be accepted: %v %+v", err, spam)
+	}
+	if spam.envelope == nil || !strings.Contains(string(spam.envelope.Data), "Subject: "+defaultSpamTagPrefix+"Hello") {
+		t.Errorf("Error: spam should be delivered tagged")
+	}
+
+	// high scores are quarantined or dropped
+	scanner.result = &ScanResult{Spam: true, Score: 12}
+	if dropped, err := checker.Check(mail()); err != nil || !dropped {
+		t.Errorf("Error: spam should be quarantined: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 1 {
+		t.Errorf("Error: quarantine should hold 1 message, holds %v", len(files))
+	}
+	scanner.result = &ScanResult{Spam: true, Score: 25}
+	if dropped, err := checker.Check(mail()); err != nil || !dropped {
+		t.Errorf("Error: spam should be dropped: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 1 {
+		t.Errorf("Error: dropped message should not be quarantined, quarantine holds %v", len(files))
+	}
+
+	// a failed scan does not let the message through
+	scanner.err = errors.New("connection refused")
+	if _, err := checker.Check(mail()); !errors.Is(err, errScanFailed) {
+		t.Errorf("Error: failed scan should return %v, got %v", errScanFailed, err)
+	}
+}
+
+func TestController_SpamScanner(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-scanner")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	recipients := getAutoReplyRecipients(t)
+	recipients["CONFIRM"] = &RecipientOptions{Confirm: &ReplyOptions{}}
+	ms := &FailingMailServer{}
+	replies := &FailingMailServer{}
+	c := newController(newTestAutoResponder(recipients, ms, replies, newReplyLimiter(10, 10, time.Hour)), &MockActiveTokens{}, &MockTarpit{})
+	c.recipients = recipients
+	c.confirmations = newTestConfirmations(replies, newReplyLimiter(10, 10, time.Hour))
+	var scanner *MockSpamScanner
+	c.scanner, scanner = newTestSpamChecker(t, dir)
+	send := func(to string) int {
+		msg := `{"Token": "TOKEN","From": "from@example.com", "To": "` + to + `", "Subject": "SUBJECT", "Body": "BODY"}`
+		req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+		return doRequestController(req, c).Code
+	}
+
+	// dropped and quarantined messages get no auto reply and no confirmation mail
+	for _, score := range []float64{12, 25} {
+		scanner.result = &ScanResult{Spam: true, Score: score}
+		if status := send("id1"); status != http.StatusCreated || ms.sentCount() != 0 || replies.sentCount() != 0 {
+			t.Errorf("Error: message with score %v answered %d, sent %d messages and %d replies", score, status, ms.sentCount(), replies.sentCount())
+		}
+		if status := send("CONFIRM"); status != http.StatusAccepted || replies.sentCount() != 0 {
+			t.Errorf("Error: message with score %v for confirmation answered %d, sent %d replies", score, status, replies.sentCount())
+		}
+	}
+
+	// the tag is only in the message to the recipient, the ticket is in the checked message, but a tagged message gets no auto reply
+	scanner.result = &ScanResult{Spam: true, Score: 6}
+	if status := send("id1"); status != http.StatusCreated || ms.sentCount() != 1 || replies.sentCount() != 0 {
+		t.Fatalf("Error: tagged message answered %d, sent %d messages and %d replies", status, ms.sentCount(), replies.sentCount())
+	}
+	sent := ms.sent[0]
+	if !strings.Contains(string(sent.envelope.Data), "Subject: [SPAM] SUBJECT") || !strings.Contains(string(sent.envelope.Data), "X-Mailbridge-Ticket: "+sent.ticket) {
+		t.Errorf("Error: tagged message was not delivered as checked: %s", sent.envelope.Data)
+	}
+
+	// the message is not accepted unchecked
+	scanner.err = errors.New("connection refused")
+	if status := send("id1"); status != http.StatusServiceUnavailable || ms.sentCount() != 1 {
+		t.Errorf("Error: failed scan answered %d, should be %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestSpamScannerConfig_Load(t *testing.T) {
+	t.Parallel()
+	invalid := []*SpamScannerConfig{
+		{},
+		{Type: "clamav"},
+		{Type: ScannerRspamd, Address: "localhost:11333"},
+		{Type: ScannerSpamd, TagPrefix: "[SPAM]\nBcc: x@example.com"},
+	}
+	for _, scanner := range invalid {
+		if err := scanner.load(); err == nil {
+			t.Errorf("Error: invalid scanner config %+v should return error", scanner)
+		}
+	}
+	scanner := &SpamScannerConfig{Type: ScannerRspamd}
+	if err := scanner.load(); err != nil || scanner.Address != defaultRspamdURL || scanner.Timeout != defaultScannerTimeout {
+		t.Errorf("Error: rspamd defaults not set: %v %+v", err, scanner)
+	}
+	config := &ApplicationConfig{SpamScanner: &SpamScannerConfig{Type: ScannerSpamd, QuarantineScore: 10}}
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error: quarantineScore without quarantineDir should return error")
+	}
+}
+
+// HELPER METHODS
+func newTestSpamChecker(t *testing.T, dir string) (*SpamChecker, *MockSpamScanner) {
+	config := &ApplicationConfig{
+		Sender:        "noreply@example.com",
+		RecipientMap:  map[string]string{"TO": "to@example.com", "id1": "to@example.com", "CONFIRM": "to@example.com"},
+		QuarantineDir: dir,
+		SpamScanner:   &SpamScannerConfig{Type: ScannerSpamd, QuarantineScore: 10, DropScore: 20},
+	}
+	if err := config.validateConfig(); err != nil {
+		t.Fatalf("Error in config validation: %v", err)
+	}
+	quarantine, err := newQuarantine(config)
+	if err != nil {
+		t.Fatalf("Error initializing quarantine: %v", err)
+	}
+	checker := InitSpamChecker(config, quarantine)
+	scanner := &MockSpamScanner{}
+	checker.scanner = scanner
+	return checker, scanner
+}
+
+// MockSpamScanner returns the configured result and records the scanned message
+type MockSpamScanner struct {
+	result  *ScanResult
+	err     error
+	scanned []byte
+}
+
+func (s *MockSpamScanner) Scan(envelope *Envelope) (*ScanResult, error) {
+	s.scanned = envelope.Data
+	return s.result, s.err
+}
+
+// newTestSpamd starts a stub spamd that answers CHECK requests. Messages with VIAGRA are spam,
+// BROKEN messages get an error status.
+func newTestSpamd(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting stub spamd: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := textproto.NewReader(bufio.NewReader(conn))
+				command, _ := reader.ReadLine()
+				header, err := reader.ReadMIMEHeader()
+				length, _ := strconv.Atoi(header.Get("Content-length"))
+				data := make([]byte, length)
+				if err != nil || command != "CHECK SPAMC/1.5" || length == 0 {
+					fmt.Fprintf(conn, "SPAMD/1.1 76 EX_PROTOCOL\r\n\r\n")
+					return
+				}
+				if _, err := io.ReadFull(reader.R, data); err != nil {
+					return
+				}
+				switch {
+				case strings.Contains(string(data), "BROKEN"):
+					fmt.Fprintf(conn, "SPAMD/1.1 74 EX_IOERR\r\n\r\n")
+				case strings.Contains(string(data), "VIAGRA"):
+					fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\nSpam: True ; 15.3 / 5.0\r\n\r\n")
+				default:
+					fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\nSpam: False ; 1.5 / 5.0\r\n\r\n")
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sesAPI posts the raw MIME message to the v2 SendEmail API of Amazon SES, signed with AWS Signature Version 4
+type sesAPI struct {
+	endpoint string
+	region   string
+	keyID    string
+	secret   string
+	now      func() time.Time
+}
+
+type sesRawMessage struct {
+	Data []byte `json:"Data"`
+}
+
+type sesContent struct {
+	Raw *sesRawMessage `json:"Raw"`
+}
+
+type sesDestination struct {
+	ToAddresses []string `json:"ToAddresses"`
+}
+
+type sesMessage struct {
+	FromEmailAddress string          `json:"FromEmailAddress"`
+	Destination      *sesDestination `json:"Destination"`
+	Content          *sesContent     `json:"Content"`
+}
+
+func (api *sesAPI) newRequest(envelope *Envelope) (*http.Request, error) {
+	// []byte is marshalled as base64, as the API expects it
+	body, err := json.Marshal(&sesMessage{
+		FromEmailAddress: envelope.From,
+		Destination:      &sesDestination{ToAddresses: envelope.To},
+		Content:          &sesContent{Raw: &sesRawMessage{Data: envelope.Data}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", api.endpoint+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(req, body, api.keyID, api.secret, api.region, "ses", api.now())
+	return req, nil
+}
+
+// signV4 adds the X-Amz-Date and Authorization headers of AWS Signature Version 4 to the request
+func signV4(req *http.Request, body []byte, keyID string, secret string, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// the canonical headers are the host and all headers of the request, lowercase and sorted
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", keyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minTokenSecretLength is the minimal length of the shared secret for signed tokens
+const minTokenSecretLength = 16
+
+// SignedTokens implements ActiveTokensInterface without a shared token table. A token carries its own
+// expiration and an HMAC of its id and expiration under a secret that all instances share, so every
+// instance can validate tokens issued by any other instance.
+// To keep the one-time semantics, the ids of used tokens are remembered until the token expires.
+// Beware: this cache is local to the instance, a token can be used once on every instance.
+type SignedTokens struct {
+	secret          []byte
+	lifetime        int
+	cleanupInterval int
+	used            map[string]time.Time
+	sync.Mutex
+}
+
+// New returns a new signed token, nothing is stored
+func (st *SignedTokens) New() (*Token, error) {
+	token := &Token{}
+	if err := token.Init(st.lifetime); err != nil {
+		return nil, err
+	}
+	// the token only transports seconds, so drop everything below
+	token.Expires = time.Unix(token.Expires.Unix(), 0)
+	token.signature = st.sign(token)
+	return token, nil
+}
+
+// Validate checks signature and expiration of the token and that it has not been used before on this instance.
+// The token is returned if it was valid, its time of issue is derived from the signed expiration.
+func (st *SignedTokens) Validate(key string) (*Token, error) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not signed")
+	}
+	seconds, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("token has invalid expiration")
+	}
+	signature, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("token has invalid signature")
+	}
+	token, err := parseToken(parts[0], time.Unix(seconds, 0))
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(signature, st.sign(token)) {
+		return nil, errors.New("token signature does not match")
+	}
+	// hex and numbers have several spellings, only the one that was handed out is accepted,
+	// so that the used token can not come back in another spelling
+	token.signature = signature
+	if token.String() != key {
+		return nil, errors.New("token is not in canonical form")
+	}
+	if time.Now().After(token.Expires) {
+		return nil, errors.New("token already expired")
+	}
+	token.Issued = token.Expires.Add(-time.Duration(st.lifetime) * time.Second)
+
+	// check and record the usage in one step
+	st.Lock()
+	defer st.Unlock()
+	if _, found := st.used[token.id()]; found {
+		return nil, errors.New("token has already been used")
+	}
+	st.used[token.id()] = token.Expires
+	return token, nil
+}
+
+// Clean forgets the used tokens that are expired anyway
+// this is called regularly by the ticker
+func (st *SignedTokens) Clean() int {
+	st.Lock()
+	defer st.Unlock()
+	i := 0
+	for id, expires := range st.used {
+		if time.Now().After(expires) {
+			delete(st.used, id)
+			i++
+		}
+	}
+	return i
+}
+
+// SetupTicker creates a ticker that calls Clean() in regular intervals (config.CleanupInterval)
+func (st *SignedTokens) SetupTicker() {
+	ticker := time.NewTicker(time.Second * time.Duration(st.cleanupInterval))
+	go func() {
+		for t := range ticker.C {
+			deleted := st.Clean()
+			if deleted > 0 {
+				log.Printf("[%s] Cleaning up %d used tokens", t, deleted)
+			}
+		}
+	}()
+}
+
+// sign returns the HMAC over id and expiration of the token
+func (st *SignedTokens) sign(token *Token) []byte {
+	mac := hmac.New(sha256.New, st.secret)
+	fmt.Fprintf(mac, "%s.%d", token.id(), token.Expires.Unix())
+	return mac.Sum(nil)
+}
+
+// newSignedTokens returns a SignedTokens without starting the cleanup ticker
+func newSignedTokens(config *ApplicationConfig) (*SignedTokens, error) {
+	if len(config.TokenSecret) < minTokenSecretLength {
+		return nil, fmt.Errorf("tokenSecret must have at least %d characters for the signed token store", minTokenSecretLength)
+	}
+	return &SignedTokens{
+		secret:          []byte(config.TokenSecret),
+		lifetime:        config.Lifetime,
+		cleanupInterval: config.CleanupInterval,
+		used:            make(map[string]time.Time),
+	}, nil
+}
+
+// InitSignedTokens is the factory function to initialize the signed token store
+func InitSignedTokens(config *ApplicationConfig) (*SignedTokens, error) {
+	st, err := newSignedTokens(config)
+	if err != nil {
+		return nil, err
+	}
+	st.SetupTicker()
+	return st, nil
+}
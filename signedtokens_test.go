@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedTokens_NewAndValidate(t *testing.T) {
+	t.Parallel()
+	store := getSignedTokens(t, "a shared secret for all instances", 10)
+
+	token, err := store.New()
+	if err != nil {
+		t.Fatalf("Error in getting new token: %v", err)
+	}
+	if parts := strings.Split(token.String(), "."); len(parts) != 3 {
+		t.Errorf("Error: signed token should have 3 parts but is %v", token.String())
+	}
+	valid, err := store.Validate(token.String())
+	if err != nil {
+		t.Errorf("Error: token validation returned error: %v", err)
+	} else if elapsed := time.Since(valid.Issued); elapsed < 0 || elapsed > 2*time.Second {
+		t.Errorf("Error: validated token was issued %v ago", elapsed)
+	}
+	if _, err := store.Validate(token.String()); err == nil {
+		t.Errorf("Error: token could be used twice")
+	}
+}
+
+func TestSignedTokens_OtherInstance(t *testing.T) {
+	t.Parallel()
+	store := getSignedTokens(t, "a shared secret for all instances", 10)
+	other := getSignedTokens(t, "a shared secret for all instances", 10)
+	foreign := getSignedTokens(t, "some completely different secret", 10)
+
+	token, err := store.New()
+	if err != nil {
+		t.Fatalf("Error in getting new token: %v", err)
+	}
+	if _, err := foreign.Validate(token.String()); err == nil {
+		t.Errorf("Error: token validated with a different secret")
+	}
+	if _, err := other.Validate(token.String()); err != nil {
+		t.Errorf("Error: token issued by another instance did not validate: %v", err)
+	}
+}
+
+func TestSignedTokens_Tampered(t *testing.T) {
+	t.Parallel()
+	store := getSignedTokens(t, "a shared secret for all instances", 10)
+
+	token, err := store.New()
+	if err != nil {
+		t.Fatalf("Error in getting new token: %v", err)
+	}
+	parts := strings.Split(token.String(), ".")
+	later := token.Expires.Add(time.Hour).Unix()
+	forged := "00" + parts[2][2:]
+	if forged == parts[2] {
+		forged = "FF" + parts[2][2:]
+	}
+	tampered := []string{
+		parts[0],
+		parts[0] + "." + parts[1],
+		strings.Join([]string{parts[0], strconv.FormatInt(later, 10), parts[2]}, "."),
+		strings.Join([]string{parts[0], parts[1], forged}, "."),
+		strings.Join([]string{parts[0], parts[1], "XYZ"}, "."),
+	}
+	for _, key := range tampered {
+		if _, err := store.Validate(key); err == nil {
+			t.Errorf("Error: tampered token %v validated", key)
+		}
+	}
+}
+
+func TestSignedTokens_ReplayOtherSpelling(t *testing.T) {
+	t.Parallel()
+	store := getSignedTokens(t, "a shared secret for all instances", 10)
+
+	token, err := store.New()
+	if err != nil {
+		t.Fatalf("Error in getting new token: %v", err)
+	}
+	parts := strings.Split(token.String(), ".")
+	respelled := []string{
+		strings.Join([]string{strings.ToLower(parts[0]), parts[1], parts[2]}, "."),
+		strings.Join([]string{parts[0], parts[1], strings.ToLower(parts[2])}, "."),
+		strings.Join([]string{parts[0], "0" + parts[1], parts[2]}, "."),
+		strings.Join([]string{parts[0], "+" + parts[1], parts[2]}, "."),
+	}
+	for _, key := range respelled {
+		if _, err := store.Validate(key); err == nil {
+			t.Errorf("Error: token in other spelling %v validated", key)
+		}
+	}
+	if _, err := store.Validate(token.String()); err != nil {
+		t.Fatalf("Error: token validation returned error: %v", err)
+	}
+	for _, key := range respelled {
+		if _, err := store.Validate(key); err == nil {
+			t.Errorf("Error: used token replayed as %v", key)
+		}
+	}
+}
+
+func TestSignedTokens_ExpiredAndClean(t *testing.T) {
+	t.Parallel()
+	store := getSignedTokens(t, "a shared secret for all instances", 1)
+
+	used, err := store.New()
+	if err != nil {
+		t.Fatalf("Error in getting new token: %v", err)
+	}
+	unused, err := store.New()
+	if err != nil {
+		t.Fatalf("Error in getting new token: %v", err)
+	}
+	if _, err := store.Validate(used.String()); err != nil {
+		t.Fatalf("Error: token validation returned error: %v", err)
+	}
+
+	// wait until both tokens are expired
+	time.Sleep(2100 * time.Millisecond)
+	if _, err := store.Validate(unused.String()); err == nil {
+		t.Errorf("Error: expired token validated")
+	}
+	if deleted := store.Clean(); deleted != 1 {
+		t.Errorf("clean method returned %v but should have returned 1", deleted)
+	}
+}
+
+func TestSignedTokens_ShortSecret(t *testing.T) {
+	t.Parallel()
+	config := getConfig(1, 1)
+	config.TokenSecret = "short"
+	if _, err := newSignedTokens(&config); err == nil {
+		t.Errorf("Error: short secret should return an error")
+	}
+}
+
+// HELPER METHODS
+func getSignedTokens(t *testing.T, secret string, lifetime int) *SignedTokens {
+	config := getConfig(lifetime, 60)
+	config.TokenSecret = secret
+	store, err := newSignedTokens(&config)
+	if err != nil {
+		t.Fatalf("Error initializing signed tokens: %v", err)
+	}
+	return store
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	// SinkTypeEmail sends the mail through the configured transport
+	SinkTypeEmail = "email"
+	// SinkTypeWebhook posts the submission as signed JSON
+	SinkTypeWebhook = "webhook"
+	// SinkTypeSlack posts a message to a Slack incoming webhook
+	SinkTypeSlack = "slack"
+	// SinkTypeMattermost posts a message to a Mattermost incoming webhook
+	SinkTypeMattermost = "mattermost"
+	// SinkTypeMatrix sends a message to a Matrix room
+	SinkTypeMatrix = "matrix"
+)
+
+var (
+	// slackEscaper escapes the control characters of Slack messages, e.g. <!channel> mentions
+	slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	// chatMentionRe matches the mentions that notify a whole channel or room
+	chatMentionRe = regexp.MustCompile(`@(channel|all|here|room)\b`)
+)
+
+// SinkConfig declares a destination that the submissions for a recipient are sent to
+type SinkConfig struct {
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Secret   string `json:"secret"`
+	Room     string `json:"room"`
+	Token    string `json:"token"`
+	Template string `json:"template"`
+	template *texttemplate.Template
+}
+
+// load checks the settings that the type of the sink needs and parses the template
+func (s *SinkConfig) load() error {
+	switch s.Type {
+	case SinkTypeEmail:
+		return nil
+	case SinkTypeWebhook:
+		if s.Secret == "" {
+			return errors.New("webhook sink needs a secret")
+		}
+	case SinkTypeSlack, SinkTypeMattermost:
+	case SinkTypeMatrix:
+		if s.Room == "" || s.Token == "" {
+			return errors.New("matrix sink needs a room and a token")
+		}
+	default:
+		return fmt.Errorf("unknown sink type %q", s.Type)
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%v sink needs a http or https url", s.Type)
+	}
+	if s.Template != "" {
+		t, err := texttemplate.New(filepath.Base(s.Template)).ParseFiles(s.Template)
+		if err != nil {
+			return fmt.Errorf("could not parse sink template: %v", err)
+		}
+		s.template = t
+	}
+	return nil
+}
+
+// Sink is a destination of the submissions, the data is the same that the mail templates get
+type Sink interface {
+	Notify(mail *EmailMessage, data *TemplateData) error
+}
+
+// dispatchSink is a sink together with its type for the log
+type dispatchSink struct {
+	kind string
+	sink Sink
+}
+
+// Dispatcher implements MailServerInterface, it sends every submission to all sinks of the recipient at the same time.
+// Recipients without sinks get the mail only, as before.
+type Dispatcher struct {
+	mailServer MailServerInterface
+	recipients map[string]*RecipientOptions
+	sinks      map[string][]*dispatchSink
+}
+
+// InitDispatcher is the factory method to initialize a Dispatcher for the sinks in the recipient options,
+// email sinks send through the given mail server
+func InitDispatcher(config *ApplicationConfig, mailServer MailServerInterface) *Dispatcher {
+	d := &Dispatcher{
+		mailServer: mailServer,
+		recipients: config.RecipientOptions,
+		sinks:      make(map[string][]*dispatchSink),
+	}
+	client := &http.Client{Timeout: apiTimeout}
+	for id, options := range config.RecipientOptions {
+		if options == nil {
+			continue
+		}
+		for _, sinkConfig := range options.Sinks {
+			d.sinks[id] = append(d.sinks[id], &dispatchSink{kind: sinkConfig.Type, sink: newSink(sinkConfig, mailServer, client)})
+		}
+	}
+	return d
+}
+
+// hasSinks returns true if any recipient has sinks
+func (c *ApplicationConfig) hasSinks() bool {
+	for _, options := range c.RecipientOptions {
+		if options != nil && len(options.Sinks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newSink creates the sink of the given config
+func newSink(config *SinkConfig, mailServer MailServerInterface, client *http.Client) Sink {
+	switch config.Type {
+	case SinkTypeEmail:
+		return &emailSink{mailServer: mailServer}
+	case SinkTypeWebhook:
+		return &webhookSink{url: config.URL, secret: config.Secret, client: client}
+	case SinkTypeMatrix:
+		return &matrixSink{url: strings.TrimSuffix(config.URL, "/"), room: config.Room, token: config.Token, template: config.template, client: client}
+	default:
+		return &chatSink{kind: config.Type, url: config.URL, template: config.template, client: client}
+	}
+}
+
+// Send notifies all sinks of the recipient. A failing sink does not affect the others,
+// an error is only returned if none of the sinks succeeded.
+func (d *Dispatcher) Send(mail *EmailMessage) error {
+	sinks := d.sinks[mail.recipientID]
+	if len(sinks) == 0 {
+		return d.mailServer.Send(mail)
+	}
+	data := newTemplateData(mail, d.recipients[mail.recipientID], time.Now())
+	data.Subject = mail.recipientSubject()
+
+	errs := make([]error, len(sinks))
+	var wg sync.WaitGroup
+	for i, s := range sinks {
+		wg.Add(1)
+		go func(i int, s *dispatchSink) {
+			defer wg.Done()
+			errs[i] = s.sink.Notify(mail, data)
+		}(i, s)
+	}
+	wg.Wait()
+
+	var firstErr error
+	failed := 0
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		log.Printf("ERROR: %v sink of %v failed: %v", sinks[i].kind, mail.recipientID, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed++
+	}
+	if failed == len(sinks) {
+		if failed == 1 {
+			return firstErr
+		}
+		return fmt.Errorf("all %d sinks of %v failed, first error: %v", failed, mail.recipientID, firstErr)
+	}
+	return nil
+}
+
+// Queued implements MailServerInterface, the sinks are only as queued as the mail server
+func (d *Dispatcher) Queued() bool {
+	return d.mailServer.Queued()
+}
+
+// emailSink sends the mail through the transport, or the mail queue in front of it
+type emailSink struct {
+	mailServer MailServerInterface
+}
+
+func (s *emailSink) Notify(mail *EmailMessage, data *TemplateData) error {
+	return s.mailServer.Send(mail)
+}
+
+// webhookSink posts the submission as JSON. The receiver can verify the request with the
+// X-Mailbridge-Signature header, the hex HMAC-SHA256 of the timestamp header, a dot and the body.
+type webhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+type webhookField struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+type webhookAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+}
+
+type webhookPayload struct {
+	RecipientID string               `json:"recipientId"`
+	From        string               `json:"from"`
+	Subject     string               `json:"subject"`
+	Body        string               `json:"body"`
+	Fields      []*webhookField      `json:"fields"`
+	Attachments []*webhookAttachment `json:"attachments,omitempty"`
+	Date        time.Time            `json:"date"`
+	Ticket      string               `json:"ticket,omitempty"`
+}
+
+func (s *webhookSink) Notify(mail *EmailMessage, data *TemplateData) error {
+	payload := &webhookPayload{
+		RecipientID: data.RecipientID,
+		From:        data.From,
+		Subject:     data.Subject,
+		Body:        data.Body,
+		Fields:      []*webhookField{},
+		Date:        data.Date.UTC(),
+		Ticket:      data.Ticket,
+	}
+	for _, field := range data.Fields {
+		payload.Fields = append(payload.Fields, &webhookField{Name: field.Name, Label: field.Label, Value: field.Value})
+	}
+	// the files themselves are only sent by mail
+	for _, attachment := range mail.attachments {
+		payload.Attachments = append(payload.Attachments, &webhookAttachment{Filename: attachment.Filename, ContentType: attachment.ContentType, Size: len(attachment.Data)})
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(data.Date.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mailbridge-Timestamp", timestamp)
+	req.Header.Set("X-Mailbridge-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(s.secret), timestamp+"."+string(body))))
+	return doSinkRequest(s.client, SinkTypeWebhook, req)
+}
+
+// chatSink posts a text message to a Slack or Mattermost incoming webhook
+type chatSink struct {
+	kind     string
+	url      string
+	template *texttemplate.Template
+	client   *http.Client
+}
+
+func (s *chatSink) Notify(mail *EmailMessage, data *TemplateData) error {
+	var text string
+	var err error
+	if s.kind == SinkTypeSlack {
+		text, err = chatText(data, s.template, "*", slackEscaper.Replace)
+	} else {
+		text, err = chatText(data, s.template, "**", escapeMentions)
+	}
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doSinkRequest(s.client, s.kind, req)
+}
+
+// matrixSink sends a text message to a room with the client-server API of the homeserver at url
+type matrixSink struct {
+	url      string
+	room     string
+	token    string
+	template *texttemplate.Template
+	client   *http.Client
+	counter  uint64
+}
+
+func (s *matrixSink) Notify(mail *EmailMessage, data *TemplateData) error {
+	text, err := chatText(data, s.template, "", escapeMentions)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": text})
+	if err != nil {
+		return err
+	}
+	// the transaction ID makes the request idempotent, it has to be unique for the access token
+	txn := fmt.Sprintf("mailbridge.%d.%d", time.Now().UnixNano(), atomic.AddUint64(&s.counter, 1))
+	req, err := http.NewRequest("PUT", s.url+"/_matrix/client/v3/rooms/"+url.PathEscape(s.room)+"/send/m.room.message/"+txn, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	return doSinkRequest(s.client, SinkTypeMatrix, req)
+}
+
+// chatText renders the template of a chat sink. Without a template, the subject is marked as bold,
+// followed by the body and one line per custom field. The submitted values are escaped, a template has to do that itself.
+func chatText(data *TemplateData, template *texttemplate.Template, bold string, escape func(string) string) (string, error) {
+	var text bytes.Buffer
+	if template != nil {
+		if err := template.Execute(&text, data); err != nil {
+			return "", fmt.Errorf("could not render sink template: %v", err)
+		}
+		return text.String(), nil
+	}
+	fmt.Fprintf(&text, "%sNew message from %s: %s%s\n\n%s", bold, escape(data.From), escape(data.Subject), bold, escape(data.Body))
+	if len(data.Fields) > 0 {
+		text.WriteString("\n")
+		for _, field := range data.Fields {
+			fmt.Fprintf(&text, "\n%s%s:%s %s", bold, escape(field.Label), bold, escape(field.Value))
+		}
+	}
+	return text.String(), nil
+}
+
+// escapeMentions breaks up mentions of the whole channel or room with a zero width space
+func escapeMentions(s string) string {
+	return chatMentionRe.ReplaceAllString(s, "@\u200b$1")
+}
+
+// doSinkRequest sends the request of a sink and maps the status of the response to an error
+func doSinkRequest(client *http.Client, kind string, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, apiErrorLength))
+	return apiError(kind+" sink", resp.StatusCode, body)
+}
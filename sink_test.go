@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSink_LoadConfig(t *testing.T) {
+	t.Parallel()
+	invalid := []*SinkConfig{
+		{Type: "pager", URL: "https://example.com/"},
+		{Type: SinkTypeWebhook, URL: "https://example.com/hook"},
+		{Type: SinkTypeSlack, URL: "hooks.slack.com/services/x"},
+		{Type: SinkTypeMattermost, URL: "ftp://example.com/hook"},
+		{Type: SinkTypeMatrix, URL: "https://matrix.example.com", Room: "!room:example.com"},
+		{Type: SinkTypeSlack, URL: "https://example.com/hook", Template: "/does/not/exist.txt"},
+	}
+	for _, sink := range invalid {
+		if err := sink.load(); err == nil {
+			t.Errorf("Error: invalid sink %+v should not load", sink)
+		}
+	}
+	valid := []*SinkConfig{
+		{Type: SinkTypeEmail},
+		{Type: SinkTypeWebhook, URL: "https://example.com/hook", Secret: "secret"},
+		{Type: SinkTypeSlack, URL: "https://hooks.slack.com/services/x"},
+		{Type: SinkTypeMatrix, URL: "https://matrix.example.com", Room: "!room:example.com", Token: "token"},
+	}
+	for _, sink := range valid {
+		if err := sink.load(); err != nil {
+			t.Errorf("Error loading valid sink %+v: %v", sink, err)
+		}
+	}
+}
+
+func TestDispatcher_WithoutSinks(t *testing.T) {
+	t.Parallel()
+	ms := &MockMailServer{}
+	d := newTestDispatcher(ms, &SinkConfig{Type: SinkTypeWebhook, URL: "http://127.0.0.1:1/", Secret: "secret"})
+	mail := newTestMessage()
+	mail.recipientID = "id2"
+	if err := d.Send(mail); err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+	if ms.sent != mail {
+		t.Errorf("A recipient without sinks must get the mail")
+	}
+}
+
+func TestDispatcher_Webhook(t *testing.T) {
+	t.Parallel()
+	server := newTestSinkServer(t, http.StatusOK)
+	defer server.Close()
+
+	ms := &MockMailServer{}
+	d := newTestDispatcher(ms,
+		&SinkConfig{Type: SinkTypeEmail},
+		&SinkConfig{Type: SinkTypeWebhook, URL: server.URL + "/hook", Secret: "secret"},
+	)
+	mail := newTestMessage()
+	mail.fields = map[string]string{"phone": "0123"}
+	mail.attachments = []*Attachment{{Filename: "a.pdf", ContentType: "application/pdf", Data: []byte("%PDF")}}
+	if err := d.Send(mail); err != nil {
+		t.Fatalf("Error sending to the sinks: %v", err)
+	}
+	if ms.sent != mail {
+		t.Errorf("The email sink did not send the mail")
+	}
+
+	req := server.request(t)
+	timestamp := req.header.Get("X-Mailbridge-Timestamp")
+	signature := "sha256=" + hex.EncodeToString(hmacSHA256([]byte("secret"), timestamp+"."+req.body))
+	if timestamp == "" || req.header.Get("X-Mailbridge-Signature") != signature {
+		t.Errorf("Invalid signature %q for timestamp %q", req.header.Get("X-Mailbridge-Signature"), timestamp)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(req.body), &payload); err != nil {
+		t.Fatalf("Error parsing the webhook payload: %v", err)
+	}
+	if payload.RecipientID != "id1" || payload.Subject != mail.subject || payload.Body != mail.body {
+		t.Errorf("Unexpected webhook payload %+v", payload)
+	}
+	if len(payload.Fields) != 1 || payload.Fields[0].Value != "0123" {
+		t.Errorf("Expected the phone field in the payload, got %+v", payload.Fields)
+	}
+	if len(payload.Attachments) != 1 || payload.Attachments[0].Size != 4 {
+		t.Errorf("Expected the attachment without its data in the payload, got %+v", payload.Attachments)
+	}
+}
+
+func TestDispatcher_ChatFormatting(t *testing.T) {
+	t.Parallel()
+	server := newTestSinkServer(t, http.StatusOK)
+	defer server.Close()
+
+	// slack mentions are written as <!channel>, mattermost mentions as @channel
+	sinks := []struct {
+		sink    *SinkConfig
+		prefix  string
+		mention string
+	}{
+		{&SinkConfig{Type: SinkTypeSlack, URL: server.URL + "/slack"}, "*New message from ", "<!channel>"},
+		{&SinkConfig{Type: SinkTypeMattermost, URL: server.URL + "/mattermost"}, "**New message from", "@channel"},
+	}
+	for _, test := range sinks {
+		sink := test.sink
+		d := newTestDispatcher(&MockMailServer{}, sink)
+		mail := newTestMessage()
+		mail.body = "<!channel> @channel please call back"
+		if err := d.Send(mail); err != nil {
+			t.Fatalf("Error sending to the %v sink: %v", sink.Type, err)
+		}
+		var message map[string]string
+		if err := json.Unmarshal([]byte(server.request(t).body), &message); err != nil {
+			t.Fatalf("Error parsing the %v message: %v", sink.Type, err)
+		}
+		text := message["text"]
+		if !strings.HasPrefix(text, test.prefix) {
+			t.Errorf("Unexpected %v message %q", sink.Type, text)
+		}
+		if strings.Contains(text, test.mention) {
+			t.Errorf("Channel mention was not escaped in the %v message %q", sink.Type, text)
+		}
+	}
+}
+
+func TestDispatcher_Matrix(t *testing.T) {
+	t.Parallel()
+	server := newTestSinkServer(t, http.StatusOK)
+	defer server.Close()
+
+	d := newTestDispatcher(&MockMailServer{}, &SinkConfig{Type: SinkTypeMatrix, URL: server.URL + "/", Room: "!room:example.com", Token: "token"})
+	for i := 0; i < 2; i++ {
+		if err := d.Send(newTestMessage()); err != nil {
+			t.Fatalf("Error sending to the matrix sink: %v", err)
+		}
+	}
+	first, second := server.request(t), server.request(t)
+	if first.method != "PUT" || !strings.HasPrefix(first.path, "/_matrix/client/v3/rooms/%21room:example.com/send/m.room.message/") {
+		t.Errorf("Unexpected matrix request %v %v", first.method, first.path)
+	}
+	if first.path == second.path {
+		t.Errorf("Matrix transaction IDs must be unique")
+	}
+	if first.header.Get("Authorization") != "Bearer token" {
+		t.Errorf("Missing access token in %v", first.header)
+	}
+	if !strings.Contains(first.body, `"msgtype":"m.text"`) {
+		t.Errorf("Unexpected matrix message %v", first.body)
+	}
+}
+
+func TestDispatcher_FailureIsolation(t *testing.T) {
+	t.Parallel()
+	broken := newTestSinkServer(t, http.StatusInternalServerError)
+	defer broken.Close()
+
+	ms := &MockMailServer{}
+	d := newTestDispatcher(ms,
+		&SinkConfig{Type: SinkTypeSlack, URL: broken.URL},
+		&SinkConfig{Type: SinkTypeEmail},
+	)
+	if err := d.Send(newTestMessage()); err != nil {
+		t.Errorf("A broken sink must not fail the submission: %v", err)
+	}
+	if ms.sent == nil {
+		t.Errorf("The email sink was not notified")
+	}
+
+	// the error is returned if all sinks failed
+	failing := &FailingMailServer{failures: -1}
+	d = newTestDispatcher(failing,
+		&SinkConfig{Type: SinkTypeSlack, URL: broken.URL},
+		&SinkConfig{Type: SinkTypeEmail},
+	)
+	if err := d.Send(newTestMessage()); err == nil {
+		t.Errorf("Error: send succeeded without a working sink")
+	}
+}
+
+func TestDispatcher_Queued(t *testing.T) {
+	t.Parallel()
+	queue := &MailQueue{}
+	if !queue.Queued() || !(&Dispatcher{mailServer: queue}).Queued() || !(&AutoResponder{mailServer: queue}).Queued() {
+		t.Errorf("Error: the mail queue was not detected")
+	}
+	if (&MockMailServer{}).Queued() || (&Dispatcher{mailServer: &MockMailServer{}}).Queued() {
+		t.Errorf("Error: a mail server without queue was detected as queue")
+	}
+}
+
+// HELPER METHODS
+func newTestDispatcher(mailServer MailServerInterface, sinks ...*SinkConfig) *Dispatcher {
+	config := &ApplicationConfig{
+		RecipientMap:     map[string]string{"id1": "to@example.com", "id2": "other@example.com"},
+		RecipientOptions: map[string]*RecipientOptions{"id1": {Sinks: sinks}},
+	}
+	return InitDispatcher(config, mailServer)
+}
+
+// testSinkRequest is a request that the test sink server received
+type testSinkRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+// testSinkServer answers every request with its status and records it
+type testSinkServer struct {
+	*httptest.Server
+	requests chan *testSinkRequest
+}
+
+func newTestSinkServer(t *testing.T, status int) *testSinkServer {
+	s := &testSinkServer{requests: make(chan *testSinkRequest, 10)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests <- &testSinkRequest{method: r.Method, path: r.URL.EscapedPath(), header: r.Header, body: string(body)}
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func (s *testSinkServer) request(t *testing.T) *testSinkRequest {
+	select {
+	case req := <-s.requests:
+		return req
+	default:
+		t.Fatalf("Error: the sink server received no request")
+		return nil
+	}
+}
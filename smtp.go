@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+const (
+	// SMTPTLSNone sends everything in plaintext
+	SMTPTLSNone = "none"
+	// SMTPTLSStartTLS upgrades the connection with STARTTLS if the server offers it
+	SMTPTLSStartTLS = "starttls"
+	// SMTPTLSRequireStartTLS upgrades the connection with STARTTLS and fails if the server does not offer it
+	SMTPTLSRequireStartTLS = "starttls-required"
+	// SMTPTLSImplicit speaks TLS right from the start, usually on port 465
+	SMTPTLSImplicit = "tls"
+
+	// smtpDialTimeout is the maximal time to establish the connection to the SMTP server
+	smtpDialTimeout = 30 * time.Second
+	// smtpTimeout is the maximal time for the greeting, a transaction or a single command on an established
+	// connection, so that a stalled server cannot block a delivery forever (RFC 5321 suggests 5 minutes)
+	smtpTimeout = 5 * time.Minute
+	// defaultSMTPAcquireTimeout is the time in seconds that a mail waits for a free connection slot
+	defaultSMTPAcquireTimeout = 5
+)
+
+// tlsVersions maps the configurable minimal TLS versions to their constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// SMTPConfig holds the settings for the connection to a SMTP server
+type SMTPConfig struct {
+	SMTPHost               string `json:"smtpHost"`
+	SMTPPort               string `json:"smtpPort"`
+	SMTPAuthUser           string `json:"smtpAuthUser"`
+	SMTPAuthPassword       string `json:"smtpAuthPassword"`
+	SMTPAuth               string `json:"smtpAuth"`
+	SMTPAuthTokenFile      string `json:"smtpAuthTokenFile"`
+	SMTPTLS                string `json:"smtpTLS"`
+	SMTPTLSMinVersion      string `json:"smtpTLSMinVersion"`
+	SMTPCACert             string `json:"smtpCACert"`
+	SMTPClientCert         string `json:"smtpClientCert"`
+	SMTPClientKey          string `json:"smtpClientKey"`
+	SMTPInsecureSkipVerify bool   `json:"smtpInsecureSkipVerify"`
+	SMTPMaxConnections     int    `json:"smtpMaxConnections"`
+	SMTPIdleTimeout        int    `json:"smtpIdleTimeout"`
+	SMTPAcquireTimeout     int    `json:"smtpAcquireTimeout"`
+}
+
+// tlsMode returns the configured TLS mode, opportunistic STARTTLS by default
+func (c *SMTPConfig) tlsMode() string {
+	if c.SMTPTLS == "" {
+		return SMTPTLSStartTLS
+	}
+	return c.SMTPTLS
+}
+
+// validate checks the TLS and auth settings that can be checked without reading any files
+func (c *SMTPConfig) validate() error {
+	if err := c.validateAuth(); err != nil {
+		return err
+	}
+	switch c.tlsMode() {
+	case SMTPTLSNone, SMTPTLSStartTLS, SMTPTLSRequireStartTLS, SMTPTLSImplicit:
+	default:
+		return fmt.Errorf("unknown smtpTLS mode %q", c.SMTPTLS)
+	}
+	if _, ok := tlsVersions[c.SMTPTLSMinVersion]; c.SMTPTLSMinVersion != "" && !ok {
+		return fmt.Errorf("unknown smtpTLSMinVersion %q", c.SMTPTLSMinVersion)
+	}
+	if (c.SMTPClientCert == "") != (c.SMTPClientKey == "") {
+		return errors.New("smtpClientCert and smtpClientKey must be given together")
+	}
+	return nil
+}
+
+// tlsConfig builds the TLS configuration for the connection to the SMTP server.
+// The certificate of the server is verified against the system roots or the configured CA bundle.
+func (c *SMTPConfig) tlsConfig() (*tls.Config, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName:         c.SMTPHost,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.SMTPInsecureSkipVerify,
+	}
+	if c.SMTPTLSMinVersion != "" {
+		config.MinVersion = tlsVersions[c.SMTPTLSMinVersion]
+	}
+	if c.SMTPCACert != "" {
+		pem, err := ioutil.ReadFile(c.SMTPCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", c.SMTPCACert)
+		}
+		config.RootCAs = pool
+	}
+	if c.SMTPClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.SMTPClientCert, c.SMTPClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dialSMTP connects to the SMTP server and secures the connection according to the TLS mode.
+// The localName is sent with EHLO, net/smtp sends localhost if it is empty. The handshake has to be completed
+// within the timeout, the deadline stays set on the returned connection until the caller extends it.
+func dialSMTP(host string, port string, mode string, tlsConfig *tls.Config, localName string, timeout time.Duration) (*smtp.Client, net.Conn, error) {
+	address := net.JoinHostPort(host, port)
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if mode == SMTPTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if localName != "" {
+		if err := client.Hello(localName); err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+	}
+
+	if mode == SMTPTLSStartTLS || mode == SMTPTLSRequireStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, nil, fmt.Errorf("STARTTLS with %v failed: %v", address, err)
+			}
+		} else if mode == SMTPTLSRequireStartTLS {
+			client.Close()
+			return nil, nil, fmt.Errorf("%v does not offer STARTTLS", address)
+		} else {
+			log.Printf("WARNING: %v does not offer STARTTLS, sending in plaintext", address)
+		}
+	}
+	return client, conn, nil
+}
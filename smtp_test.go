@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMailServer_SendTLSModes(t *testing.T) {
+	t.Parallel()
+	dir := tempCertDir(t)
+	defer os.RemoveAll(dir)
+	serverCert := newTestCertificate(t, dir, "server", x509.ExtKeyUsageServerAuth)
+
+	tests := []struct {
+		name        string
+		mode        string
+		startTLS    bool
+		implicitTLS bool
+		ok          bool
+		encrypted   bool
+	}{
+		{"none", SMTPTLSNone, true, false, true, false},
+		{"opportunistic", SMTPTLSStartTLS, true, false, true, true},
+		{"opportunistic without STARTTLS", SMTPTLSStartTLS, false, false, true, false},
+		{"required", SMTPTLSRequireStartTLS, true, false, true, true},
+		{"required without STARTTLS", SMTPTLSRequireStartTLS, false, false, false, false},
+		{"implicit", SMTPTLSImplicit, false, true, true, true},
+		{"implicit against plaintext server", SMTPTLSImplicit, false, false, false, false},
+	}
+	for _, test := range tests {
+		server := &fakeSMTPServer{certificate: serverCert, startTLS: test.startTLS, implicitTLS: test.implicitTLS}
+		server.start(t)
+		config := server.config()
+		config.SMTPTLS = test.mode
+		config.SMTPCACert = serverCert.certFile
+
+		err := sendTestMail(t, config)
+		server.close()
+		if test.ok != (err == nil) {
+			t.Errorf("%s: unexpected result of Send: %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		messages := server.delivered()
+		if len(messages) != 1 {
+			t.Errorf("%s: expected 1 delivered message, got %d", test.name, len(messages))
+			continue
+		}
+		if messages[0].encrypted != test.encrypted {
+			t.Errorf("%s: message was sent with encryption %v but should be %v", test.name, messages[0].encrypted, test.encrypted)
+		}
+	}
+}
+
+func TestMailServer_VerifyCertificate(t *testing.T) {
+	t.Parallel()
+	dir := tempCertDir(t)
+	defer os.RemoveAll(dir)
+	serverCert := newTestCertificate(t, dir, "server", x509.ExtKeyUsageServerAuth)
+
+	server := &fakeSMTPServer{certificate: serverCert, startTLS: true}
+	server.start(t)
+	defer server.close()
+
+	// the self signed certificate is not trusted by the system roots
+	config := server.config()
+	if err := sendTestMail(t, config); err == nil {
+		t.Errorf("Error: mail was sent to a server with an untrusted certificate")
+	}
+
+	// unless verification is turned off explicitly
+	config.SMTPInsecureSkipVerify = true
+	if err := sendTestMail(t, config); err != nil {
+		t.Errorf("Error sending mail without verification: %v", err)
+	}
+}
+
+func TestMailServer_TLSMinVersion(t *testing.T) {
+	t.Parallel()
+	dir := tempCertDir(t)
+	defer os.RemoveAll(dir)
+	serverCert := newTestCertificate(t, dir, "server", x509.ExtKeyUsageServerAuth)
+
+	server := &fakeSMTPServer{certificate: serverCert, startTLS: true, maxVersion: tls.VersionTLS12}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPCACert = serverCert.certFile
+	config.SMTPTLSMinVersion = "1.3"
+	if err := sendTestMail(t, config); err == nil {
+		t.Errorf("Error: mail was sent with a TLS version below the minimum")
+	}
+	config.SMTPTLSMinVersion = "1.2"
+	if err := sendTestMail(t, config); err != nil {
+		t.Errorf("Error sending mail with TLS 1.2: %v", err)
+	}
+}
+
+func TestMailServer_ClientCertificate(t *testing.T) {
+	t.Parallel()
+	dir := tempCertDir(t)
+	defer os.RemoveAll(dir)
+	serverCert := newTestCertificate(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCertificate(t, dir, "client", x509.ExtKeyUsageClientAuth)
+
+	server := &fakeSMTPServer{certificate: serverCert, clientCA: clientCert, implicitTLS: true}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSImplicit
+	config.SMTPCACert = serverCert.certFile
+	if err := sendTestMail(t, config); err == nil {
+		t.Errorf("Error: mail was sent without the required client certificate")
+	}
+	config.SMTPClientCert = clientCert.certFile
+	config.SMTPClientKey = clientCert.keyFile
+	if err := sendTestMail(t, config); err != nil {
+		t.Errorf("Error sending mail with client certificate: %v", err)
+	}
+}
+
+func TestSMTPConfig_Validate(t *testing.T) {
+	t.Parallel()
+	invalid := map[string]*SMTPConfig{
+		"mode":        {SMTPTLS: "ssl"},
+		"min version": {SMTPTLSMinVersion: "1.4"},
+		"cert no key": {SMTPClientCert: "client.pem"},
+		"auth":        {SMTPAuth: "gssapi"},
+		"no user":     {SMTPAuth: SMTPAuthLogin},
+		"no token":    {SMTPAuth: SMTPAuthXOAUTH2, SMTPAuthUser: "user"},
+	}
+	for name, config := range invalid {
+		if err := config.validate(); err == nil {
+			t.Errorf("%s: invalid SMTP config validated", name)
+		}
+	}
+	valid := &SMTPConfig{SMTPTLS: SMTPTLSImplicit, SMTPTLSMinVersion: "1.3"}
+	if err := valid.validate(); err != nil {
+		t.Errorf("Error validating SMTP config: %v", err)
+	}
+	if mode := (&SMTPConfig{}).tlsMode(); mode != SMTPTLSStartTLS {
+		t.Errorf("Default TLS mode is %v but should be %v", mode, SMTPTLSStartTLS)
+	}
+}
+
+// HELPER METHODS
+
+// fakeSMTPServer is a minimal SMTP server on localhost that records the delivered messages
+type fakeSMTPServer struct {
+	certificate *testCertificate
+	clientCA    *testCertificate
+	maxVersion  uint16
+	startTLS    bool
+	implicitTLS bool
+	users       map[string]string
+	auth        []string
+	pipelining  bool
+	maxMessages int
+	rcptReply   string
+	address     string
+	connections int
+	messages    []*fakeSMTPMessage
+	listener    net.Listener
+	wg          sync.WaitGroup
+	sync.Mutex
+}
+
+// fakeSMTPMessage is a message that has been delivered to the fakeSMTPServer
+type fakeSMTPMessage struct {
+	from      string
+	to        []string
+	data      string
+	encrypted bool
+	user      string
+	mechanism string
+	helo      string
+}
+
+func (s *fakeSMTPServer) start(t *testing.T) {
+	address := s.address
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Error starting fake SMTP server: %v", err)
+	}
+	if s.implicitTLS {
+		listener = tls.NewListener(listener, s.tlsConfig())
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.connections++
+			s.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+}
+
+func (s *fakeSMTPServer) close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// connectionCount returns the number of accepted connections
+func (s *fakeSMTPServer) connectionCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.connections
+}
+
+// delivered returns the messages that have been delivered so far
+func (s *fakeSMTPServer) delivered() []*fakeSMTPMessage {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*fakeSMTPMessage(nil), s.messages...)
+}
+
+// config returns SMTP settings that point to the fake server
+func (s *fakeSMTPServer) config() *SMTPConfig {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &SMTPConfig{SMTPHost: host, SMTPPort: port}
+}
+
+func (s *fakeSMTPServer) tlsConfig() *tls.Config {
+	config := &tls.Config{Certificates: []tls.Certificate{s.certificate.cert}, MaxVersion: s.maxVersion}
+	if s.clientCA != nil {
+		config.ClientCAs = s.clientCA.pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, encrypted := conn.(*tls.Conn)
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost fake ESMTP")
+
+	var user, mechanism, helo string
+	var count int
+	var message *fakeSMTPMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			helo = arg
+			extensions := []string{"localhost"}
+			if s.startTLS && !encrypted {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if s.pipelining {
+				extensions = append(extensions, "PIPELINING")
+			}
+			if s.users != nil {
+				extensions = append(extensions, "AUTH "+strings.Join(s.mechanisms(), " "))
+			}
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+				text.PrintfLine("250%s%s", separator, extension)
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig())
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, encrypted = tlsConn, true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			if name, ok := s.authenticate(text, arg); ok {
+				user, mechanism = name, strings.Fields(arg)[0]
+				text.PrintfLine("235 authenticated")
+			} else {
+				text.PrintfLine("535 authentication failed")
+			}
+		case "MAIL":
+			message = &fakeSMTPMessage{from: arg, encrypted: encrypted, user: user, mechanism: mechanism, helo: helo}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rcptReply != "" {
+				text.PrintfLine("%s", s.rcptReply)
+				continue
+			}
+			message.to = append(message.to, arg)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			if len(message.to) == 0 {
+				text.PrintfLine("554 no valid recipients")
+				continue
+			}
+			text.PrintfLine("354 go ahead")
+			data, err := ioutil.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			message.data = string(data)
+			s.Lock()
+			s.messages = append(s.messages, message)
+			s.Unlock()
+			text.PrintfLine("250 OK")
+			// drop the connection without notice, like a server side timeout
+			count++
+			if s.maxMessages > 0 && count >= s.maxMessages {
+				return
+			}
+		case "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// mechanisms returns the offered auth mechanisms, PLAIN by default
+func (s *fakeSMTPServer) mechanisms() []string {
+	if len(s.auth) == 0 {
+		return []string{"PLAIN"}
+	}
+	return s.auth
+}
+
+// authenticate runs the server side of an AUTH command and returns the authenticated user
+func (s *fakeSMTPServer) authenticate(text *textproto.Conn, arg string) (string, bool) {
+	fields := strings.Fields(arg)
+	mechanism := strings.ToUpper(fields[0])
+	offered := false
+	for _, m := range s.mechanisms() {
+		offered = offered || m == mechanism
+	}
+	if !offered {
+		return "", false
+	}
+	decode := func(s string) string {
+		decoded, _ := base64.StdEncoding.DecodeString(s)
+		return string(decoded)
+	}
+	challenge := func(prompt string) string {
+		text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, _ := text.ReadLine()
+		return decode(line)
+	}
+	initial := ""
+	if len(fields) > 1 {
+		initial = decode(fields[1])
+	}
+
+	switch mechanism {
+	case "PLAIN":
+		parts := strings.SplitN(initial, "\x00", 3)
+		if len(parts) != 3 {
+			return "", false
+		}
+		return parts[1], s.checkPassword(parts[1], parts[2])
+	case "LOGIN":
+		user := challenge("Username:")
+		return user, s.checkPassword(user, challenge("Password:"))
+	case "CRAM-MD5":
+		const nonce = "<1234.5678@localhost>"
+		parts := strings.Fields(challenge(nonce))
+		if len(parts) != 2 {
+			return "", false
+		}
+		mac := hmac.New(md5.New, []byte(s.users[parts[0]]))
+		mac.Write([]byte(nonce))
+		return parts[0], s.users[parts[0]] != "" && hex.EncodeToString(mac.Sum(nil)) == parts[1]
+	case "XOAUTH2":
+		var user, token string
+		for _, part := range strings.Split(initial, "\x01") {
+			if strings.HasPrefix(part, "user=") {
+				user = strings.TrimPrefix(part, "user=")
+			}
+			if strings.HasPrefix(part, "auth=Bearer ") {
+				token = strings.TrimPrefix(part, "auth=Bearer ")
+			}
+		}
+		if !s.checkPassword(user, token) {
+			challenge(`{"status":"401","schemes":"bearer"}`)
+			return "", false
+		}
+		return user, true
+	}
+	return "", false
+}
+
+func (s *fakeSMTPServer) checkPassword(user string, password string) bool {
+	expected, ok := s.users[user]
+	return ok && expected == password
+}
+
+// testCertificate is a self signed certificate for 127.0.0.1 that is written to PEM files
+type testCertificate struct {
+	certFile string
+	keyFile  string
+	cert     tls.Certificate
+	pool     *x509.CertPool
+}
+
+func newTestCertificate(t *testing.T, dir string, name string, usage x509.ExtKeyUsage) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	c := &testCertificate{certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key"), pool: x509.NewCertPool()}
+	if err := ioutil.WriteFile(c.certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(c.keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	if c.cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+	c.pool.AppendCertsFromPEM(certPEM)
+	return c
+}
+
+func tempCertDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mailbridge-certs")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	return dir
+}
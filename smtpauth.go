@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"strings"
+)
+
+const (
+	// SMTPAuthAuto picks the best mechanism that the server offers, or none if no credentials are configured
+	SMTPAuthAuto = "auto"
+	// SMTPAuthNone does not authenticate, e.g. for a MTA on localhost
+	SMTPAuthNone = "none"
+	// SMTPAuthPlain is AUTH PLAIN
+	SMTPAuthPlain = "plain"
+	// SMTPAuthLogin is the non standard but widespread AUTH LOGIN
+	SMTPAuthLogin = "login"
+	// SMTPAuthCRAMMD5 is AUTH CRAM-MD5, the password is not sent over the wire
+	SMTPAuthCRAMMD5 = "cram-md5"
+	// SMTPAuthXOAUTH2 authenticates with an OAuth2 bearer token
+	SMTPAuthXOAUTH2 = "xoauth2"
+)
+
+var (
+	// smtpAuthPreference is the order in which auto negotiation picks a mechanism from the ones the server offers
+	// on an unencrypted connection, CRAM-MD5 does not send the password
+	smtpAuthPreference = []string{SMTPAuthCRAMMD5, SMTPAuthPlain, SMTPAuthLogin}
+	// smtpAuthTLSPreference is the order on a TLS connection. CRAM-MD5 needs passwords that the server can decrypt
+	// and often fails on servers that offer it, so it comes last.
+	smtpAuthTLSPreference = []string{SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5}
+)
+
+// authMechanism returns the configured auth mechanism, auto negotiation by default
+func (c *SMTPConfig) authMechanism() string {
+	if c.SMTPAuth == "" {
+		return SMTPAuthAuto
+	}
+	return strings.ToLower(c.SMTPAuth)
+}
+
+// validateAuth checks the auth mechanism and the credentials it needs
+func (c *SMTPConfig) validateAuth() error {
+	switch c.authMechanism() {
+	case SMTPAuthAuto, SMTPAuthNone:
+	case SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5:
+		if c.SMTPAuthUser == "" {
+			return fmt.Errorf("smtpAuth %v needs a smtpAuthUser", c.SMTPAuth)
+		}
+	case SMTPAuthXOAUTH2:
+		if c.SMTPAuthUser == "" || c.SMTPAuthTokenFile == "" {
+			return fmt.Errorf("smtpAuth %v needs a smtpAuthUser and a smtpAuthTokenFile", c.SMTPAuth)
+		}
+	default:
+		return fmt.Errorf("unknown smtpAuth mechanism %q", c.SMTPAuth)
+	}
+	return nil
+}
+
+// authenticate authenticates the client with the configured mechanism.
+// With auto negotiation, the mechanism is picked from the AUTH extension of the EHLO response.
+func (server *MailServer) authenticate(client *smtp.Client) error {
+	mechanism := server.authMechanism
+	if mechanism == SMTPAuthNone {
+		return nil
+	}
+	if mechanism == SMTPAuthAuto {
+		if server.authUser == "" {
+			return nil
+		}
+		ok, offered := client.Extension("AUTH")
+		if !ok {
+			return fmt.Errorf("%v does not offer authentication", server.host)
+		}
+		_, encrypted := client.TLSConnectionState()
+		mechanism = server.negotiateAuth(strings.Fields(strings.ToLower(offered)), encrypted)
+		if mechanism == "" {
+			return fmt.Errorf("%v offers no supported auth mechanism: %v", server.host, offered)
+		}
+	}
+
+	var auth smtp.Auth
+	switch mechanism {
+	case SMTPAuthPlain:
+		auth = smtp.PlainAuth("", server.authUser, server.authPassword, server.host)
+	case SMTPAuthLogin:
+		auth = &loginAuth{username: server.authUser, password: server.authPassword}
+	case SMTPAuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(server.authUser, server.authPassword)
+	case SMTPAuthXOAUTH2:
+		// the token is read for every connection, so that it can be refreshed by an external process
+		token, err := ioutil.ReadFile(server.authTokenFile)
+		if err != nil {
+			return err
+		}
+		auth = &xoauth2Auth{username: server.authUser, token: strings.TrimSpace(string(token))}
+	}
+	return client.Auth(auth)
+}
+
+// negotiateAuth returns the preferred mechanism out of the offered ones, or an empty string
+func (server *MailServer) negotiateAuth(offered []string, encrypted bool) string {
+	preference := smtpAuthPreference
+	if encrypted {
+		preference = smtpAuthTLSPreference
+	}
+	if server.authTokenFile != "" {
+		preference = []string{SMTPAuthXOAUTH2}
+	}
+	for _, mechanism := range preference {
+		for _, o := range offered {
+			if o == mechanism {
+				return mechanism
+			}
+		}
+	}
+	return ""
+}
+
+// checkEncrypted refuses to send credentials over an unencrypted connection to a remote host, like smtp.PlainAuth does
+func checkEncrypted(server *smtp.ServerInfo) error {
+	if server.TLS || server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1" {
+		return nil
+	}
+	return errors.New("unencrypted connection")
+}
+
+// loginAuth implements smtp.Auth for AUTH LOGIN
+type loginAuth struct {
+	username string
+	password string
+}
+
+// Start begins the authentication, the credentials are sent on the challenges of the server
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkEncrypted(server); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next answers the Username: and Password: challenges
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
+
+// xoauth2Auth implements smtp.Auth for AUTH XOAUTH2
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+// Start sends the user and the bearer token as initial response
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkEncrypted(server); err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers an error challenge with an empty response, the server then finishes with the final error
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMailServer_AuthOverTLS(t *testing.T) {
+	t.Parallel()
+	dir := tempCertDir(t)
+	defer os.RemoveAll(dir)
+	serverCert := newTestCertificate(t, dir, "server", x509.ExtKeyUsageServerAuth)
+
+	server := &fakeSMTPServer{certificate: serverCert, startTLS: true, users: map[string]string{"user": "secret"}}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSRequireStartTLS
+	config.SMTPCACert = serverCert.certFile
+	config.SMTPAuthUser = "user"
+	config.SMTPAuthPassword = "wrong"
+	if err := sendTestMail(t, config); err == nil {
+		t.Errorf("Error: mail was sent with a wrong password")
+	}
+	config.SMTPAuthPassword = "secret"
+	if err := sendTestMail(t, config); err != nil {
+		t.Fatalf("Error sending authenticated mail: %v", err)
+	}
+	messages := server.delivered()
+	if len(messages) != 1 || messages[0].user != "user" || !messages[0].encrypted {
+		t.Errorf("Message was not sent authenticated over TLS: %+v", messages)
+	}
+}
+
+func TestMailServer_AuthMechanisms(t *testing.T) {
+	t.Parallel()
+	dir := tempCertDir(t)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	wrongTokenFile := filepath.Join(dir, "wrong-token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Error writing token file: %v", err)
+	}
+	if err := ioutil.WriteFile(wrongTokenFile, []byte("expired"), 0600); err != nil {
+		t.Fatalf("Error writing token file: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		auth      string
+		offered   []string
+		password  string
+		tokenFile string
+		mechanism string
+	}{
+		{"auto prefers CRAM-MD5", SMTPAuthAuto, []string{"PLAIN", "LOGIN", "CRAM-MD5"}, "secret", "", "CRAM-MD5"},
+		{"auto falls back to LOGIN", "", []string{"LOGIN"}, "secret", "", "LOGIN"},
+		{"auto with token", SMTPAuthAuto, []string{"PLAIN", "XOAUTH2"}, "", tokenFile, "XOAUTH2"},
+		{"plain", SMTPAuthPlain, []string{"PLAIN", "CRAM-MD5"}, "secret", "", "PLAIN"},
+		{"login", SMTPAuthLogin, []string{"PLAIN", "LOGIN"}, "secret", "", "LOGIN"},
+		{"cram-md5", "CRAM-MD5", []string{"CRAM-MD5"}, "secret", "", "CRAM-MD5"},
+		{"xoauth2", SMTPAuthXOAUTH2, []string{"XOAUTH2"}, "", tokenFile, "XOAUTH2"},
+		{"none", SMTPAuthNone, []string{"PLAIN"}, "secret", "", ""},
+		{"cram-md5 wrong password", SMTPAuthCRAMMD5, []string{"CRAM-MD5"}, "wrong", "", "error"},
+		{"login wrong password", SMTPAuthLogin, []string{"LOGIN"}, "wrong", "", "error"},
+		{"xoauth2 wrong token", SMTPAuthXOAUTH2, []string{"XOAUTH2"}, "", wrongTokenFile, "error"},
+		{"xoauth2 missing token", SMTPAuthXOAUTH2, []string{"XOAUTH2"}, "", tokenFile + ".missing", "error"},
+		{"auto without supported mechanism", SMTPAuthAuto, []string{"GSSAPI"}, "secret", "", "error"},
+	}
+	for _, test := range tests {
+		server := &fakeSMTPServer{users: map[string]string{"user": "secret"}, auth: test.offered}
+		server.start(t)
+		config := server.config()
+		config.SMTPTLS = SMTPTLSNone
+		config.SMTPAuth = test.auth
+		config.SMTPAuthUser = "user"
+		config.SMTPAuthPassword = test.password
+		config.SMTPAuthTokenFile = test.tokenFile
+
+		err := sendTestMail(t, config)
+		server.close()
+		if test.mechanism == "error" {
+			if err == nil {
+				t.Errorf("%s: mail was sent without valid authentication", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error sending mail: %v", test.name, err)
+			continue
+		}
+		if messages := server.delivered(); len(messages) != 1 || messages[0].mechanism != test.mechanism {
+			t.Errorf("%s: message was not authenticated with %q: %+v", test.name, test.mechanism, messages)
+		}
+	}
+}
+
+func TestMailServer_NegotiateAuth(t *testing.T) {
+	t.Parallel()
+	server := &MailServer{authUser: "user"}
+	offered := []string{SMTPAuthCRAMMD5, SMTPAuthLogin, SMTPAuthPlain}
+	if mechanism := server.negotiateAuth(offered, true); mechanism != SMTPAuthPlain {
+		t.Errorf("Error: auto negotiation over TLS picked %v instead of PLAIN", mechanism)
+	}
+	if mechanism := server.negotiateAuth([]string{SMTPAuthCRAMMD5, SMTPAuthLogin}, true); mechanism != SMTPAuthLogin {
+		t.Errorf("Error: auto negotiation over TLS picked %v instead of LOGIN", mechanism)
+	}
+	if mechanism := server.negotiateAuth([]string{SMTPAuthCRAMMD5}, true); mechanism != SMTPAuthCRAMMD5 {
+		t.Errorf("Error: auto negotiation over TLS picked %v instead of CRAM-MD5", mechanism)
+	}
+	if mechanism := server.negotiateAuth(offered, false); mechanism != SMTPAuthCRAMMD5 {
+		t.Errorf("Error: auto negotiation without TLS picked %v instead of CRAM-MD5", mechanism)
+	}
+}
+
+func TestMailServer_NoAuthOffered(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{}
+	server.start(t)
+	defer server.close()
+
+	// a local MTA without authentication
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	if err := sendTestMail(t, config); err != nil {
+		t.Errorf("Error sending mail without credentials: %v", err)
+	}
+	// configured credentials must not be ignored silently
+	config.SMTPAuthUser = "user"
+	config.SMTPAuthPassword = "secret"
+	if err := sendTestMail(t, config); err == nil {
+		t.Errorf("Error: credentials were ignored by a server without authentication")
+	}
+}
+
+func TestSMTPAuth_RequiresEncryption(t *testing.T) {
+	t.Parallel()
+	mechanisms := map[string]smtp.Auth{
+		"LOGIN":   &loginAuth{username: "user", password: "secret"},
+		"XOAUTH2": &xoauth2Auth{username: "user", token: "secret"},
+	}
+	for name, auth := range mechanisms {
+		if _, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", Auth: []string{name}}); err == nil {
+			t.Errorf("%s: credentials would be sent over an unencrypted connection", name)
+		}
+		if _, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{name}}); err != nil {
+			t.Errorf("%s: error starting authentication over TLS: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// smtpKeepAliveInterval is the maximal interval between two NOOPs on an idle connection
+const smtpKeepAliveInterval = time.Minute
+
+// smtpConnection is an authenticated connection to the SMTP server that can be reused for several mails
+type smtpConnection struct {
+	client     *smtp.Client
+	conn       net.Conn
+	timeout    time.Duration
+	pipelining bool
+	lastUsed   time.Time
+}
+
+// extend sets the deadline of the connection for the next transaction or command
+func (conn *smtpConnection) extend() {
+	conn.conn.SetDeadline(time.Now().Add(conn.timeout))
+}
+
+// send transfers one envelope, pipelined if the server supports it
+func (conn *smtpConnection) send(envelope *Envelope) error {
+	conn.extend()
+	if conn.pipelining {
+		return transferPipelined(conn.client, envelope)
+	}
+	return transfer(conn.client, envelope)
+}
+
+// acquire returns an idle connection that is still alive, or a new one.
+// Idle connections are checked with RSET, connections that the server has closed in the meantime are dropped.
+func (server *MailServer) acquire() (*smtpConnection, error) {
+	for {
+		conn := server.popIdle()
+		if conn == nil {
+			break
+		}
+		conn.extend()
+		if err := conn.client.Reset(); err == nil {
+			return conn, nil
+		}
+		conn.client.Close()
+	}
+	return server.connect()
+}
+
+// connect dials the SMTP server and authenticates. Errors are never permanent SMTP errors,
+// even if the server rejected the credentials with a 5xx code, another relay may still accept the mail.
+func (server *MailServer) connect() (*smtpConnection, error) {
+	// Connect to the remote SMTP server, secured according to the TLS mode
+	client, netConn, err := dialSMTP(server.host, server.port, server.tlsMode, server.tlsConfig, "", server.timeout)
+	if err != nil {
+		log.Printf("Dial")
+		return nil, fmt.Errorf("connect to %v failed: %v", server.host, err)
+	}
+
+	// Use Auth, credentials are never sent over an unencrypted connection to a remote host
+	if err = server.authenticate(client); err != nil {
+		log.Printf("Auth")
+		client.Close()
+		return nil, fmt.Errorf("auth with %v failed: %v", server.host, err)
+	}
+	pipelining, _ := client.Extension("PIPELINING")
+	return &smtpConnection{client: client, conn: netConn, timeout: server.timeout, pipelining: pipelining}, nil
+}
+
+// release puts a connection into the idle pool, or closes it if pooling is disabled
+func (server *MailServer) release(conn *smtpConnection) {
+	if server.idleTimeout <= 0 {
+		// the mail has been accepted already, an error on QUIT does not matter
+		conn.extend()
+		if err := conn.client.Quit(); err != nil {
+			log.Printf("quit: %v", err)
+			conn.client.Close()
+		}
+		return
+	}
+	conn.lastUsed = time.Now()
+	server.Lock()
+	defer server.Unlock()
+	server.idle = append(server.idle, conn)
+}
+
+// popIdle returns the most recently used idle connection, expired connections are closed
+func (server *MailServer) popIdle() *smtpConnection {
+	server.Lock()
+	defer server.Unlock()
+	for len(server.idle) > 0 {
+		conn := server.idle[len(server.idle)-1]
+		server.idle = server.idle[:len(server.idle)-1]
+		if time.Since(conn.lastUsed) <= server.idleTimeout {
+			return conn
+		}
+		conn.extend()
+		go conn.client.Quit()
+	}
+	return nil
+}
+
+// KeepAlive closes expired idle connections and sends a NOOP over the others, so that the server does not time them out.
+// It returns the number of connections that are still idle.
+func (server *MailServer) KeepAlive() int {
+	server.Lock()
+	idle := server.idle
+	server.idle = nil
+	server.Unlock()
+
+	var alive []*smtpConnection
+	for _, conn := range idle {
+		conn.extend()
+		if time.Since(conn.lastUsed) > server.idleTimeout {
+			conn.client.Quit()
+			continue
+		}
+		if err := conn.client.Noop(); err != nil {
+			conn.client.Close()
+			continue
+		}
+		alive = append(alive, conn)
+	}
+
+	server.Lock()
+	defer server.Unlock()
+	server.idle = append(alive, server.idle...)
+	return len(server.idle)
+}
+
+// Close quits all idle connections
+func (server *MailServer) Close() {
+	server.Lock()
+	idle := server.idle
+	server.idle = nil
+	server.Unlock()
+	for _, conn := range idle {
+		conn.extend()
+		conn.client.Quit()
+	}
+}
+
+// SetupTicker keeps the idle connections alive
+func (server *MailServer) SetupTicker() {
+	interval := server.idleTimeout / 2
+	if interval > smtpKeepAliveInterval {
+		interval = smtpKeepAliveInterval
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			server.KeepAlive()
+		}
+	}()
+}
+
+// transferPipelined sends MAIL, RCPT and DATA without waiting for the single responses (RFC 2920).
+// The connection must be closed if an error is returned, the transaction may still be open.
+func transferPipelined(client *smtp.Client, envelope *Envelope) error {
+	text := client.Text
+	commands := []string{"MAIL FROM:<" + envelope.From + ">"}
+	for _, to := range envelope.To {
+		commands = append(commands, "RCPT TO:<"+to+">")
+	}
+	commands = append(commands, "DATA")
+
+	ids := make([]uint, len(commands))
+	for i, command := range commands {
+		id, err := text.Cmd("%s", command)
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+
+	// read the responses in order, MAIL needs 250, RCPT 250 or 251 and DATA 354
+	var firstErr error
+	for i, id := range ids {
+		expected := 25
+		switch i {
+		case 0:
+			expected = 250
+		case len(ids) - 1:
+			expected = 354
+		}
+		text.StartResponse(id)
+		_, _, err := text.ReadResponse(expected)
+		text.EndResponse(id)
+		if err != nil && firstErr == nil {
+			log.Printf("%s", strings.Fields(commands[i])[0])
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	wc := text.DotWriter()
+	if _, err := wc.Write(envelope.Data); err != nil {
+		log.Printf("print body")
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		log.Printf("close")
+		return err
+	}
+	_, _, err := text.ReadResponse(250)
+	return err
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMailServer_PoolReusesConnections(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	config.SMTPIdleTimeout = 60
+	ms := newTestMailServer(t, config)
+	defer ms.Close()
+	for i := 0; i < 3; i++ {
+		if err := ms.Send(newTestMessage()); err != nil {
+			t.Fatalf("Error sending mail %d: %v", i, err)
+		}
+	}
+	if n := len(server.delivered()); n != 3 {
+		t.Errorf("Expected 3 delivered messages, got %d", n)
+	}
+	if n := server.connectionCount(); n != 1 {
+		t.Errorf("Expected 1 connection, got %d", n)
+	}
+}
+
+func TestMailServer_NoPool(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	ms := newTestMailServer(t, config)
+	defer ms.Close()
+	for i := 0; i < 2; i++ {
+		if err := ms.Send(newTestMessage()); err != nil {
+			t.Fatalf("Error sending mail %d: %v", i, err)
+		}
+	}
+	if n := server.connectionCount(); n != 2 {
+		t.Errorf("Expected 2 connections without pooling, got %d", n)
+	}
+}
+
+func TestMailServer_PoolReconnects(t *testing.T) {
+	t.Parallel()
+	// the server drops every connection after one message
+	server := &fakeSMTPServer{maxMessages: 1}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	config.SMTPIdleTimeout = 60
+	ms := newTestMailServer(t, config)
+	defer ms.Close()
+	for i := 0; i < 3; i++ {
+		if err := ms.Send(newTestMessage()); err != nil {
+			t.Fatalf("Error sending mail %d over a dropped connection: %v", i, err)
+		}
+	}
+	if n := server.connectionCount(); n != 3 {
+		t.Errorf("Expected 3 connections, got %d", n)
+	}
+}
+
+func TestMailServer_PoolMaxConnections(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	config.SMTPIdleTimeout = 60
+	config.SMTPMaxConnections = 2
+	ms := newTestMailServer(t, config)
+	defer ms.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ms.Send(newTestMessage()); err != nil {
+				t.Errorf("Error sending mail: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(server.delivered()); n != 10 {
+		t.Errorf("Expected 10 delivered messages, got %d", n)
+	}
+	if n := server.connectionCount(); n > 2 {
+		t.Errorf("Expected at most 2 connections, got %d", n)
+	}
+}
+
+func TestMailServer_KeepAlive(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	config.SMTPIdleTimeout = 60
+	ms := newTestMailServer(t, config)
+	defer ms.Close()
+	if err := ms.Send(newTestMessage()); err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+	if n := ms.KeepAlive(); n != 1 {
+		t.Errorf("Expected 1 idle connection, got %d", n)
+	}
+
+	// expire the idle connection
+	ms.idleTimeout = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if n := ms.KeepAlive(); n != 0 {
+		t.Errorf("Expected no idle connection after the idle timeout, got %d", n)
+	}
+}
+
+func TestMailServer_Pipelining(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{pipelining: true}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	config.SMTPIdleTimeout = 60
+	ms := newTestMailServer(t, config)
+	defer ms.Close()
+	for i := 0; i < 2; i++ {
+		if err := ms.Send(newTestMessage()); err != nil {
+			t.Fatalf("Error sending pipelined mail %d: %v", i, err)
+		}
+	}
+	messages := server.delivered()
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 delivered messages, got %d", len(messages))
+	}
+	for _, message := range messages {
+		if message.from != "FROM:<noreply@example.com>" || len(message.to) != 1 || !strings.Contains(message.data, "BODY") {
+			t.Errorf("Wrong pipelined message: %+v", message)
+		}
+	}
+	if n := server.connectionCount(); n != 1 {
+		t.Errorf("Expected 1 connection, got %d", n)
+	}
+}
+
+func TestMailServer_PipeliningRejectedRecipient(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{pipelining: true, rcptReply: "550 no such user"}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	config.SMTPIdleTimeout = 60
+	ms := newTestMailServer(t, config)
+	defer ms.Close()
+	if err := ms.Send(newTestMessage()); err == nil {
+		t.Fatalf("Error: mail to a rejected recipient was sent")
+	}
+	if n := len(server.delivered()); n != 0 {
+		t.Errorf("Expected no delivered message, got %d", n)
+	}
+	if n := ms.KeepAlive(); n != 0 {
+		t.Errorf("The failed connection must not be reused, got %d idle connections", n)
+	}
+}
+
+func TestMailServer_StalledServer(t *testing.T) {
+	t.Parallel()
+	// accept the connection but never send the greeting
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(5 * time.Second)
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	ms := newTestMailServer(t, &SMTPConfig{SMTPHost: host, SMTPPort: port, SMTPTLS: SMTPTLSNone})
+	ms.timeout = 100 * time.Millisecond
+	start := time.Now()
+	if err := ms.Send(newTestMessage()); err == nil {
+		t.Fatalf("Error: mail to a stalled server was sent")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the send to time out, it took %v", elapsed)
+	}
+}
+
+func TestMailServer_PoolSlotTimeout(t *testing.T) {
+	t.Parallel()
+	server := &fakeSMTPServer{}
+	server.start(t)
+	defer server.close()
+
+	config := server.config()
+	config.SMTPTLS = SMTPTLSNone
+	config.SMTPMaxConnections = 1
+	ms := newTestMailServer(t, config)
+	if ms.acquireTimeout != defaultSMTPAcquireTimeout*time.Second {
+		t.Errorf("Expected the default acquire timeout, got %v", ms.acquireTimeout)
+	}
+	ms.acquireTimeout = 50 * time.Millisecond
+
+	// a stalled delivery holds the only slot
+	ms.slots <- struct{}{}
+	if err := ms.Send(newTestMessage()); err == nil || isPermanentError(err) || !strings.Contains(err.Error(), "no free connection") {
+		t.Errorf("Expected a timeout waiting for a connection slot, got %v", err)
+	}
+	<-ms.slots
+	if err := ms.Send(newTestMessage()); err != nil {
+		t.Errorf("Error sending mail with a free slot: %v", err)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// SpamAccept sends the message as it is
+	SpamAccept = "accept"
+	// SpamTag sends the message with the tag prefix in front of the subject
+	SpamTag = "tag"
+	// SpamQuarantine stores the message in the quarantine directory instead of sending it
+	SpamQuarantine = "quarantine"
+	// SpamReject refuses the send request
+	SpamReject = "reject"
+	// defaultSpamTagPrefix is put in front of the subject of tagged messages
+	defaultSpamTagPrefix = "[SPAM] "
+	// defaultBayesThreshold is the spam probability from which the classifier adds its score
+	defaultBayesThreshold = 0.9
+)
+
+var (
+	// spamURLRe finds links in the text of a message
+	spamURLRe = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+	// spamWordRe splits the text of a message into the words of the Bayesian classifier
+	spamWordRe = regexp.MustCompile(`[\p{L}\p{N}]{2,30}`)
+)
+
+// SpamConfig configures the rules of the spam filter and the actions for their total score.
+// A rule is only used if its main setting is given, a threshold of 0 disables its action.
+type SpamConfig struct {
+	MaxURLs         int      `json:"maxURLs"`
+	URLScore        float64  `json:"urlScore"`
+	Keywords        []string `json:"keywords"`
+	Patterns        []string `json:"patterns"`
+	KeywordScore    float64  `json:"keywordScore"`
+	Scripts         []string `json:"scripts"`
+	MaxForeignRatio float64  `json:"maxForeignRatio"`
+	ForeignScore    float64  `json:"foreignScore"`
+	DuplicateWindow int      `json:"duplicateWindow"`
+	DuplicateScore  float64  `json:"duplicateScore"`
+	BayesDir        string   `json:"bayesDir"`
+	BayesThreshold  float64  `json:"bayesThreshold"`
+	BayesScore      float64  `json:"bayesScore"`
+	TagScore        float64  `json:"tagScore"`
+	QuarantineScore float64  `json:"quarantineScore"`
+	RejectScore     float64  `json:"rejectScore"`
+	TagPrefix       string   `json:"tagPrefix"`
+	patterns        []*regexp.Regexp
+	scripts         []*unicode.RangeTable
+}
+
+// load sets the default scores, compiles the patterns and looks up the scripts
+func (s *SpamConfig) load() error {
+	if s.TagScore == 0 && s.QuarantineScore == 0 && s.RejectScore == 0 {
+		return errors.New("spam filter without tagScore, quarantineScore or rejectScore")
+	}
+	if s.URLScore == 0 {
+		s.URLScore = 1
+	}
+	if s.KeywordScore == 0 {
+		s.KeywordScore = 3
+	}
+	if s.ForeignScore == 0 {
+		s.ForeignScore = 3
+	}
+	if s.DuplicateScore == 0 {
+		s.DuplicateScore = 5
+	}
+	if s.BayesScore == 0 {
+		s.BayesScore = 5
+	}
+	if s.BayesThreshold == 0 {
+		s.BayesThreshold = defaultBayesThreshold
+	}
+	if s.BayesThreshold < 0 || s.BayesThreshold > 1 {
+		return fmt.Errorf("bayesThreshold %v is not between 0 and 1", s.BayesThreshold)
+	}
+	if s.TagPrefix == "" {
+		s.TagPrefix = defaultSpamTagPrefix
+	}
+	if strings.ContainsAny(s.TagPrefix, "\r\n") {
+		return errors.New("tagPrefix must not contain line breaks")
+	}
+	s.patterns = nil
+	for _, pattern := range s.Patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return fmt.Errorf("invalid spam pattern %q: %v", pattern, err)
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	s.scripts = nil
+	for _, name := range s.Scripts {
+		script, found := unicode.Scripts[name]
+		if !found {
+			return fmt.Errorf("unknown script %q", name)
+		}
+		s.scripts = append(s.scripts, script)
+	}
+	return nil
+}
+
+// SpamRule is one rule of the spam filter chain. It returns the score of the message, and the reason for the log if the score is not 0.
+type SpamRule interface {
+	Score(mail *EmailMessage) (float64, string)
+}
+
+// SpamVerdict is the result of the spam filter for a message
+type SpamVerdict struct {
+	Score   float64
+	Action  string
+	Reasons []string
+}
+
+// SpamFilter runs the message through all rules and maps the total score to an action
+type SpamFilter struct {
+	rules           []SpamRule
+	duplicates      *duplicateRule
+	tagScore        float64
+	quarantineScore float64
+	rejectScore     float64
+	tagPrefix       string
+	cleanupInterval int
+}
+
+// InitSpamFilter is the factory method to initialize the SpamFilter with the rules of the config
+func InitSpamFilter(config *ApplicationConfig) (*SpamFilter, error) {
+	f, err := newSpamFilter(config)
+	if err != nil {
+		return nil, err
+	}
+	f.SetupTicker()
+	return f, nil
+}
+
+// newSpamFilter returns a SpamFilter without starting the cleanup ticker. The Bayesian classifier is trained here.
+func newSpamFilter(config *ApplicationConfig) (*SpamFilter, error) {
+	s := config.Spam
+	f := &SpamFilter{
+		tagScore:        s.TagScore,
+		quarantineScore: s.QuarantineScore,
+		rejectScore:     s.RejectScore,
+		tagPrefix:       s.TagPrefix,
+		cleanupInterval: config.CleanupInterval,
+	}
+	if s.MaxURLs > 0 {
+		f.rules = append(f.rules, &urlRule{max: s.MaxURLs, score: s.URLScore})
+	}
+	if len(s.Keywords) > 0 || len(s.patterns) > 0 {
+		f.rules = append(f.rules, &keywordRule{keywords: s.Keywords, patterns: s.patterns, score: s.KeywordScore})
+	}
+	if len(s.scripts) > 0 {
+		f.rules = append(f.rules, &scriptRule{scripts: s.scripts, maxRatio: s.MaxForeignRatio, score: s.ForeignScore})
+	}
+	if s.DuplicateWindow > 0 {
+		f.duplicates = &duplicateRule{
+			window: time.Duration(s.DuplicateWindow) * time.Second,
+			score:  s.DuplicateScore,
+			seen:   make(map[[sha256.Size]byte]time.Time),
+		}
+		f.rules = append(f.rules, f.duplicates)
+	}
+	if s.BayesDir != "" {
+		classifier, err := trainBayes(s.BayesDir)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, &bayesRule{classifier: classifier, threshold: s.BayesThreshold, score: s.BayesScore})
+	}
+	return f, nil
+}
+
+// Check scores the message with all rules. The action is the one with the highest threshold that the score reaches.
+func (f *SpamFilter) Check(mail *EmailMessage) *SpamVerdict {
+	verdict := &SpamVerdict{Action: SpamAccept}
+	for _, rule := range f.rules {
+		score, reason := rule.Score(mail)
+		if score != 0 {
+			verdict.Score += score
+			verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("%s (%+g)", reason, score))
+		}
+	}
+	switch {
+	case f.rejectScore > 0 && verdict.Score >= f.rejectScore:
+		verdict.Action = SpamReject
+	case f.quarantineScore > 0 && verdict.Score >= f.quarantineScore:
+		verdict.Action = SpamQuarantine
+	case f.tagScore > 0 && verdict.Score >= f.tagScore:
+		verdict.Action = SpamTag
+	}
+	return verdict
+}
+
+// Clean forgets the bodies that are older than the duplicate window and returns how many were forgotten
+func (f *SpamFilter) Clean() int {
+	if f.duplicates == nil {
+		return 0
+	}
+	return f.duplicates.clean(time.Now())
+}
+
+// SetupTicker creates a ticker that calls Clean() in regular intervals (config.CleanupInterval)
+func (f *SpamFilter) SetupTicker() {
+	if f.duplicates == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Second * time.Duration(f.cleanupInterval))
+	go func() {
+		for t := range ticker.C {
+			deleted := f.Clean()
+			if deleted > 0 {
+				log.Printf("[%s] Cleaning up %d remembered message bodies", t, deleted)
+			}
+		}
+	}()
+}
+
+// spamText returns the text of the message that the rules look at: subject, body and the values of the custom fields
+func spamText(mail *EmailMessage) string {
+	parts := []string{mail.subject, mail.body}
+	names := make([]string, 0, len(mail.fields))
+	for name := range mail.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, mail.fields[name])
+	}
+	return strings.Join(parts, "\n")
+}
+
+// urlRule scores every link beyond the allowed number
+type urlRule struct {
+	max   int
+	score float64
+}
+
+// Score implements SpamRule
+func (r *urlRule) Score(mail *EmailMessage) (float64, string) {
+	count := len(spamURLRe.FindAllString(spamText(mail), -1))
+	if count <= r.max {
+		return 0, ""
+	}
+	return float64(count-r.max) * r.score, fmt.Sprintf("%d links", count)
+}
+
+// keywordRule scores every blocked keyword and pattern that is found, keywords are compared case insensitive
+type keywordRule struct {
+	keywords []string
+	patterns []*regexp.Regexp
+	score    float64
+}
+
+// Score implements SpamRule
+func (r *keywordRule) Score(mail *EmailMessage) (float64, string) {
+	text := spamText(mail)
+	lower := strings.ToLower(text)
+	var found []string
+	for _, keyword := range r.keywords {
+		if strings.Contains(lower, strings.ToLower(keyword)) {
+			found = append(found, keyword)
+		}
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(text) {
+			found = append(found, re.String())
+		}
+	}
+	if len(found) == 0 {
+		return 0, ""
+	}
+	return float64(len(found)) * r.score, "blocked words " + strings.Join(found, ", ")
+}
+
+// scriptRule scores messages whose letters are too often not in one of the expected scripts
+type scriptRule struct {
+	scripts  []*unicode.RangeTable
+	maxRatio float64
+	score    float64
+}
+
+// Score implements SpamRule
+func (r *scriptRule) Score(mail *EmailMessage) (float64, string) {
+	letters, foreign := 0, 0
+	for _, c := range spamText(mail) {
+		if !unicode.IsLetter(c) {
+			continue
+		}
+		letters++
+		if !unicode.In(c, r.scripts...) {
+			foreign++
+		}
+	}
+	if letters == 0 {
+		return 0, ""
+	}
+	ratio := float64(foreign) / float64(letters)
+	if ratio <= r.maxRatio {
+		return 0, ""
+	}
+	return r.score, fmt.Sprintf("%.0f%% foreign letters", ratio*100)
+}
+
+// duplicateRule scores bodies that have been submitted before within the window. Only a hash of the
+// normalized body is remembered.
+type duplicateRule struct {
+	window time.Duration
+	score  float64
+	seen   map[[sha256.Size]byte]time.Time
+	sync.Mutex
+}
+
+// Score implements SpamRule, the body is remembered for the next messages
+func (r *duplicateRule) Score(mail *EmailMessage) (float64, string) {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.Join(strings.Fields(mail.body), " "))))
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	last, found := r.seen[hash]
+	r.seen[hash] = now
+	if found && now.Sub(last) < r.window {
+		return r.score, "duplicate body"
+	}
+	return 0, ""
+}
+
+// clean forgets the bodies that have not been seen within the window
+func (r *duplicateRule) clean(now time.Time) int {
+	r.Lock()
+	defer r.Unlock()
+	i := 0
+	for hash, last := range r.seen {
+		if now.Sub(last) >= r.window {
+			delete(r.seen, hash)
+			i++
+		}
+	}
+	return i
+}
+
+// bayesRule scores messages that the classifier rates as spam with at least the threshold
+type bayesRule struct {
+	classifier *bayesClassifier
+	threshold  float64
+	score      float64
+}
+
+// Score implements SpamRule
+func (r *bayesRule) Score(mail *EmailMessage) (float64, string) {
+	p := r.classifier.spamProbability(spamText(mail))
+	if p < r.threshold {
+		return 0, ""
+	}
+	return r.score, fmt.Sprintf("spam probability %.2f", p)
+}
+
+// bayesClassifier is a naive Bayesian classifier over the words of a message. It is trained once
+// on startup and not changed afterwards, so it needs no lock.
+type bayesClassifier struct {
+	ham, spam           map[string]int
+	hamWords, spamWords int
+	hamDocs, spamDocs   int
+	vocabulary          int
+}
+
+// trainBayes trains a classifier with the files in the ham and spam sub directories of dir.
+// Every file is one sample message.
+func trainBayes(dir string) (*bayesClassifier, error) {
+	c := &bayesClassifier{ham: make(map[string]int), spam: make(map[string]int)}
+	var err error
+	if c.hamDocs, c.hamWords, err = trainBayesDir(filepath.Join(dir, "ham"), c.ham); err != nil {
+		return nil, err
+	}
+	if c.spamDocs, c.spamWords, err = trainBayesDir(filepath.Join(dir, "spam"), c.spam); err != nil {
+		return nil, err
+	}
+	if c.hamDocs == 0 || c.spamDocs == 0 {
+		return nil, fmt.Errorf("bayes directory %v needs ham and spam samples", dir)
+	}
+	words := make(map[string]bool)
+	for word := range c.ham {
+		words[word] = true
+	}
+	for word := range c.spam {
+		words[word] = true
+	}
+	c.vocabulary = len(words)
+	return c, nil
+}
+
+// trainBayesDir counts the words of all files in dir and returns the number of files and words
+func trainBayesDir(dir string, counts map[string]int) (int, int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	docs, total := 0, 0
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return 0, 0, err
+		}
+		for word := range bayesWords(string(raw)) {
+			counts[word]++
+			total++
+		}
+		docs++
+	}
+	return docs, total, nil
+}
+
+// bayesWords returns the distinct lower case words of the text
+func bayesWords(text string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range spamWordRe.FindAllString(strings.ToLower(text), -1) {
+		words[word] = true
+	}
+	return words
+}
+
+// spamProbability returns the probability that the text is spam, the word probabilities are smoothed
+// so that unknown words do not decide alone
+func (c *bayesClassifier) spamProbability(text string) float64 {
+	logHam := math.Log(float64(c.hamDocs) / float64(c.hamDocs+c.spamDocs))
+	logSpam := math.Log(float64(c.spamDocs) / float64(c.hamDocs+c.spamDocs))
+	for word := range bayesWords(text) {
+		logHam += math.Log(float64(c.ham[word]+1) / float64(c.hamWords+c.vocabulary))
+		logSpam += math.Log(float64(c.spam[word]+1) / float64(c.spamWords+c.vocabulary))
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpamFilter_Rules(t *testing.T) {
+	t.Parallel()
+	filter := newTestSpamFilter(t, &SpamConfig{
+		MaxURLs:         1,
+		Keywords:        []string{"Casino"},
+		Patterns:        []string{`crypto\s+invest`},
+		Scripts:         []string{"Latin"},
+		MaxForeignRatio: 0.5,
+		DuplicateWindow: 60,
+		TagScore:        1,
+	})
+
+	// in order, the last message repeats the first one
+	messages := []struct {
+		body  string
+		score float64
+	}{
+		{"Hello, I have a question about your product.", 0},
+		{"See https://example.com for details", 0},
+		{"See https://a.example.com, http://b.example.com and www.c.example", 2},
+		{"Best CASINO bonus", 3},
+		{"Crypto  Investment in the casino", 6},
+		{"Привет, это сообщение на русском языке", 3},
+		{"Hello Привет", 0},
+		{"Hello, I have a question about your  product.\n", 5},
+	}
+	for _, m := range messages {
+		verdict := filter.Check(&EmailMessage{subject: "Question", body: m.body})
+		if verdict.Score != m.score {
+			t.Errorf("Error: score of %q is %v, should be %v: %v", m.body, verdict.Score, m.score, verdict.Reasons)
+		}
+	}
+
+	// custom fields are scored as well
+	verdict := filter.Check(&EmailMessage{subject: "Question", body: "Another question", fields: map[string]string{"website": "casino"}})
+	if verdict.Score != 3 {
+		t.Errorf("Error: custom field should be scored, score is %v", verdict.Score)
+	}
+}
+
+func TestSpamFilter_Actions(t *testing.T) {
+	t.Parallel()
+	filter := newTestSpamFilter(t, &SpamConfig{
+		Keywords:        []string{"one", "two", "three"},
+		KeywordScore:    1,
+		TagScore:        1,
+		QuarantineScore: 2,
+		RejectScore:     3,
+	})
+	actions := map[string]string{
+		"nothing":         SpamAccept,
+		"one":             SpamTag,
+		"one two":         SpamQuarantine,
+		"one two three":   SpamReject,
+		"three two three": SpamQuarantine,
+	}
+	for body, expected := range actions {
+		if verdict := filter.Check(&EmailMessage{subject: "Subject", body: body}); verdict.Action != expected {
+			t.Errorf("Error: action for %q is %v, should be %v", body, verdict.Action, expected)
+		}
+	}
+}
+
+func TestSpamFilter_Duplicates(t *testing.T) {
+	t.Parallel()
+	filter := newTestSpamFilter(t, &SpamConfig{DuplicateWindow: 1, TagScore: 1})
+
+	if verdict := filter.Check(&EmailMessage{body: "Same   body"}); verdict.Action != SpamAccept {
+		t.Errorf("Error: first body should be accepted, got %v", verdict.Action)
+	}
+	if verdict := filter.Check(&EmailMessage{body: "same body"}); verdict.Action != SpamTag {
+		t.Errorf("Error: duplicate body should be tagged, got %v", verdict.Action)
+	}
+	if cleaned := filter.duplicates.clean(time.Now().Add(2 * time.Second)); cleaned != 1 {
+		t.Errorf("Error: clean should forget 1 body, forgot %v", cleaned)
+	}
+	if verdict := filter.Check(&EmailMessage{body: "same body"}); verdict.Action != SpamAccept {
+		t.Errorf("Error: body should be accepted after the window, got %v", verdict.Action)
+	}
+}
+
+func TestSpamFilter_Bayes(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-bayes")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	samples := map[string][]string{
+		"ham": {
+			"Hello, I would like to know the opening hours of your shop.",
+			"Could you send me an offer for the repair of my bicycle?",
+			"Thank you for the quick delivery, the order arrived today.",
+		},
+		"spam": {
+			"Cheap pills online, buy now without prescription.",
+			"Earn money fast, buy cheap followers now.",
+			"Buy cheap watches online now, limited offer.",
+		},
+	}
+	for class, texts := range samples {
+		os.MkdirAll(filepath.Join(dir, class), 0700)
+		for i, text := range texts {
+			ioutil.WriteFile(filepath.Join(dir, class, string(rune('a'+i))+".txt"), []byte(text), 0600)
+		}
+	}
+
+	filter := newTestSpamFilter(t, &SpamConfig{BayesDir: dir, BayesThreshold: 0.8, TagScore: 1})
+	if verdict := filter.Check(&EmailMessage{subject: "Buy now", body: "cheap pills online"}); verdict.Action != SpamTag {
+		t.Errorf("Error: spam should be tagged, got %v: %v", verdict.Action, verdict.Reasons)
+	}
+	if verdict := filter.Check(&EmailMessage{subject: "Opening hours", body: "When is your shop open? Thank you"}); verdict.Action != SpamAccept {
+		t.Errorf("Error: ham should be accepted, got %v: %v", verdict.Action, verdict.Reasons)
+	}
+
+	config := &ApplicationConfig{Spam: &SpamConfig{BayesDir: filepath.Join(dir, "missing"), TagScore: 1}}
+	config.Spam.load()
+	if _, err := newSpamFilter(config); err == nil {
+		t.Errorf("Error: missing bayes directory should return error")
+	}
+}
+
+func TestSpamConfig_Load(t *testing.T) {
+	t.Parallel()
+	invalid := []*SpamConfig{
+		{Keywords: []string{"casino"}},
+		{Patterns: []string{"("}, TagScore: 1},
+		{Scripts: []string{"Klingon"}, TagScore: 1},
+		{BayesThreshold: 2, TagScore: 1},
+		{TagPrefix: "[SPAM]\r\nBcc: x@example.com", TagScore: 1},
+	}
+	for _, spam := range invalid {
+		if err := spam.load(); err == nil {
+			t.Errorf("Error: invalid spam config %+v should return error", spam)
+		}
+	}
+	config := &ApplicationConfig{Spam: &SpamConfig{QuarantineScore: 5}}
+	if err := config.validateConfig(); err == nil {
+		t.Errorf("Error: quarantineScore without quarantineDir should return error")
+	}
+}
+
+func TestController_Spam(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mailbridge-quarantine")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ms := &MockMailServer{}
+	c := newController(ms, &MockActiveTokens{}, &MockTarpit{})
+	c.spam = newTestSpamFilter(t, &SpamConfig{
+		Keywords:        []string{"one", "two", "three"},
+		KeywordScore:    1,
+		TagScore:        1,
+		QuarantineScore: 2,
+		RejectScore:     3,
+	})
+	c.quarantine, err = newQuarantine(&ApplicationConfig{QuarantineDir: dir})
+	if err != nil {
+		t.Fatalf("Error initializing quarantine: %v", err)
+	}
+	send := func(body string) int {
+		msg := `{"Token": "TOKEN","From": "from@example.com", "To": "TO", "Subject": "SUBJECT", "Body": "` + body + `"}`
+		req, _ := http.NewRequest("POST", "/send", strings.NewReader(msg))
+		return doRequestController(req, c).Code
+	}
+
+	if status := send("one two three"); status != http.StatusBadRequest || ms.sent != nil {
+		t.Errorf("Error: rejected message answered %d, should be %d and not be sent", status, http.StatusBadRequest)
+	}
+	if status := send("one two"); status != http.StatusCreated || ms.sent != nil {
+		t.Errorf("Error: quarantined message answered %d, should be %d and not be sent", status, http.StatusCreated)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("Error: quarantine should hold 1 message, holds %v", len(files))
+	}
+	raw, _ := ioutil.ReadFile(files[0])
+	var qm QueuedMessage
+	if err := json.Unmarshal(raw, &qm); err != nil || qm.Message.body != "one two" || !strings.Contains(qm.LastError, "spam score 2") {
+		t.Errorf("Error: quarantined message is not readable by the mail queue: %v %+v", err, qm)
+	}
+
+	if status := send("one"); status != http.StatusCreated || ms.sent == nil {
+		t.Fatalf("Error: tagged message answered %d, should be %d and be sent", status, http.StatusCreated)
+	}
+	if ms.sent.recipientSubject() != defaultSpamTagPrefix+"SUBJECT" || ms.sent.subject != "SUBJECT" {
+		t.Errorf("Error: tagged message has subject %q for the recipient", ms.sent.recipientSubject())
+	}
+}
+
+func TestSpamFilter_TagOnlyForRecipient(t *testing.T) {
+	t.Parallel()
+	recipients := getAutoReplyRecipients(t)
+	composer := &Composer{sender: "noreply@example.com", recipientMap: map[string]string{"id1": "to@example.com"}, recipients: recipients}
+	msg := newTestMessage()
+	msg.spamTag = defaultSpamTagPrefix
+
+	envelope, err := composer.Compose(msg)
+	if err != nil {
+		t.Fatalf("Error composing the message: %v", err)
+	}
+	if !strings.Contains(string(envelope.Data), "Subject: [SPAM] SUBJECT") {
+		t.Errorf("The message to the recipient must be tagged, got %s", envelope.Data)
+	}
+
+	// the acknowledgement to the submitter does not reveal the tag
+	reply := *msg
+	reply.autoReply = true
+	envelope, err = composer.Compose(&reply)
+	if err != nil {
+		t.Fatalf("Error composing the auto reply: %v", err)
+	}
+	if strings.Contains(string(envelope.Data), "[SPAM]") {
+		t.Errorf("The auto reply must not be tagged, got %s", envelope.Data)
+	}
+}
+
+// HELPER METHODS
+func newTestSpamFilter(t *testing.T, spam *SpamConfig) *SpamFilter {
+	if err := spam.load(); err != nil {
+		t.Fatalf("Error loading spam config: %v", err)
+	}
+	filter, err := newSpamFilter(&ApplicationConfig{Spam: spam, CleanupInterval: 60})
+	if err != nil {
+		t.Fatalf("Error creating spam filter: %v", err)
+	}
+	return filter
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"container/heap"
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,14 +21,45 @@ type Token struct {
 	d       [2]byte
 	e       [6]byte
 	Expires time.Time
+	// Issued is the time when the token was handed out, to reject forms that were filled too fast
+	Issued time.Time
+	// signature is only set for stateless tokens, see SignedTokens
+	signature []byte
 }
 
-// String returns a string representation of the token without expiration datetime
+// String returns a string representation of the token without expiration datetime.
+// Signed tokens additionally carry their expiration and signature.
 func (token *Token) String() string {
+	if token.signature == nil {
+		return token.id()
+	}
+	return fmt.Sprintf("%s.%d.%X", token.id(), token.Expires.Unix(), token.signature)
+}
+
+// id returns the random identifier of the token
+func (token *Token) id() string {
 	return fmt.Sprintf("%X-%X-%X-%X-%X", token.a, token.b, token.c, token.d, token.e)
 }
 
-// Init Initializes a new random token and sets the expiration to the provided lifetime parameter [seconds] in future
+// parseToken restores a token from its string representation and the given expiration
+func parseToken(key string, expires time.Time) (*Token, error) {
+	parts := strings.Split(key, "-")
+	token := &Token{Expires: expires}
+	fields := [][]byte{token.a[:], token.b[:], token.c[:], token.d[:], token.e[:]}
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("malformed token: %v", key)
+	}
+	for i, part := range parts {
+		raw, err := hex.DecodeString(part)
+		if err != nil || len(raw) != len(fields[i]) {
+			return nil, fmt.Errorf("malformed token: %v", key)
+		}
+		copy(fields[i], raw)
+	}
+	return token, nil
+}
+
+// Init Initializes a new random token, records the time of issue and sets the expiration to the provided lifetime parameter [seconds] in future
 func (token *Token) Init(lifetime int) error {
 	// identifier
 	buf := make([]byte, 16)
@@ -38,23 +74,58 @@ func (token *Token) Init(lifetime int) error {
 	copy(token.d[:], buf[8:10])
 	copy(token.e[:], buf[10:])
 
-	// expiration
-	token.Expires = time.Now().Add(time.Duration(lifetime) * time.Second)
+	// issue and expiration
+	token.Issued = time.Now()
+	token.Expires = token.Issued.Add(time.Duration(lifetime) * time.Second)
 	return nil
 }
 
 // ActiveTokensInterface for being able to mock ActiveTokens
 type ActiveTokensInterface interface {
 	New() (*Token, error)
-	Validate(key string) error
+	Validate(key string) (*Token, error)
 	Clean() int
 	SetupTicker()
 }
 
+// tokenShards is the number of independently locked parts of the ActiveTokens map
+const tokenShards = 16
+
+// tokenExpiry is an entry of the expiration heap of a token shard
+type tokenExpiry struct {
+	key     string
+	expires time.Time
+}
+
+// tokenExpiryHeap implements heap.Interface, the token that expires first is on top
+type tokenExpiryHeap []tokenExpiry
+
+func (h tokenExpiryHeap) Len() int            { return len(h) }
+func (h tokenExpiryHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h tokenExpiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *tokenExpiryHeap) Push(x interface{}) { *h = append(*h, x.(tokenExpiry)) }
+func (h *tokenExpiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// tokenShard is one part of the ActiveTokens map with its own lock. Besides the map, every shard
+// keeps a heap of expirations, so that Clean only needs to look at the tokens that are expired.
+// Tokens that have been validated stay in the heap until they expire.
+type tokenShard struct {
+	tokens map[string]*Token
+	expiry tokenExpiryHeap
+	sync.Mutex
+}
+
 // ActiveTokens is an in memory structure that will hold all active tokens during application lifetime
 // Beware: If this application dies, all active tokens die with it...
+// It is safe for concurrent use, the tokens are distributed over several shards that are locked independently.
 type ActiveTokens struct {
-	Tokens          map[string]*Token
+	shards          [tokenShards]*tokenShard
 	lifetime        int
 	cleanupInterval int
 }
@@ -70,47 +141,57 @@ func (at *ActiveTokens) New() (*Token, error) {
 	// get string representation
 	key := token.String()
 
+	shard := at.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
 	// check whether the Token exists already:
-	_, exists := at.Tokens[key]
+	_, exists := shard.tokens[key]
 	if exists {
 		return nil, errors.New("freshly initialized key exists already in the table")
 	}
 
 	// add to map
-	at.Tokens[key] = token
+	shard.add(key, token)
 	return token, nil
 }
 
 // Validate will check that a provided token indeed is in the ActiveTokens map and is not expired.
 // It will delete the token so it can not be used a second time.
 // An error is returned if  something went wrong or the token did not exist or was expired.
-// nil is returned if the token was valid.
-func (at *ActiveTokens) Validate(key string) error {
+// The token is returned if it was valid.
+func (at *ActiveTokens) Validate(key string) (*Token, error) {
+	shard := at.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
 	// check existence
-	token, ok := at.Tokens[key]
+	token, ok := shard.tokens[key]
 	if !ok {
-		return errors.New("token did not exist")
+		return nil, errors.New("token did not exist")
 	}
 
 	// it was found, whether or not it is expired, we will delete it anyway
-	delete(at.Tokens, key)
+	delete(shard.tokens, key)
 
 	// check expiration
 	if time.Now().After(token.Expires) {
-		return errors.New("token already expired")
+		return nil, errors.New("token already expired")
 	}
-	return nil
+	return token, nil
 }
 
-// Clean iterates all tokens in the map and deletes the expired ones
+// Clean deletes the expired tokens, shard by shard
 // this is called regularly by the ticker
 func (at *ActiveTokens) Clean() int {
+	return at.cleanAt(time.Now())
+}
+
+// cleanAt deletes the tokens that are expired at the given time
+func (at *ActiveTokens) cleanAt(now time.Time) int {
 	i := 0
-	for key, token := range at.Tokens {
-		if time.Now().After(token.Expires) {
-			delete(at.Tokens, key)
-			i++
-		}
+	for _, shard := range at.shards {
+		i += shard.clean(now)
 	}
 	return i
 }
@@ -129,15 +210,112 @@ func (at *ActiveTokens) SetupTicker() {
 	}()
 }
 
-// InitActiveTokens is the factory function to initialize the ActiveTokens map
-func InitActiveTokens(config *ApplicationConfig) *ActiveTokens {
+// Len returns the number of tokens in the map, including expired ones that are not cleaned yet
+func (at *ActiveTokens) Len() int {
+	i := 0
+	for _, shard := range at.shards {
+		shard.Lock()
+		i += len(shard.tokens)
+		shard.Unlock()
+	}
+	return i
+}
+
+// get returns the token for the given key if it is in the map
+func (at *ActiveTokens) get(key string) (*Token, bool) {
+	shard := at.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	token, ok := shard.tokens[key]
+	return token, ok
+}
+
+// add puts an existing token into the map, e.g. when tokens are restored from persistent storage
+func (at *ActiveTokens) add(token *Token) {
+	key := token.String()
+	shard := at.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.add(key, token)
+}
+
+// remove deletes the token with the given key from the map without validating it
+func (at *ActiveTokens) remove(key string) {
+	shard := at.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.tokens, key)
+}
+
+// each calls fn for every token in the map. fn must not call back into ActiveTokens.
+func (at *ActiveTokens) each(fn func(key string, token *Token)) {
+	for _, shard := range at.shards {
+		shard.Lock()
+		for key, token := range shard.tokens {
+			fn(key, token)
+		}
+		shard.Unlock()
+	}
+}
+
+// shard returns the shard that is responsible for the given key
+func (at *ActiveTokens) shard(key string) *tokenShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return at.shards[h.Sum32()%tokenShards]
+}
+
+// add puts the token into the shard, the caller must hold the lock
+func (shard *tokenShard) add(key string, token *Token) {
+	shard.tokens[key] = token
+	heap.Push(&shard.expiry, tokenExpiry{key: key, expires: token.Expires})
+}
+
+// clean pops all expirations before now from the heap and deletes the referring tokens
+func (shard *tokenShard) clean(now time.Time) int {
+	shard.Lock()
+	defer shard.Unlock()
+	i := 0
+	for shard.expiry.Len() > 0 && now.After(shard.expiry[0].expires) {
+		entry := heap.Pop(&shard.expiry).(tokenExpiry)
+		// the token may have been validated already, or re-added with another expiration
+		if token, ok := shard.tokens[entry.key]; ok && now.After(token.Expires) {
+			delete(shard.tokens, entry.key)
+			i++
+		}
+	}
+	return i
+}
+
+// newActiveTokens returns an empty ActiveTokens map without starting the cleanup ticker
+func newActiveTokens(config *ApplicationConfig) *ActiveTokens {
 	at := &ActiveTokens{
 		lifetime:        config.Lifetime,
 		cleanupInterval: config.CleanupInterval,
 	}
-	if at.Tokens == nil {
-		at.Tokens = make(map[string]*Token)
+	for i := range at.shards {
+		at.shards[i] = &tokenShard{tokens: make(map[string]*Token)}
 	}
+	return at
+}
+
+// InitActiveTokens is the factory function to initialize the ActiveTokens map
+func InitActiveTokens(config *ApplicationConfig) *ActiveTokens {
+	at := newActiveTokens(config)
 	at.SetupTicker()
 	return at
 }
+
+// InitTokenStore is the factory function that returns the token store selected by config.TokenStore
+func InitTokenStore(config *ApplicationConfig) (ActiveTokensInterface, error) {
+	switch config.TokenStore {
+	case "", "memory":
+		return InitActiveTokens(config), nil
+	case "file":
+		return InitFileTokens(config)
+	case "signed":
+		return InitSignedTokens(config)
+	default:
+		return nil, fmt.Errorf("unknown token store: %v", config.TokenStore)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
+	"sync"
 	"testing"
 	"time"
 )
@@ -49,7 +51,7 @@ func TestActiveTokens_New(t *testing.T) {
 	}
 
 	// validate this token is in the token map:
-	exists, found := activeTokens.Tokens[token.String()]
+	exists, found := activeTokens.get(token.String())
 	if !found {
 		t.Errorf("Error in getting token: Token not in active tokens map")
 	}
@@ -88,13 +90,13 @@ func TestActiveTokens_Clean_TickerExpired(t *testing.T) {
 		t.Errorf("Error in getting token: %v", err)
 	}
 	// validate they are recorded in the map
-	if len(activeTokens.Tokens) != 2 {
-		t.Errorf("Error: active tokens map should be 2 but is %v", len(activeTokens.Tokens))
+	if activeTokens.Len() != 2 {
+		t.Errorf("Error: active tokens map should be 2 but is %v", activeTokens.Len())
 	}
-	if _, found := activeTokens.Tokens[token1.String()]; !found {
+	if _, found := activeTokens.get(token1.String()); !found {
 		t.Errorf("Error: did not find active token 1: %v", token1.String())
 	}
-	if _, found := activeTokens.Tokens[token2.String()]; !found {
+	if _, found := activeTokens.get(token2.String()); !found {
 		t.Errorf("Error: did not find active token 2: %v", token2.String())
 	}
 
@@ -102,13 +104,13 @@ func TestActiveTokens_Clean_TickerExpired(t *testing.T) {
 	time.Sleep(2100 * time.Millisecond)
 
 	// validate they are deleted
-	if len(activeTokens.Tokens) != 0 {
-		t.Errorf("Error: active tokens map should be 0 but is %v", len(activeTokens.Tokens))
+	if activeTokens.Len() != 0 {
+		t.Errorf("Error: active tokens map should be 0 but is %v", activeTokens.Len())
 	}
-	if _, found := activeTokens.Tokens[token1.String()]; found {
+	if _, found := activeTokens.get(token1.String()); found {
 		t.Errorf("Error: active token 1 still exists: %v", token1.String())
 	}
-	if _, found := activeTokens.Tokens[token2.String()]; found {
+	if _, found := activeTokens.get(token2.String()); found {
 		t.Errorf("Error: active token 2 still exists %v", token2.String())
 	}
 }
@@ -130,13 +132,13 @@ func TestActiveTokens_Clean_Direct(t *testing.T) {
 		t.Errorf("Error in getting token: %v", err)
 	}
 	// validate they are recorded in the map
-	if len(activeTokens.Tokens) != 2 {
-		t.Errorf("Error: active tokens map should be 2 but is %v", len(activeTokens.Tokens))
+	if activeTokens.Len() != 2 {
+		t.Errorf("Error: active tokens map should be 2 but is %v", activeTokens.Len())
 	}
-	if _, found := activeTokens.Tokens[token1.String()]; !found {
+	if _, found := activeTokens.get(token1.String()); !found {
 		t.Errorf("Error: did not find active token 1: %v", token1.String())
 	}
-	if _, found := activeTokens.Tokens[token2.String()]; !found {
+	if _, found := activeTokens.get(token2.String()); !found {
 		t.Errorf("Error: did not find active token 2: %v", token2.String())
 	}
 
@@ -147,13 +149,13 @@ func TestActiveTokens_Clean_Direct(t *testing.T) {
 	deleted := activeTokens.Clean()
 
 	// validate they are deleted
-	if len(activeTokens.Tokens) != 0 {
-		t.Errorf("Error: active tokens map should be 0 but is %v", len(activeTokens.Tokens))
+	if activeTokens.Len() != 0 {
+		t.Errorf("Error: active tokens map should be 0 but is %v", activeTokens.Len())
 	}
-	if _, found := activeTokens.Tokens[token1.String()]; found {
+	if _, found := activeTokens.get(token1.String()); found {
 		t.Errorf("Error: active token 1 still exists: %v", token1.String())
 	}
-	if _, found := activeTokens.Tokens[token2.String()]; found {
+	if _, found := activeTokens.get(token2.String()); found {
 		t.Errorf("Error: active token 2 still exists %v", token2.String())
 	}
 	if deleted != 2 {
@@ -179,13 +181,13 @@ func TestActiveTokens_Clean_TickerNonExpired(t *testing.T) {
 		t.Errorf("Error in getting token: %v", err)
 	}
 	// validate they are recorded in the map
-	if len(activeTokens.Tokens) != 2 {
-		t.Errorf("Error: active tokens map should be 2 but is %v", len(activeTokens.Tokens))
+	if activeTokens.Len() != 2 {
+		t.Errorf("Error: active tokens map should be 2 but is %v", activeTokens.Len())
 	}
-	if _, found := activeTokens.Tokens[token1.String()]; !found {
+	if _, found := activeTokens.get(token1.String()); !found {
 		t.Errorf("Error: did not find active token 1: %v", token1.String())
 	}
-	if _, found := activeTokens.Tokens[token2.String()]; !found {
+	if _, found := activeTokens.get(token2.String()); !found {
 		t.Errorf("Error: did not find active token 2: %v", token2.String())
 	}
 
@@ -193,13 +195,13 @@ func TestActiveTokens_Clean_TickerNonExpired(t *testing.T) {
 	time.Sleep(1200 * time.Millisecond)
 
 	// validate they are NOT deleted
-	if len(activeTokens.Tokens) != 2 {
-		t.Errorf("Error: active tokens map should be 2 but is %v", len(activeTokens.Tokens))
+	if activeTokens.Len() != 2 {
+		t.Errorf("Error: active tokens map should be 2 but is %v", activeTokens.Len())
 	}
-	if _, found := activeTokens.Tokens[token1.String()]; !found {
+	if _, found := activeTokens.get(token1.String()); !found {
 		t.Errorf("Error: active token 1 has been cleaned up but should not: %v", token1.String())
 	}
-	if _, found := activeTokens.Tokens[token2.String()]; !found {
+	if _, found := activeTokens.get(token2.String()); !found {
 		t.Errorf("Error: active token 2 has been cleaned up but should not: %v", token2.String())
 	}
 }
@@ -218,20 +220,104 @@ func TestActiveTokens_Validate(t *testing.T) {
 		t.Errorf("Error in getting token: %v", err)
 	}
 	// token must be available
-	if _, found := activeTokens.Tokens[token.String()]; !found {
+	if _, found := activeTokens.get(token.String()); !found {
 		t.Errorf("Error: active token not available: %v", token.String())
 	}
 
 	// run MUT
-	if err := activeTokens.Validate(token.String()); err != nil {
+	valid, err := activeTokens.Validate(token.String())
+	if err != nil {
 		t.Errorf("Error: Token validation returned error: %v", err)
+	} else if !valid.Issued.Equal(token.Issued) || valid.Issued.IsZero() {
+		t.Errorf("Error: validated token has issue time %v, should be %v", valid.Issued, token.Issued)
 	}
 	// now, token must not be available
-	if _, found := activeTokens.Tokens[token.String()]; found {
+	if _, found := activeTokens.get(token.String()); found {
 		t.Errorf("Error: active token is available but should not: %v", token.String())
 	}
 }
 
+func TestActiveTokens_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	// the tokens do not expire during the test, expiry is checked with a time in the future
+	config := getConfig(3600, 1)
+	activeTokens := newActiveTokens(&config)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				token, err := activeTokens.New()
+				if err != nil {
+					errs <- err
+					return
+				}
+				// validate every other token, leave the rest for Clean
+				if j%2 == 0 {
+					if _, err := activeTokens.Validate(token.String()); err != nil {
+						errs <- err
+						return
+					}
+					if _, err := activeTokens.Validate(token.String()); err == nil {
+						errs <- fmt.Errorf("token %v validated twice", token.String())
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				activeTokens.Clean()
+				activeTokens.Len()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Error in concurrent token usage: %v", err)
+	}
+	if n := activeTokens.Len(); n != 20*100 {
+		t.Errorf("Error: expected %d unvalidated tokens but got %d", 20*100, n)
+	}
+
+	// after expiration, all remaining tokens must be cleaned up
+	if deleted := activeTokens.cleanAt(time.Now().Add(2 * time.Hour)); deleted != 20*100 {
+		t.Errorf("clean method returned %v but should have returned %v", deleted, 20*100)
+	}
+	if n := activeTokens.Len(); n != 0 {
+		t.Errorf("Error: active tokens map should be 0 but is %v", n)
+	}
+}
+
+func TestActiveTokens_CleanSkipsValidated(t *testing.T) {
+	t.Parallel()
+
+	config := getConfig(1, 60)
+	activeTokens := newActiveTokens(&config)
+	token, err := activeTokens.New()
+	if err != nil {
+		t.Fatalf("Error in getting token: %v", err)
+	}
+	if _, err := activeTokens.Validate(token.String()); err != nil {
+		t.Fatalf("Error: token validation returned error: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	// the heap still has an entry, but the token is not counted again
+	if deleted := activeTokens.Clean(); deleted != 0 {
+		t.Errorf("clean method returned %v but should have returned 0", deleted)
+	}
+}
+
 func getConfig(lifetime int, cleanupInterval int) ApplicationConfig {
 	config := &ApplicationConfig{}
 	config.CleanupInterval = cleanupInterval